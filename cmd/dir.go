@@ -0,0 +1,167 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// dirOptions select the files sent from a directory. Include and Exclude
+// are glob patterns matched against file names.
+type dirOptions struct {
+	Recursive bool
+	Include   string
+	Exclude   string
+}
+
+// sendDir sends the lines of each file in a directory, with the source set
+// to the file's path unless it is set by -source or the input. Files that
+// cannot be read are logged and skipped. Each sender is used by a worker that
+// sends one file at a time, so files are sent in parallel but the lines of a
+// file are sent in order over the same sender.
+func sendDir(senders []messageSender, dir string, opts dirOptions) error {
+	if _, err := filepath.Match(opts.Include, ""); err != nil {
+		return err
+	}
+	if _, err := filepath.Match(opts.Exclude, ""); err != nil {
+		return err
+	}
+
+	// the queue is bounded so that walking doesn't get far ahead of sending
+	paths := make(chan string, len(senders))
+	errs := make(chan error, len(senders))
+	var wg sync.WaitGroup
+	for _, sender := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range paths {
+				if err := sendFile(sender, path); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			log.Printf("Skipping %s: %v", path, err)
+			return nil
+		}
+		if d.IsDir() {
+			if path != dir && !opts.Recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !opts.matches(d.Name()) {
+			return nil
+		}
+		select {
+		case paths <- path:
+			return nil
+		case err := <-errs:
+			return err
+		}
+	})
+	close(paths)
+	wg.Wait()
+	close(errs)
+	if err != nil {
+		return err
+	}
+	return <-errs
+}
+
+// sendFile sends the lines of a file, or the whole file with -whole-file,
+// logging and skipping it if it cannot be read
+func sendFile(sender messageSender, path string) error {
+	if flagWholeFile {
+		if err := sendWholeFile(sender, path); err != nil {
+			log.Printf("Skipping %s: %v", path, err)
+		}
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		log.Printf("Skipping %s: %v", path, err)
+		return nil
+	}
+	defer file.Close()
+
+	// each file gets a new parser, since parsers such as csv read a header
+	parser, err := newParser()
+	if err != nil {
+		return err
+	}
+	return sendLines(sender, file, sourceParser{inputParser: parser, source: path})
+}
+
+// matches returns true if a file name is included and not excluded
+func (opts dirOptions) matches(name string) bool {
+	if opts.Include != "" {
+		if ok, _ := filepath.Match(opts.Include, name); !ok {
+			return false
+		}
+	}
+	if opts.Exclude != "" {
+		if ok, _ := filepath.Match(opts.Exclude, name); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// sourceParser is an inputParser that sets the source of messages without one
+type sourceParser struct {
+	inputParser
+	source string
+}
+
+// Parse parses a line and sets the message source if the parser did not
+func (p sourceParser) Parse(line string) (*s2s.Message, error) {
+	m, err := p.inputParser.Parse(line)
+	if err == nil && m != nil && m.Source == "" {
+		m.Source = p.source
+	}
+	return m, err
+}
+
+// lockedSender is a messageSender that may be shared by several workers
+type lockedSender struct {
+	mu     sync.Mutex
+	sender messageSender
+}
+
+// SendMessage sends a message while holding the lock
+func (l *lockedSender) SendMessage(m *s2s.Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sender.SendMessage(m)
+}
@@ -0,0 +1,161 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// collectSender is a messageSender that records messages
+type collectSender []*s2s.Message
+
+func (c *collectSender) SendMessage(m *s2s.Message) error {
+	*c = append(*c, m)
+	return nil
+}
+
+func TestSendDir(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.log":         "app line 1\napp line 2\n",
+		"db.log":          "db line\n",
+		"notes.txt":       "notes line\n",
+		"sub/nested.log":  "nested line\n",
+		"sub/skipped.txt": "skipped line\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("MkdirAll() error = %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts dirOptions
+		want []string
+	}{
+		{"all files", dirOptions{}, []string{"app.log", "app.log", "db.log", "notes.txt"}},
+		{"include", dirOptions{Include: "*.log"}, []string{"app.log", "app.log", "db.log"}},
+		{"exclude", dirOptions{Exclude: "app*"}, []string{"db.log", "notes.txt"}},
+		{"recursive", dirOptions{Recursive: true, Include: "*.log"}, []string{"app.log", "app.log", "db.log", "sub/nested.log"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sent collectSender
+			if err := sendDir([]messageSender{&sent}, dir, tt.opts); err != nil {
+				t.Fatalf("sendDir() error = %v", err)
+			}
+			var got []string
+			for _, m := range sent {
+				rel, _ := filepath.Rel(dir, m.Source)
+				got = append(got, filepath.ToSlash(rel))
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("sendDir() sources = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendDirErrors(t *testing.T) {
+	var sent collectSender
+	if err := sendDir([]messageSender{&sent}, filepath.Join(t.TempDir(), "missing"), dirOptions{}); err == nil {
+		t.Error("sendDir() of missing directory succeeded, want error")
+	}
+	if err := sendDir([]messageSender{&sent}, t.TempDir(), dirOptions{Include: "["}); err == nil {
+		t.Error("sendDir() with invalid pattern succeeded, want error")
+	}
+}
+
+func TestSendDirWorkers(t *testing.T) {
+	const numFiles, numLines = 6, 200
+	dir := t.TempDir()
+	for i := 0; i < numFiles; i++ {
+		var content strings.Builder
+		for j := 0; j < numLines; j++ {
+			fmt.Fprintf(&content, "file %d line %d\n", i, j)
+		}
+		if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("%d.log", i)), []byte(content.String()), 0o644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	var mu sync.Mutex
+	received := make(map[string][]string)
+	endpoint := s2s.UnixPrefix + filepath.Join(t.TempDir(), "s2s.sock")
+	server := s2s.NewServer(endpoint)
+	server.Logger = nil
+	server.Handler = s2s.HandlerFunc(func(info s2s.ConnInfo, m *s2s.Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received[m.Source] = append(received[m.Source], m.Raw)
+		return nil
+	})
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	var senders []messageSender
+	for i := 0; i < 3; i++ {
+		conn, err := s2s.Connect(endpoint)
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		senders = append(senders, conn)
+		defer conn.Close()
+	}
+	if err := sendDir(senders, dir, dirOptions{}); err != nil {
+		t.Fatalf("sendDir() error = %v", err)
+	}
+	for _, sender := range senders {
+		sender.(*s2s.Conn).Close()
+	}
+	if err := server.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	if len(received) != numFiles {
+		t.Fatalf("received lines from %d files, want %d", len(received), numFiles)
+	}
+	for i := 0; i < numFiles; i++ {
+		lines := received[filepath.Join(dir, fmt.Sprintf("%d.log", i))]
+		if len(lines) != numLines {
+			t.Errorf("file %d: received %d lines, want %d", i, len(lines), numLines)
+			continue
+		}
+		for j, line := range lines {
+			if want := fmt.Sprintf("file %d line %d", i, j); line != want {
+				t.Errorf("file %d: line %d = %q, want %q", i, j, line, want)
+				break
+			}
+		}
+	}
+}
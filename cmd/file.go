@@ -0,0 +1,57 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// fileSender sends the contents of a file as a single message, such as a
+// *s2s.Conn, which streams the file instead of reading it into memory
+type fileSender interface {
+	SendFile(m *s2s.Message, path string) error
+}
+
+// sendWholeFile sends the contents of a file, or stdin if path is -, as a
+// single message with the metadata and fields from the command line flags.
+// The source is set to the path unless it is set by -source.
+func sendWholeFile(sender messageSender, path string) error {
+	m := newMessage("")
+	if fs, ok := sender.(fileSender); ok && path != "-" {
+		return fs.SendFile(m, path)
+	}
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return err
+	}
+	m.Raw = string(data)
+	if m.Source == "" {
+		m.Source = path
+	}
+	return sender.SendMessage(m)
+}
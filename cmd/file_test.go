@@ -0,0 +1,86 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+func TestSendWholeFile(t *testing.T) {
+	content := "key = value\n[section]\nother = 1\n"
+	path := filepath.Join(t.TempDir(), "app.conf")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	flagIndex, flagSourceType = "main", "config"
+	defer func() { flagIndex, flagSourceType = "", "" }()
+
+	check := func(t *testing.T, m *s2s.Message) {
+		t.Helper()
+		if m.Raw != content {
+			t.Errorf("Raw = %q, want %q", m.Raw, content)
+		}
+		if m.Source != path || m.Index != "main" || m.SourceType != "config" {
+			t.Errorf("received %v, want index=main source=%s sourcetype=config", m, path)
+		}
+	}
+
+	t.Run("offline", func(t *testing.T) {
+		var sender collectSender
+		if err := sendWholeFile(&sender, path); err != nil {
+			t.Fatalf("sendWholeFile() error = %v", err)
+		}
+		if len(sender) != 1 {
+			t.Fatalf("sent %d messages, want 1", len(sender))
+		}
+		check(t, sender[0])
+	})
+
+	t.Run("connection", func(t *testing.T) {
+		endpoint := s2s.UnixPrefix + filepath.Join(t.TempDir(), "s2s.sock")
+		server := s2s.NewServer(endpoint)
+		server.Logger = nil
+		messages := server.Messages()
+		if err := server.Start(); err != nil {
+			t.Fatalf("Start() error = %v", err)
+		}
+		defer server.Stop()
+
+		conn, err := s2s.Connect(endpoint)
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		defer conn.Close()
+
+		if err := sendWholeFile(conn, path); err != nil {
+			t.Fatalf("sendWholeFile() error = %v", err)
+		}
+		select {
+		case m := <-messages:
+			check(t, m)
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for the file")
+		}
+	})
+}
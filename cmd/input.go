@@ -0,0 +1,154 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// inputParser converts a line of input into a message
+type inputParser interface {
+	Parse(line string) (*s2s.Message, error)
+}
+
+// newInputParser returns the parser for an input format: plain, json or csv
+func newInputParser(format string) (inputParser, error) {
+	switch format {
+	case "", "plain":
+		return plainParser{}, nil
+	case "json":
+		return jsonParser{}, nil
+	case "csv":
+		return &csvParser{}, nil
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+}
+
+// plainParser sends each line as the raw event
+type plainParser struct{}
+
+// Parse returns a message with the line as its raw event
+func (plainParser) Parse(line string) (*s2s.Message, error) {
+	return newMessage(line), nil
+}
+
+// jsonParser parses each line as a JSON object
+type jsonParser struct{}
+
+// Parse returns a message with metadata taken from the JSON object's host,
+// source, sourcetype, index and time keys. The raw event is the _raw key, or
+// the whole line if there is none, and other keys become indexed fields.
+func (jsonParser) Parse(line string) (*s2s.Message, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &obj); err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(obj))
+	for k, v := range obj {
+		var s string
+		if err := json.Unmarshal(v, &s); err != nil {
+			// use non-string values as they appear in the JSON
+			s = string(v)
+		}
+		values[k] = s
+	}
+	return messageFromValues(line, values)
+}
+
+// csvParser parses each line as a CSV record, using the first line as the header
+type csvParser struct {
+	header []string
+}
+
+// Parse returns a message with metadata taken from the columns named host,
+// source, sourcetype, index and time, as for JSON. The header line returns
+// a nil message.
+func (p *csvParser) Parse(line string) (*s2s.Message, error) {
+	record, err := csv.NewReader(strings.NewReader(line)).Read()
+	if err != nil {
+		return nil, err
+	}
+	if p.header == nil {
+		p.header = record
+		return nil, nil
+	}
+	if len(record) != len(p.header) {
+		return nil, fmt.Errorf("record has %d columns, header has %d", len(record), len(p.header))
+	}
+	values := make(map[string]string, len(record))
+	for i, v := range record {
+		values[p.header[i]] = v
+	}
+	return messageFromValues(line, values)
+}
+
+// messageFromValues creates a message from named values, with line as the
+// raw event if there is no _raw value
+func messageFromValues(line string, values map[string]string) (*s2s.Message, error) {
+	m := newMessage(line)
+	if m.Fields == nil {
+		m.Fields = make(map[string]string)
+	}
+	for k, v := range values {
+		switch k {
+		case "_raw":
+			m.Raw = v
+		case "index":
+			m.Index = v
+		case "host":
+			m.Host = v
+		case "source":
+			m.Source = v
+		case "sourcetype":
+			m.SourceType = v
+		case "time", "_time":
+			t, err := parseTime(v)
+			if err != nil {
+				return nil, err
+			}
+			m.Time = t
+		default:
+			m.Fields[k] = v
+		}
+	}
+	return m, nil
+}
+
+// parseTime parses a time as seconds since the epoch or RFC 3339
+func parseTime(s string) (time.Time, error) {
+	secs, frac, _ := strings.Cut(s, ".")
+	if sec, err := strconv.ParseInt(secs, 10, 64); err == nil {
+		frac = (frac + "000000000")[:9]
+		if nsec, err := strconv.ParseInt(frac, 10, 64); err == nil {
+			return time.Unix(sec, nsec), nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,108 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+func TestJSONParser(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    *s2s.Message
+		wantErr bool
+	}{
+		{
+			name: "metadata and fields",
+			line: `{"host":"web01","source":"/var/log/app.log","sourcetype":"app","index":"main","time":1700000000.5,"level":"info","status":200,"tags":["a","b"]}`,
+			want: &s2s.Message{
+				Index:      "main",
+				Host:       "web01",
+				Source:     "/var/log/app.log",
+				SourceType: "app",
+				Time:       time.Unix(1700000000, 500000000),
+				Fields:     map[string]string{"level": "info", "status": "200", "tags": `["a","b"]`},
+				Raw:        `{"host":"web01","source":"/var/log/app.log","sourcetype":"app","index":"main","time":1700000000.5,"level":"info","status":200,"tags":["a","b"]}`,
+			},
+		},
+		{
+			name: "raw and RFC 3339 time",
+			line: `{"_raw":"the event","time":"2024-03-01T12:00:00Z"}`,
+			want: &s2s.Message{
+				Time: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+				Raw:  "the event",
+			},
+		},
+		{name: "invalid json", line: `not json`, wantErr: true},
+		{name: "invalid time", line: `{"time":"yesterday"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := jsonParser{}.Parse(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !got.Equal(tt.want) {
+				t.Errorf("Parse() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSVParser(t *testing.T) {
+	p, err := newInputParser("csv")
+	if err != nil {
+		t.Fatalf("newInputParser() error = %v", err)
+	}
+	if m, err := p.Parse("host,_time,message"); m != nil || err != nil {
+		t.Fatalf("Parse() of header = %v, %v, want nil, nil", m, err)
+	}
+
+	got, err := p.Parse(`web01,1700000000,"hello, world"`)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	want := &s2s.Message{
+		Host:   "web01",
+		Time:   time.Unix(1700000000, 0),
+		Fields: map[string]string{"message": "hello, world"},
+		Raw:    `web01,1700000000,"hello, world"`,
+	}
+	if !got.Equal(want) {
+		t.Errorf("Parse() = %v, want %v", got, want)
+	}
+
+	if _, err := p.Parse("too,few"); err == nil {
+		t.Error("Parse() with wrong column count succeeded, want error")
+	}
+}
+
+func TestNewInputParser(t *testing.T) {
+	for _, format := range []string{"", "plain", "json", "csv"} {
+		if _, err := newInputParser(format); err != nil {
+			t.Errorf("newInputParser(%q) error = %v", format, err)
+		}
+	}
+	if _, err := newInputParser("xml"); err == nil {
+		t.Error("newInputParser(\"xml\") succeeded, want error")
+	}
+}
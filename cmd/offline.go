@@ -0,0 +1,94 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// messageSender sends messages, such as a *s2s.Conn
+type messageSender interface {
+	SendMessage(m *s2s.Message) error
+}
+
+// dumpSender writes each message and a hexdump of its encoding to a writer
+type dumpSender struct {
+	w io.Writer
+}
+
+// SendMessage writes the message and its hexdump
+func (d dumpSender) SendMessage(m *s2s.Message) error {
+	var buf bytes.Buffer
+	if err := s2s.EncodeMessage(&buf, m); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(d.w, "%s\n%s\n", m.String(), hex.Dump(buf.Bytes()))
+	return err
+}
+
+// captureSender writes messages to a S2S stream, flushing after each one
+type captureSender struct {
+	enc *s2s.Encoder
+}
+
+// SendMessage encodes the message to the stream
+func (c captureSender) SendMessage(m *s2s.Message) error {
+	if err := c.enc.Encode(m); err != nil {
+		return err
+	}
+	return c.enc.Flush()
+}
+
+// multiSender sends each message to several senders
+type multiSender []messageSender
+
+// SendMessage sends the message to each sender, stopping at the first error
+func (ms multiSender) SendMessage(m *s2s.Message) error {
+	for _, s := range ms {
+		if err := s.SendMessage(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newOfflineSender returns a sender that writes messages locally instead of
+// opening a connection: a hexdump to stdout if dryRun is set, and the raw
+// S2S stream to the file out if it is not empty
+func newOfflineSender(stdout io.Writer, dryRun bool, out string) (messageSender, func() error, error) {
+	var senders multiSender
+	closeFn := func() error { return nil }
+	if dryRun {
+		senders = append(senders, dumpSender{w: stdout})
+	}
+	if out != "" {
+		file, err := os.Create(out)
+		if err != nil {
+			return nil, nil, err
+		}
+		senders = append(senders, captureSender{enc: s2s.NewEncoder(file)})
+		closeFn = file.Close
+	}
+	return senders, closeFn, nil
+}
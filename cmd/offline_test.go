@@ -0,0 +1,106 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// undump parses the bytes from the output of hex.Dump
+func undump(t *testing.T, dump string) []byte {
+	t.Helper()
+	var b []byte
+	scanner := bufio.NewScanner(strings.NewReader(dump))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(line) < 10 {
+			continue
+		}
+		hexPart, _, _ := strings.Cut(line[10:], "|")
+		decoded, err := hex.DecodeString(strings.ReplaceAll(hexPart, " ", ""))
+		if err != nil {
+			t.Fatalf("hex.DecodeString() error = %v", err)
+		}
+		b = append(b, decoded...)
+	}
+	return b
+}
+
+func TestOfflineSender(t *testing.T) {
+	lines := []string{"first line", "second line", "third line"}
+	out := filepath.Join(t.TempDir(), "capture.s2s")
+	var stdout bytes.Buffer
+
+	flagIndex = "main"
+	defer func() { flagIndex = "" }()
+
+	sender, closeSender, err := newOfflineSender(&stdout, true, out)
+	if err != nil {
+		t.Fatalf("newOfflineSender() error = %v", err)
+	}
+	if err := sendLines(sender, strings.NewReader(strings.Join(lines, "\n")), plainParser{}); err != nil {
+		t.Fatalf("sendLines() error = %v", err)
+	}
+	if err := closeSender(); err != nil {
+		t.Fatalf("close error = %v", err)
+	}
+
+	// the hexdump of each message decodes to the message
+	dumps := strings.Split(strings.TrimSpace(stdout.String()), "\n\n")
+	if len(dumps) != len(lines) {
+		t.Fatalf("dry run wrote %d messages, want %d:\n%s", len(dumps), len(lines), stdout.String())
+	}
+	for i, dump := range dumps {
+		summary, hexdump, _ := strings.Cut(dump, "\n")
+		if want := "index=main _raw=" + lines[i]; summary != want {
+			t.Errorf("dump %d summary = %q, want %q", i, summary, want)
+		}
+		m := &s2s.Message{}
+		if err := s2s.DecodeMessage(bytes.NewReader(undump(t, hexdump)), m); err != nil {
+			t.Fatalf("DecodeMessage() of dump %d error = %v", i, err)
+		}
+		if m.Raw != lines[i] || m.Index != "main" {
+			t.Errorf("dump %d decoded = %v, want index=main _raw=%s", i, m, lines[i])
+		}
+	}
+
+	// the capture file is a S2S stream that decodes to the messages
+	file, err := os.Open(out)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	defer file.Close()
+	dec := s2s.NewDecoder(file)
+	for i, line := range lines {
+		m := &s2s.Message{}
+		if err := dec.Decode(m); err != nil {
+			t.Fatalf("Decode() of message %d error = %v", i, err)
+		}
+		if m.Raw != line || m.Index != "main" {
+			t.Errorf("message %d = %v, want index=main _raw=%s", i, m, line)
+		}
+	}
+}
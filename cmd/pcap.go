@@ -0,0 +1,53 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s/pcap"
+)
+
+// printPcap prints the events extracted from the capture file at path, one
+// per line, as text with the connection they were sent on, or as JSON
+func printPcap(w io.Writer, path string, asJSON bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// events decoded before an error are still printed
+	events, err := pcap.ExtractEvents(file)
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		var writeErr error
+		if asJSON {
+			writeErr = enc.Encode(e.Message)
+		} else {
+			_, writeErr = fmt.Fprintf(w, "%s -> %s %s\n", e.Src, e.Dst, e.Message)
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// writeTestCapture writes a pcap file with raw IP link type holding a single
+// TCP segment with the data
+func writeTestCapture(t *testing.T, data []byte) string {
+	t.Helper()
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], 50000)
+	binary.BigEndian.PutUint16(tcp[2:], 9997)
+	tcp[12] = 5 << 4
+	ip := []byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, 6, 0, 0, 10, 0, 0, 1, 10, 0, 0, 2}
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(ip)+len(tcp)+len(data)))
+	packet := append(append(ip, tcp...), data...)
+
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint32(header[20:], 101)
+	record := make([]byte, 16)
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+
+	path := filepath.Join(t.TempDir(), "capture.pcap")
+	if err := os.WriteFile(path, append(append(header, record...), packet...), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	return path
+}
+
+func TestPrintPcap(t *testing.T) {
+	var stream bytes.Buffer
+	enc := s2s.NewEncoder(&stream)
+	for _, m := range []*s2s.Message{
+		{Fields: map[string]string{"__s2s_capabilities": "ack=0;compression=0"}},
+		{Index: "main", Raw: "first event"},
+		{Index: "main", Raw: "second event"},
+	} {
+		if err := enc.Encode(m); err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	path := writeTestCapture(t, stream.Bytes())
+
+	tests := []struct {
+		name   string
+		asJSON bool
+		want   []string
+	}{
+		{"text", false, []string{
+			"10.0.0.1:50000 -> 10.0.0.2:9997 index=main _raw=first event",
+			"10.0.0.1:50000 -> 10.0.0.2:9997 index=main _raw=second event",
+		}},
+		{"json", true, []string{
+			`{"index":"main","raw":"first event"}`,
+			`{"index":"main","raw":"second event"}`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := printPcap(&out, path, tt.asJSON); err != nil {
+				t.Fatalf("printPcap() error = %v", err)
+			}
+			got := strings.Split(strings.TrimSpace(out.String()), "\n")
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("printPcap() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// maxReplayMessageSize is the largest message that will be read from a capture
+const maxReplayMessageSize = 64 << 20
+
+// rawSender sends pre-encoded messages, such as a *s2s.Conn
+type rawSender interface {
+	SendRaw(b []byte) error
+}
+
+// replay sends each message in a captured S2S stream verbatim. A leading
+// signature and any control messages are skipped, since the connection makes
+// its own handshake. If speed is positive, the time between messages follows
+// their _time values, divided by speed.
+func replay(sender rawSender, r io.Reader, speed float64) error {
+	br := bufio.NewReader(r)
+	if prefix, err := br.Peek(len("--splunk-cooked-mode-v")); err == nil && string(prefix) == "--splunk-cooked-mode-v" {
+		if _, err := s2s.ReadHandshake(br); err != nil {
+			return fmt.Errorf("error reading capture signature: %v", err)
+		}
+	}
+
+	var last time.Time
+	for {
+		frame, err := readFrame(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading capture: %v", err)
+		}
+
+		m := &s2s.Message{}
+		if err := s2s.DecodeMessage(bytes.NewReader(frame), m); err != nil {
+			return fmt.Errorf("error decoding capture: %v", err)
+		}
+		if isControl(m) {
+			continue
+		}
+
+		if speed > 0 && !m.Time.IsZero() {
+			if !last.IsZero() && m.Time.After(last) {
+				time.Sleep(time.Duration(float64(m.Time.Sub(last)) / speed))
+			}
+			last = m.Time
+		}
+		if err := sender.SendRaw(frame); err != nil {
+			return err
+		}
+	}
+}
+
+// readFrame reads the bytes of the next encoded message, including its size
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxReplayMessageSize {
+		return nil, fmt.Errorf("message size %d is too large", size)
+	}
+	frame := make([]byte, 4+size)
+	copy(frame, header[:])
+	if _, err := io.ReadFull(r, frame[4:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// isControl returns true if the message is a S2S control message
+func isControl(m *s2s.Message) bool {
+	if m.Raw != "" {
+		return false
+	}
+	for k := range m.Fields {
+		if strings.HasPrefix(k, "__s2s_") {
+			return true
+		}
+	}
+	return false
+}
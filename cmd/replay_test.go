@@ -0,0 +1,102 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+func TestReplay(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	messages := []*s2s.Message{
+		{Index: "main", Host: "web01", Time: start, Raw: "first event"},
+		{Index: "main", Host: "web01", Time: start.Add(time.Second), Raw: "second event", Fields: map[string]string{"status": "200"}},
+		{Index: "main", Host: "web02", Time: start.Add(2 * time.Second), Raw: "third event"},
+	}
+
+	// capture a stream with a signature and a control message
+	var capture bytes.Buffer
+	enc := s2s.NewEncoder(&capture)
+	if err := enc.Encode(&s2s.Message{Fields: map[string]string{"__s2s_capabilities": "ack=0;compression=0"}}); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	for _, m := range messages {
+		if err := enc.Encode(m); err != nil {
+			t.Fatalf("Encode() error = %v", err)
+		}
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+
+	endpoint := s2s.UnixPrefix + filepath.Join(t.TempDir(), "s2s.sock")
+	server := s2s.NewServer(endpoint)
+	server.Logger = nil
+	received := server.Messages()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer server.Stop()
+
+	conn, err := s2s.Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer conn.Close()
+
+	// the messages span 2 seconds, so replaying at 20x takes at least 100ms
+	begin := time.Now()
+	if err := replay(conn, &capture, 20); err != nil {
+		t.Fatalf("replay() error = %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed < 100*time.Millisecond {
+		t.Errorf("replay() took %v, want at least 100ms", elapsed)
+	}
+
+	for i, want := range messages {
+		select {
+		case got := <-received:
+			if !got.Equal(want) {
+				t.Errorf("message %d = %v, want %v", i, got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+}
+
+func TestReplayTruncated(t *testing.T) {
+	var capture bytes.Buffer
+	if err := s2s.EncodeMessage(&capture, &s2s.Message{Raw: "event"}); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+	truncated := capture.Bytes()[:capture.Len()-5]
+	if err := replay(discardSender{}, bytes.NewReader(truncated), 0); err == nil {
+		t.Error("replay() of truncated capture succeeded, want error")
+	}
+}
+
+// discardSender is a rawSender that discards messages
+type discardSender struct{}
+
+func (discardSender) SendRaw(b []byte) error { return nil }
@@ -24,9 +24,11 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"strings"
 	"syscall"
 
@@ -34,21 +36,87 @@ import (
 )
 
 var (
-	flagVersion     bool
-	flagEndpoint    string
-	flagFile        string
-	flagTLS         bool
-	flagCert        string
-	flagServerName  string
-	flagInsecureTLS bool
-	flagServerMode  bool
-	flagKeyFile     string
-	flagIndex       string
-	flagHost        string
-	flagSource      string
-	flagSourceType  string
+	flagVersion      bool
+	flagEndpoint     string
+	flagFile         string
+	flagTLS          bool
+	flagCert         string
+	flagServerName   string
+	flagInsecureTLS  bool
+	flagServerMode   bool
+	flagKeyFile      string
+	flagIndex        string
+	flagHost         string
+	flagSource       string
+	flagSourceType   string
+	flagRelay        string
+	flagProxy        string
+	flagFields       = fieldFlags{}
+	flagFieldsFile   string
+	flagFormat       string
+	flagTimeFormat   string
+	flagTimeRegex    string
+	flagTimeFallback string
+	flagDryRun       bool
+	flagOut          string
+	flagReplay       string
+	flagSpeed        float64
+	flagDir          string
+	flagRecursive    bool
+	flagInclude      string
+	flagExclude      string
+	flagWorkers      int
+	flagWholeFile    bool
+	flagPcap         string
+	flagJSON         bool
 )
 
+// fieldFlags is a repeatable flag of key=value indexed fields
+type fieldFlags map[string]string
+
+// String returns the fields as comma separated key=value pairs
+func (f fieldFlags) String() string {
+	pairs := make([]string, 0, len(f))
+	for k, v := range f {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+// Set adds a key=value field
+func (f fieldFlags) Set(s string) error {
+	key, value, ok := strings.Cut(s, "=")
+	key = strings.TrimSpace(key)
+	if !ok || key == "" {
+		return fmt.Errorf("invalid field %q: expected key=value", s)
+	}
+	f[key] = strings.TrimSpace(value)
+	return nil
+}
+
+// loadFieldsFile adds the key=value fields in a file, one per line. Blank
+// lines and lines starting with # are ignored.
+func (f fieldFlags) loadFieldsFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if err := f.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, lineNum, err)
+		}
+	}
+	return scanner.Err()
+}
+
 // isConnectionError returns true if the error indicates a broken connection
 func isConnectionError(err error) bool {
 	if err == nil {
@@ -74,7 +142,7 @@ func main() {
 	// process command line args
 	flag.BoolVar(&flagVersion, "version", false, "display current version")
 	flag.StringVar(&flagEndpoint, "endpoint", "localhost:9997", "S2S server endpoint (host:port)")
-	flag.StringVar(&flagFile, "file", "", "log file to send")
+	flag.StringVar(&flagFile, "file", "", "log file to send, or - for stdin")
 	flag.BoolVar(&flagTLS, "tls", false, "enable TLS connection")
 	flag.StringVar(&flagCert, "cert", "", "path to client certificate for TLS (optional)")
 	flag.StringVar(&flagServerName, "server-name", "", "server name for TLS verification")
@@ -85,6 +153,26 @@ func main() {
 	flag.StringVar(&flagHost, "host", "", "host value for messages")
 	flag.StringVar(&flagSource, "source", "", "source value for messages")
 	flag.StringVar(&flagSourceType, "sourcetype", "", "sourcetype value for messages")
+	flag.StringVar(&flagProxy, "proxy", "", "connect through a proxy (socks5://host:port or http://host:port)")
+	flag.Var(flagFields, "field", "indexed field to add to messages as key=value (repeatable)")
+	flag.StringVar(&flagFieldsFile, "fields-file", "", "file of key=value indexed fields to add to messages")
+	flag.StringVar(&flagFormat, "format", "plain", "input format: plain, json or csv")
+	flag.StringVar(&flagTimeFormat, "time-format", "", "extract event times using this format: rfc3339, syslog, epoch or a Go time layout")
+	flag.StringVar(&flagTimeRegex, "time-regex", "", "regular expression matching the timestamp in each line (first group is used if present)")
+	flag.StringVar(&flagTimeFallback, "time-fallback", "none", "time for events without a timestamp: none (assigned by the indexer) or now")
+	flag.BoolVar(&flagDryRun, "dry-run", false, "print a hexdump of each encoded message instead of sending it")
+	flag.StringVar(&flagOut, "out", "", "write encoded messages to this file instead of sending them")
+	flag.StringVar(&flagDir, "dir", "", "send the lines of each file in this directory")
+	flag.BoolVar(&flagRecursive, "recursive", false, "with -dir, include files in subdirectories")
+	flag.StringVar(&flagInclude, "include", "", "with -dir, only send files whose names match this glob pattern")
+	flag.StringVar(&flagExclude, "exclude", "", "with -dir, skip files whose names match this glob pattern")
+	flag.BoolVar(&flagWholeFile, "whole-file", false, "send the whole of each file as a single event instead of one event per line")
+	flag.IntVar(&flagWorkers, "workers", 1, "with -dir, number of files to send in parallel, each over its own connection")
+	flag.StringVar(&flagReplay, "replay", "", "send the messages in a captured S2S file, such as one written with -out")
+	flag.Float64Var(&flagSpeed, "speed", 0, "with -replay, pace messages by their times at this multiple of real time (0 sends as fast as possible)")
+	flag.StringVar(&flagPcap, "pcap", "", "print the events sent on S2S connections in a packet capture file")
+	flag.BoolVar(&flagJSON, "json", false, "with -pcap, print events as lines of JSON")
+	flag.StringVar(&flagRelay, "relay", "", "forward received messages to this S2S endpoint (server mode)")
 	flag.Parse()
 
 	if flagVersion {
@@ -108,6 +196,13 @@ func main() {
 		} else {
 			server = s2s.NewServer(flagEndpoint)
 		}
+		server.Handler = s2s.PrintHandler
+
+		if flagRelay != "" {
+			relay := s2s.NewRelayHandler(flagRelay)
+			defer relay.Close()
+			server.Handler = relay
+		}
 
 		if err := server.Start(); err != nil {
 			log.Fatalf("Failed to start S2S server: %v", err)
@@ -117,6 +212,9 @@ func main() {
 		if flagTLS {
 			fmt.Println("TLS enabled")
 		}
+		if flagRelay != "" {
+			fmt.Printf("Forwarding messages to %s\n", flagRelay)
+		}
 
 		// Wait for Ctrl+C
 		sigChan := make(chan os.Signal, 1)
@@ -129,54 +227,205 @@ func main() {
 		return
 	}
 
-	if flagFile == "" {
-		log.Fatal("Please specify a log file using -file")
+	if flagPcap != "" {
+		if err := printPcap(os.Stdout, flagPcap, flagJSON); err != nil {
+			log.Fatalf("Failed to extract events: %v", err)
+		}
+		return
+	}
+
+	if flagReplay != "" {
+		file, err := os.Open(flagReplay)
+		if err != nil {
+			log.Fatalf("Failed to open capture file: %v", err)
+		}
+		defer file.Close()
+		conn, err := connect()
+		if err != nil {
+			log.Fatalf("Failed to create S2S connection: %v", err)
+		}
+		defer conn.Close()
+		if err := replay(conn, file, flagSpeed); err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	if flagFieldsFile != "" {
+		// fields given with -field take precedence over the file
+		fields := fieldFlags{}
+		if err := fields.loadFieldsFile(flagFieldsFile); err != nil {
+			log.Fatalf("Failed to load fields file: %v", err)
+		}
+		for k, v := range flagFields {
+			fields[k] = v
+		}
+		flagFields = fields
 	}
 
-	if flagSource == "" {
+	parser, err := newParser()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if flagFile == "" && flagDir == "" && stdinIsPipe() {
+		flagFile = "-"
+	}
+	if flagFile == "" && flagDir == "" {
+		log.Fatal("Please specify a log file using -file or a directory using -dir")
+	}
+
+	if flagSource == "" && flagDir == "" {
 		// default to log file name
 		flagSource = flagFile
+		if flagFile == "-" {
+			flagSource = "stdin"
+		}
 	}
 
 	// Open the log file
-	file, err := os.Open(flagFile)
-	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+	input := os.Stdin
+	if flagFile != "-" && flagDir == "" {
+		file, err := os.Open(flagFile)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer file.Close()
+		input = file
 	}
-	defer file.Close()
 
-	// Create S2S connection
-	var conn *s2s.Conn
-	if flagTLS {
-		conn, err = s2s.ConnectTLS(flagEndpoint, flagCert, flagServerName, flagInsecureTLS)
+	// Send messages to the indexer, or write them locally for debugging
+	var sender messageSender
+	var closeSender func() error
+	if flagDryRun || flagOut != "" {
+		sender, closeSender, err = newOfflineSender(os.Stdout, flagDryRun, flagOut)
+		if err != nil {
+			log.Fatalf("Failed to create output file: %v", err)
+		}
+	} else {
+		conn, err := connect()
+		if err != nil {
+			log.Fatalf("Failed to create S2S connection: %v", err)
+		}
+		sender, closeSender = conn, conn.Close
+	}
+	defer closeSender()
+
+	// Read and send messages until the end of the input
+	if flagDir != "" {
+		senders := []messageSender{sender}
+		if flagWorkers > 1 {
+			if flagDryRun || flagOut != "" {
+				// workers share the output, which is locked while writing a message
+				shared := &lockedSender{sender: sender}
+				senders = []messageSender{shared}
+				for len(senders) < flagWorkers {
+					senders = append(senders, shared)
+				}
+			} else {
+				// each worker has its own connection
+				for len(senders) < flagWorkers {
+					conn, err := connect()
+					if err != nil {
+						log.Fatalf("Failed to create S2S connection: %v", err)
+					}
+					defer conn.Close()
+					senders = append(senders, conn)
+				}
+			}
+		}
+		err = sendDir(senders, flagDir, dirOptions{
+			Recursive: flagRecursive,
+			Include:   flagInclude,
+			Exclude:   flagExclude,
+		})
+	} else if flagWholeFile {
+		err = sendWholeFile(sender, flagFile)
 	} else {
-		conn, err = s2s.Connect(flagEndpoint)
+		err = sendLines(sender, input, parser)
 	}
 	if err != nil {
-		log.Fatalf("Failed to create S2S connection: %v", err)
+		log.Print(err)
 	}
-	defer conn.Close()
+}
 
-	// Read and send messages
-	scanner := bufio.NewScanner(file)
+// newParser creates the input parser selected by the command line flags
+func newParser() (inputParser, error) {
+	parser, err := newInputParser(flagFormat)
+	if err != nil {
+		return nil, err
+	}
+	if flagTimeFormat != "" {
+		extractor, err := newTimeExtractor(flagTimeFormat, flagTimeRegex, flagTimeFallback)
+		if err != nil {
+			return nil, err
+		}
+		parser = timeParser{inputParser: parser, extractor: extractor}
+	}
+	return parser, nil
+}
+
+// connect creates a S2S connection using the command line flags
+func connect() (*s2s.Conn, error) {
+	var dial s2s.DialFunc
+	if flagProxy != "" {
+		var err error
+		dial, err = s2s.ProxyDialer(flagProxy, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %v", err)
+		}
+	}
+	if flagTLS {
+		return s2s.ConnectTLSWithOptions(flagEndpoint, s2s.TLSOptions{
+			CACert:             flagCert,
+			ServerName:         flagServerName,
+			InsecureSkipVerify: flagInsecureTLS,
+			DialContext:        dial,
+		})
+	}
+	return s2s.ConnectWithDialer(flagEndpoint, dial)
+}
+
+// stdinIsPipe returns true if stdin is redirected from a pipe or file
+func stdinIsPipe() bool {
+	fi, err := os.Stdin.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice == 0
+}
+
+// sendLines sends each line read from r as a message created by parser
+func sendLines(sender messageSender, r io.Reader, parser inputParser) error {
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
-		m := &s2s.Message{
-			Raw:        scanner.Text(),
-			Index:      flagIndex,
-			Host:       flagHost,
-			Source:     flagSource,
-			SourceType: flagSourceType,
-		}
-		if err := conn.SendMessage(m); err != nil {
+		m, err := parser.Parse(scanner.Text())
+		if err != nil {
+			log.Printf("Failed to parse line: %v", err)
+			continue
+		}
+		if m == nil {
+			continue
+		}
+		if err := sender.SendMessage(m); err != nil {
 			if isConnectionError(err) {
-				log.Printf("Connection lost: %v", err)
-				return
+				return fmt.Errorf("Connection lost: %v", err)
 			}
 			log.Printf("Failed to send message: %v", err)
 		}
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Printf("Error reading log file: %v", err)
+		return fmt.Errorf("Error reading log file: %v", err)
+	}
+	return nil
+}
+
+// newMessage creates a message with the metadata and fields from the command line flags
+func newMessage(raw string) *s2s.Message {
+	return &s2s.Message{
+		Raw:        raw,
+		Index:      flagIndex,
+		Host:       flagHost,
+		Source:     flagSource,
+		SourceType: flagSourceType,
+		Fields:     maps.Clone(flagFields),
 	}
 }
@@ -0,0 +1,151 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+func TestSendLinesFromPipe(t *testing.T) {
+	endpoint := s2s.UnixPrefix + filepath.Join(t.TempDir(), "s2s.sock")
+	server := s2s.NewServer(endpoint)
+	server.Logger = nil
+	messages := server.Messages()
+	if err := server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer server.Stop()
+
+	conn, err := s2s.Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer conn.Close()
+
+	flagIndex, flagSource, flagSourceType = "main", "stdin", "test"
+	defer func() { flagIndex, flagSource, flagSourceType = "", "", "" }()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("os.Pipe() error = %v", err)
+	}
+	defer r.Close()
+	go func() {
+		io.WriteString(w, "first line\nsecond line\nthird line\n")
+		w.Close()
+	}()
+	if err := sendLines(conn, r, plainParser{}); err != nil {
+		t.Fatalf("sendLines() error = %v", err)
+	}
+
+	for _, want := range []string{"first line", "second line", "third line"} {
+		select {
+		case m := <-messages:
+			if m.Raw != want || m.Index != "main" || m.Source != "stdin" || m.SourceType != "test" {
+				t.Errorf("received %v, want index=main source=stdin sourcetype=test _raw=%s", m, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestFieldFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"single", []string{"env=prod"}, map[string]string{"env": "prod"}, false},
+		{"repeated", []string{"env=prod", "dc=us-east", "env=dev"}, map[string]string{"env": "dev", "dc": "us-east"}, false},
+		{"value with equals", []string{"query=a=b"}, map[string]string{"query": "a=b"}, false},
+		{"empty value", []string{"empty="}, map[string]string{"empty": ""}, false},
+		{"empty key", []string{"=value"}, nil, true},
+		{"missing equals", []string{"novalue"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields := fieldFlags{}
+			var err error
+			for _, arg := range tt.args {
+				if err = fields.Set(arg); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !maps.Equal(fields, fieldFlags(tt.want)) {
+				t.Errorf("fields = %v, want %v", fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadFieldsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fields.conf")
+	content := "# indexed fields\nenv=prod\n\n  dc = us-east\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	fields := fieldFlags{}
+	if err := fields.loadFieldsFile(path); err != nil {
+		t.Fatalf("loadFieldsFile() error = %v", err)
+	}
+	if want := (fieldFlags{"env": "prod", "dc": "us-east"}); !maps.Equal(fields, want) {
+		t.Errorf("loadFieldsFile() = %v, want %v", fields, want)
+	}
+
+	if err := os.WriteFile(path, []byte("env=prod\n=bad\n"), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if err := (fieldFlags{}).loadFieldsFile(path); err == nil {
+		t.Error("loadFieldsFile() with empty key succeeded, want error")
+	}
+}
+
+func TestNewMessageFields(t *testing.T) {
+	flagFields = fieldFlags{"env": "prod", "dc": "us-east"}
+	defer func() { flagFields = fieldFlags{} }()
+
+	var buf bytes.Buffer
+	if err := s2s.EncodeMessage(&buf, newMessage("event")); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+	for _, want := range []string{"env\x00\x00\x00\x00\x05prod\x00", "dc\x00\x00\x00\x00\x08us-east\x00"} {
+		if !bytes.Contains(buf.Bytes(), []byte(want)) {
+			t.Errorf("encoded message %q does not contain %q", buf.Bytes(), want)
+		}
+	}
+
+	// each message gets its own copy of the fields
+	m := newMessage("event")
+	m.Fields["env"] = "dev"
+	if flagFields["env"] != "prod" {
+		t.Errorf("modifying message fields changed flags to %v", flagFields)
+	}
+}
@@ -0,0 +1,134 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// syslogLayout is the timestamp layout used by traditional syslog, which has no year
+const syslogLayout = time.Stamp
+
+// timeFormats are the named timestamp formats, with a pattern for finding them in a line
+var timeFormats = map[string]struct {
+	layout  string
+	pattern string
+}{
+	"rfc3339": {time.RFC3339Nano, `\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(?:\.\d+)?(?:Z|[+-]\d{2}:\d{2})`},
+	"syslog":  {syslogLayout, `[A-Z][a-z]{2} [ \d]\d \d{2}:\d{2}:\d{2}`},
+	"epoch":   {"", `\b\d{10}(?:\.\d+)?\b`},
+}
+
+// timeExtractor sets message times from timestamps found in their raw events
+type timeExtractor struct {
+	layout      string
+	re          *regexp.Regexp
+	fallbackNow bool
+	loc         *time.Location
+	now         func() time.Time
+}
+
+// newTimeExtractor creates a timeExtractor for a named format or Go time
+// layout. The timestamp is the first match of pattern, or of its first
+// subexpression if it has one. If pattern is empty, the named format's
+// pattern is used, or the start of the line for a custom layout. When no
+// timestamp is found, the time is left unset for the indexer to assign,
+// or set to the current time if fallback is "now".
+func newTimeExtractor(format, pattern, fallback string) (*timeExtractor, error) {
+	e := &timeExtractor{layout: format, loc: time.Local, now: time.Now}
+	if named, ok := timeFormats[format]; ok {
+		e.layout = named.layout
+		if pattern == "" {
+			pattern = named.pattern
+		}
+	}
+	if pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time pattern: %v", err)
+		}
+		e.re = re
+	}
+	switch fallback {
+	case "", "none":
+	case "now":
+		e.fallbackNow = true
+	default:
+		return nil, fmt.Errorf("invalid time fallback %q: expected none or now", fallback)
+	}
+	return e, nil
+}
+
+// extract returns the timestamp found in a line
+func (e *timeExtractor) extract(line string) (time.Time, bool) {
+	s := line
+	if e.re != nil {
+		match := e.re.FindStringSubmatch(line)
+		if match == nil {
+			return time.Time{}, false
+		}
+		s = match[0]
+		if len(match) > 1 {
+			s = match[1]
+		}
+	} else if len(s) > len(e.layout) {
+		s = s[:len(e.layout)]
+	}
+
+	if e.layout == "" {
+		t, err := parseTime(s)
+		return t, err == nil
+	}
+	t, err := time.ParseInLocation(e.layout, s, e.loc)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if e.layout == syslogLayout {
+		// syslog timestamps have no year, so assume the most recent one
+		now := e.now().In(e.loc)
+		t = t.AddDate(now.Year(), 0, 0)
+		if t.After(now.AddDate(0, 0, 1)) {
+			t = t.AddDate(-1, 0, 0)
+		}
+	}
+	return t, true
+}
+
+// timeParser is an inputParser that sets message times using a timeExtractor
+type timeParser struct {
+	inputParser
+	extractor *timeExtractor
+}
+
+// Parse parses a line and sets the message time from it, unless the parser already set it
+func (p timeParser) Parse(line string) (*s2s.Message, error) {
+	m, err := p.inputParser.Parse(line)
+	if err != nil || m == nil || !m.Time.IsZero() {
+		return m, err
+	}
+	if t, ok := p.extractor.extract(m.Raw); ok {
+		m.Time = t
+	} else if p.extractor.fallbackNow {
+		m.Time = p.extractor.now()
+	}
+	return m, nil
+}
@@ -0,0 +1,78 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Utility
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeExtractor(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		format   string
+		pattern  string
+		fallback string
+		line     string
+		want     time.Time
+	}{
+		{"syslog", "syslog", "", "", "Feb 29 23:59:58 web01 sshd[123]: Accepted publickey",
+			time.Date(2024, 2, 29, 23, 59, 58, 0, time.UTC)},
+		{"syslog from last year", "syslog", "", "", "Dec 31 23:00:00 web01 cron: job",
+			time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC)},
+		{"rfc3339", "rfc3339", "", "", `level=info ts=2024-02-01T10:00:00.5+02:00 msg="started"`,
+			time.Date(2024, 2, 1, 8, 0, 0, 500000000, time.UTC)},
+		{"epoch", "epoch", "", "", "1700000000.25 request served",
+			time.Unix(1700000000, 250000000)},
+		{"custom layout at start of line", "2006/01/02 15:04:05", "", "", "2024/02/01 10:30:00 started",
+			time.Date(2024, 2, 1, 10, 30, 0, 0, time.UTC)},
+		{"custom layout with pattern", "02/Jan/2006:15:04:05 -0700", `\[([^\]]+)\]`, "",
+			`127.0.0.1 - - [01/Feb/2024:10:30:00 +0000] "GET / HTTP/1.1" 200`,
+			time.Date(2024, 2, 1, 10, 30, 0, 0, time.UTC)},
+		{"not found", "syslog", "", "", "no timestamp here", time.Time{}},
+		{"not found with fallback", "syslog", "", "now", "no timestamp here", now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := newTimeExtractor(tt.format, tt.pattern, tt.fallback)
+			if err != nil {
+				t.Fatalf("newTimeExtractor() error = %v", err)
+			}
+			e.loc = time.UTC
+			e.now = func() time.Time { return now }
+
+			m, err := timeParser{inputParser: plainParser{}, extractor: e}.Parse(tt.line)
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !m.Time.Equal(tt.want) {
+				t.Errorf("Parse() Time = %v, want %v", m.Time, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTimeExtractorErrors(t *testing.T) {
+	if _, err := newTimeExtractor("syslog", "(", ""); err == nil {
+		t.Error("newTimeExtractor() with invalid pattern succeeded, want error")
+	}
+	if _, err := newTimeExtractor("syslog", "", "later"); err == nil {
+		t.Error("newTimeExtractor() with invalid fallback succeeded, want error")
+	}
+}
@@ -0,0 +1,168 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Indexer acknowledgements work as follows:
+//
+//  1. The client advertises "ack=1" in its __s2s_capabilities handshake message.
+//  2. Every message sent afterwards carries an extra "__s2s_ack_id" field holding
+//     a per-connection, monotonically increasing identifier starting at 1.
+//  3. Once the indexer has durably written a message, it sends back a control
+//     message with __s2s_control_msg set to "ack_id=<id>;ack_status=success"
+//     (or "ack_status=failure" if the message could not be indexed).
+//
+// Messages sent on a Channel also carry "__s2s_channel" holding the channel
+// identifier. Acknowledgement identifiers are assigned per channel, and the
+// indexer echoes the channel as "channel=<id>" in its control message.
+
+const (
+	// AckTimeout is the maximum time SendMessageAck waits for an acknowledgement
+	AckTimeout = 30 * time.Second
+
+	// ackIDKey is the field used to carry the acknowledgement identifier
+	ackIDKey = "__s2s_ack_id"
+
+	// ackBufferSize is the number of acknowledgements buffered for Acks()
+	ackBufferSize = 1024
+)
+
+var (
+	ErrAckDisabled   = errors.New("acknowledgements are not enabled")
+	ErrAckTimeout    = errors.New("timed out waiting for acknowledgement")
+	ErrAckFailed     = errors.New("indexer reported acknowledgement failure")
+	ErrAckConnClosed = errors.New("connection closed before acknowledgement")
+)
+
+// Ack is an acknowledgement sent by the indexer for a single message. Channel
+// is zero for messages that were not sent on a Channel.
+type Ack struct {
+	ID      uint64
+	Channel uint64
+	Success bool
+}
+
+// parseAck extracts an acknowledgement from an indexer control message
+func parseAck(m *Message) (Ack, bool) {
+	controlMsg, ok := m.Fields[controlMsgKey]
+	if !ok {
+		return Ack{}, false
+	}
+	values := parseControlValues(controlMsg)
+	idStr, ok := values["ack_id"]
+	if !ok {
+		return Ack{}, false
+	}
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return Ack{}, false
+	}
+	var channel uint64
+	if s, ok := values["channel"]; ok {
+		if channel, err = strconv.ParseUint(s, 10, 64); err != nil {
+			return Ack{}, false
+		}
+	}
+	return Ack{ID: id, Channel: channel, Success: values["ack_status"] == "success"}, true
+}
+
+// SendAck writes an acknowledgement control message for the given identifier.
+// This allows a Server to act as an indexer for forwarders waiting on acks.
+func SendAck(w io.Writer, ackID uint64, success bool) error {
+	return SendChannelAck(w, 0, ackID, success)
+}
+
+// SendChannelAck writes an acknowledgement control message for a message sent
+// on the given channel. A channel of zero is omitted, as with SendAck.
+func SendChannelAck(w io.Writer, channel, ackID uint64, success bool) error {
+	status := "success"
+	if !success {
+		status = "failure"
+	}
+	value := fmt.Sprintf("ack_id=%d;ack_status=%s", ackID, status)
+	if channel != 0 {
+		value += fmt.Sprintf(";channel=%d", channel)
+	}
+	m := &Message{
+		Fields: map[string]string{
+			controlMsgKey: value,
+		},
+	}
+	return m.Write(w)
+}
+
+// ackTracker assigns acknowledgement identifiers to a stream of messages and
+// routes acknowledgements to their waiters, or to a buffered channel
+type ackTracker struct {
+	mu      sync.Mutex
+	lastID  uint64
+	waiters map[uint64]chan Ack
+	acks    chan Ack
+}
+
+// newAckTracker creates an ackTracker with an empty buffer
+func newAckTracker() *ackTracker {
+	return &ackTracker{
+		waiters: make(map[uint64]chan Ack),
+		acks:    make(chan Ack, ackBufferSize),
+	}
+}
+
+// next returns the next identifier, delivering its acknowledgement to waiter if not nil
+func (t *ackTracker) next(waiter chan Ack) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lastID++
+	if waiter != nil {
+		t.waiters[t.lastID] = waiter
+	}
+	return t.lastID
+}
+
+// cancel stops waiting for the acknowledgement of an identifier
+func (t *ackTracker) cancel(id uint64) {
+	t.mu.Lock()
+	delete(t.waiters, id)
+	t.mu.Unlock()
+}
+
+// deliver passes an acknowledgement to its waiter, or to acks if it has none.
+// Acknowledgements are dropped if acks is full.
+func (t *ackTracker) deliver(ack Ack) {
+	t.mu.Lock()
+	waiter, found := t.waiters[ack.ID]
+	delete(t.waiters, ack.ID)
+	t.mu.Unlock()
+
+	if found {
+		waiter <- ack
+		return
+	}
+	select {
+	case t.acks <- ack:
+	default:
+	}
+}
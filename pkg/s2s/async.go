@@ -0,0 +1,132 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// DefaultQueueSize is the default number of messages queued by an AsyncConn
+const DefaultQueueSize = 1000
+
+var (
+	ErrQueueFull   = errors.New("message queue is full")
+	ErrQueueClosed = errors.New("message queue is closed")
+)
+
+// AsyncConn sends messages over a Conn from a background goroutine, so that
+// many goroutines can queue messages without blocking. QueueSize and OnError
+// must be set before the first call to Enqueue. OnError is called from the
+// background goroutine with each message that could not be sent.
+type AsyncConn struct {
+	QueueSize int
+	OnError   func(m *Message, err error)
+	conn      *Conn
+	queue     chan *Message
+	startOnce sync.Once
+	done      chan struct{}
+	mu        sync.RWMutex
+	closed    bool
+}
+
+// NewAsyncConn creates an AsyncConn that sends messages over conn
+func NewAsyncConn(conn *Conn) *AsyncConn {
+	return &AsyncConn{
+		QueueSize: DefaultQueueSize,
+		conn:      conn,
+		done:      make(chan struct{}),
+	}
+}
+
+// Enqueue queues a message to be sent without waiting. It returns
+// ErrQueueFull if the queue is full, or ErrQueueClosed after Close.
+func (a *AsyncConn) Enqueue(m *Message) error {
+	if m == nil {
+		return ErrNilMessage
+	}
+	a.startOnce.Do(a.start)
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		return ErrQueueClosed
+	}
+	select {
+	case a.queue <- m:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Close stops accepting messages, waits for queued messages to be sent and
+// then closes the connection
+func (a *AsyncConn) Close() error {
+	a.stopQueue()
+	<-a.done
+	return a.conn.Close()
+}
+
+// Drain stops accepting messages and waits for queued messages to be sent,
+// without closing the connection. If ctx expires first, the error wraps
+// ctx.Err() and reports how many messages are still queued; they continue to
+// be sent in the background until Close.
+func (a *AsyncConn) Drain(ctx context.Context) error {
+	a.stopQueue()
+	select {
+	case <-a.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%w: %d messages still queued", ctx.Err(), len(a.queue))
+	}
+}
+
+// stopQueue closes the queue so that no more messages are accepted
+func (a *AsyncConn) stopQueue() {
+	a.startOnce.Do(a.start)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.closed {
+		a.closed = true
+		close(a.queue)
+	}
+}
+
+// start creates the queue and starts the background goroutine
+func (a *AsyncConn) start() {
+	size := a.QueueSize
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	a.queue = make(chan *Message, size)
+	go a.run()
+}
+
+// run sends queued messages until the queue is closed
+func (a *AsyncConn) run() {
+	defer close(a.done)
+	for m := range a.queue {
+		if err := a.conn.SendMessage(m); err != nil && a.OnError != nil {
+			a.OnError(m, err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAsyncConnConcurrentEnqueue(t *testing.T) {
+	const producers, perProducer = 8, 250
+	var received atomic.Int64
+	s := startTestServer(t)
+	s.Logger = nil
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		received.Add(1)
+		return nil
+	})
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	a := NewAsyncConn(c)
+	a.QueueSize = 16
+	a.OnError = func(m *Message, err error) {
+		t.Errorf("OnError(%v, %v)", m, err)
+	}
+
+	var wg sync.WaitGroup
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perProducer; i++ {
+				m := &Message{Raw: fmt.Sprintf("producer %d message %d", p, i)}
+				for {
+					err := a.Enqueue(m)
+					if err == nil {
+						break
+					}
+					if err != ErrQueueFull {
+						t.Errorf("Enqueue() error = %v", err)
+						return
+					}
+					runtime.Gosched()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := a.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := a.Enqueue(&Message{Raw: "late"}); err != ErrQueueClosed {
+		t.Errorf("Enqueue() after Close() error = %v, want %v", err, ErrQueueClosed)
+	}
+
+	waitForActive(t, s, 0)
+	if got, want := received.Load(), int64(producers*perProducer); got != want {
+		t.Errorf("server received %d messages, want %d", got, want)
+	}
+}
+
+func TestAsyncConnOnError(t *testing.T) {
+	endpoint := startMockIndexer(t, func(conn net.Conn) {})
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	c.Version = 2
+	c.CloseNow()
+
+	failed := make(chan *Message, 1)
+	a := NewAsyncConn(c)
+	a.OnError = func(m *Message, err error) {
+		failed <- m
+	}
+	m := &Message{Raw: "undeliverable"}
+	if err := a.Enqueue(m); err != nil {
+		t.Fatalf("Enqueue() error = %v", err)
+	}
+	select {
+	case got := <-failed:
+		if got != m {
+			t.Errorf("OnError() message = %v, want %v", got, m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for OnError")
+	}
+	a.Close()
+}
+
+func TestAsyncConnDrain(t *testing.T) {
+	var received atomic.Int64
+	s := startTestServer(t)
+	s.Logger = nil
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		received.Add(1)
+		return nil
+	})
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	a := NewAsyncConn(c)
+	for i := 0; i < 100; i++ {
+		if err := a.Enqueue(&Message{Raw: fmt.Sprintf("message %d", i)}); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Drain(ctx); err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+	if err := a.Enqueue(&Message{Raw: "late"}); err != ErrQueueClosed {
+		t.Errorf("Enqueue() after Drain() error = %v, want %v", err, ErrQueueClosed)
+	}
+	if got := c.Stats().MessagesSent; got != 100 {
+		t.Errorf("Stats().MessagesSent = %d, want 100", got)
+	}
+
+	c.Close()
+	waitForActive(t, s, 0)
+	if got := received.Load(); got != 100 {
+		t.Errorf("server received %d messages, want 100", got)
+	}
+}
+
+func TestAsyncConnDrainTimeout(t *testing.T) {
+	// a handler that never returns stops the server reading, so writes block
+	// once the socket buffers are full
+	release := make(chan struct{})
+	s := startTestServer(t)
+	s.Logger = nil
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		<-release
+		return nil
+	})
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	a := NewAsyncConn(c)
+	raw := strings.Repeat("x", 1<<20)
+	for i := 0; i < 32; i++ {
+		if err := a.Enqueue(&Message{Raw: raw}); err != nil {
+			t.Fatalf("Enqueue() error = %v", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = a.Drain(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "still queued") {
+		t.Errorf("Drain() error = %v, want %v with the queued count", err, context.DeadlineExceeded)
+	}
+
+	close(release)
+	a.Close()
+}
@@ -0,0 +1,164 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// DefaultDownRetryInterval is how long an endpoint that failed is skipped
+const DefaultDownRetryInterval = 30 * time.Second
+
+// ErrNoEndpoints is returned when a LoadBalancer has no endpoints
+var ErrNoEndpoints = errors.New("no endpoints configured")
+
+// BalanceStrategy selects the endpoint a LoadBalancer sends each message to
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin cycles through endpoints in order
+	BalanceRoundRobin BalanceStrategy = iota
+	// BalanceRandom picks a random endpoint for each message
+	BalanceRandom
+	// BalanceSticky sends messages with the same StickyKey to the same endpoint
+	BalanceSticky
+)
+
+// LoadBalancer distributes messages across multiple endpoints, such as the
+// indexers in a cluster, keeping one connection open to each. If sending to
+// an endpoint fails because of its connection, the message is sent to the
+// next endpoint instead, and the failed endpoint is skipped for
+// DownRetryInterval; invalid messages fail at once. If RebalanceInterval
+// is set, connections older than it are closed and redialed before use, like
+// a Splunk forwarder's autoLBFrequency.
+type LoadBalancer struct {
+	Endpoints         []string
+	Strategy          BalanceStrategy
+	StickyKey         func(m *Message) string
+	RebalanceInterval time.Duration
+	DownRetryInterval time.Duration
+	Dial              func(endpoint string) (*Conn, error)
+	mu                sync.Mutex
+	next              int
+	conns             map[string]*lazyConn
+	down              map[string]time.Time
+}
+
+// NewLoadBalancer creates a LoadBalancer for endpoints using strategy.
+// Sticky balancing uses the message Host as the key unless StickyKey is set.
+func NewLoadBalancer(endpoints []string, strategy BalanceStrategy) *LoadBalancer {
+	return &LoadBalancer{
+		Endpoints:         endpoints,
+		Strategy:          strategy,
+		StickyKey:         func(m *Message) string { return m.Host },
+		DownRetryInterval: DefaultDownRetryInterval,
+		Dial:              Connect,
+		conns:             make(map[string]*lazyConn),
+		down:              make(map[string]time.Time),
+	}
+}
+
+// SendMessage sends a message to an endpoint chosen by the strategy,
+// failing over to the other endpoints if it cannot be sent
+func (lb *LoadBalancer) SendMessage(m *Message) error {
+	if len(lb.Endpoints) == 0 {
+		return ErrNoEndpoints
+	}
+	if m == nil {
+		return ErrNilMessage
+	}
+
+	candidates := lb.candidates(m)
+	return failover(len(candidates), func(i int) error {
+		err := lb.send(candidates[i], m)
+		if err != nil && isConnError(err) {
+			lb.mu.Lock()
+			lb.down[candidates[i]] = time.Now()
+			lb.mu.Unlock()
+		}
+		return err
+	})
+}
+
+// candidates returns the endpoints to try in order, with endpoints that
+// recently failed moved to the end
+func (lb *LoadBalancer) candidates(m *Message) []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	n := len(lb.Endpoints)
+	var start int
+	switch lb.Strategy {
+	case BalanceRandom:
+		start = rand.Intn(n)
+	case BalanceSticky:
+		h := fnv.New32a()
+		if lb.StickyKey != nil {
+			h.Write([]byte(lb.StickyKey(m)))
+		}
+		start = int(h.Sum32() % uint32(n))
+	default:
+		start = lb.next % n
+		lb.next++
+	}
+
+	var up, down []string
+	for i := 0; i < n; i++ {
+		endpoint := lb.Endpoints[(start+i)%n]
+		if failed, ok := lb.down[endpoint]; ok && time.Since(failed) < lb.DownRetryInterval {
+			down = append(down, endpoint)
+		} else {
+			delete(lb.down, endpoint)
+			up = append(up, endpoint)
+		}
+	}
+	return append(up, down...)
+}
+
+// send sends a message to an endpoint, dialing it if needed
+func (lb *LoadBalancer) send(endpoint string, m *Message) error {
+	lb.mu.Lock()
+	lc, ok := lb.conns[endpoint]
+	if !ok {
+		lc = &lazyConn{}
+		lb.conns[endpoint] = lc
+	}
+	lb.mu.Unlock()
+
+	return lc.send(m, lb.RebalanceInterval, func() (*Conn, error) {
+		return lb.Dial(endpoint)
+	})
+}
+
+// Close closes the connections to all endpoints
+func (lb *LoadBalancer) Close() error {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	var err error
+	for _, lc := range lb.conns {
+		if closeErr := lc.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,231 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingServer is a test server that counts the messages it receives by host
+type countingServer struct {
+	*Server
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// startCountingServer starts a countingServer on a random local port
+func startCountingServer(t *testing.T) *countingServer {
+	t.Helper()
+	cs := &countingServer{Server: NewServer("127.0.0.1:0"), counts: map[string]int{}}
+	cs.Logger = nil
+	cs.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+		cs.counts[m.Host]++
+		return nil
+	})
+	if err := cs.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { cs.Stop() })
+	return cs
+}
+
+// total waits for the server to stop receiving messages and returns the count
+func (cs *countingServer) total() int {
+	last := -1
+	for i := 0; i < 100; i++ {
+		cs.mu.Lock()
+		n := 0
+		for _, c := range cs.counts {
+			n += c
+		}
+		cs.mu.Unlock()
+		if n == last {
+			return n
+		}
+		last = n
+		time.Sleep(20 * time.Millisecond)
+	}
+	return last
+}
+
+func TestLoadBalancerStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy BalanceStrategy
+		min, max int
+	}{
+		{"round robin", BalanceRoundRobin, 50, 50},
+		{"random", BalanceRandom, 25, 75},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s1, s2 := startCountingServer(t), startCountingServer(t)
+			lb := NewLoadBalancer([]string{s1.listener.Addr().String(), s2.listener.Addr().String()}, tt.strategy)
+
+			for i := 0; i < 100; i++ {
+				if err := lb.SendMessage(&Message{Raw: "balanced message"}); err != nil {
+					t.Fatalf("SendMessage() error = %v", err)
+				}
+			}
+			lb.Close()
+
+			n1, n2 := s1.total(), s2.total()
+			if n1+n2 != 100 {
+				t.Errorf("servers received %d messages, want 100", n1+n2)
+			}
+			for _, n := range []int{n1, n2} {
+				if n < tt.min || n > tt.max {
+					t.Errorf("server received %d messages, want between %d and %d", n, tt.min, tt.max)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadBalancerSticky(t *testing.T) {
+	s1, s2 := startCountingServer(t), startCountingServer(t)
+	lb := NewLoadBalancer([]string{s1.listener.Addr().String(), s2.listener.Addr().String()}, BalanceSticky)
+
+	hosts := []string{"host1", "host2", "host3", "host4", "host5", "host6"}
+	for i := 0; i < 10; i++ {
+		for _, host := range hosts {
+			if err := lb.SendMessage(&Message{Host: host, Raw: "sticky message"}); err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+		}
+	}
+	lb.Close()
+	s1.total()
+	s2.total()
+
+	s1.mu.Lock()
+	defer s1.mu.Unlock()
+	s2.mu.Lock()
+	defer s2.mu.Unlock()
+	for _, host := range hosts {
+		if s1.counts[host] != 0 && s2.counts[host] != 0 {
+			t.Errorf("%s was sent to both servers", host)
+		}
+		if s1.counts[host]+s2.counts[host] != 10 {
+			t.Errorf("%s sent %d messages, want 10", host, s1.counts[host]+s2.counts[host])
+		}
+	}
+}
+
+func TestLoadBalancerFailover(t *testing.T) {
+	s1 := startCountingServer(t)
+
+	// an endpoint with nothing listening
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	down := listener.Addr().String()
+	listener.Close()
+
+	lb := NewLoadBalancer([]string{down, s1.listener.Addr().String()}, BalanceRoundRobin)
+	dials := map[string]int{}
+	lb.Dial = func(endpoint string) (*Conn, error) {
+		dials[endpoint]++
+		return Connect(endpoint)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := lb.SendMessage(&Message{Raw: "failover message"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	lb.Close()
+
+	if n := s1.total(); n != 10 {
+		t.Errorf("server received %d messages, want 10", n)
+	}
+	if dials[down] != 1 {
+		t.Errorf("dialed down endpoint %d times, want 1", dials[down])
+	}
+}
+
+func TestLoadBalancerRebalance(t *testing.T) {
+	s1 := startCountingServer(t)
+	lb := NewLoadBalancer([]string{s1.listener.Addr().String()}, BalanceRoundRobin)
+	lb.RebalanceInterval = 10 * time.Millisecond
+	dials := 0
+	lb.Dial = func(endpoint string) (*Conn, error) {
+		dials++
+		return Connect(endpoint)
+	}
+	defer lb.Close()
+
+	for i := 0; i < 3; i++ {
+		if err := lb.SendMessage(&Message{Raw: "rebalanced message"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if dials != 3 {
+		t.Errorf("dialed %d times, want 3", dials)
+	}
+}
+
+func TestLoadBalancerInvalidMessage(t *testing.T) {
+	s1, s2 := startCountingServer(t), startCountingServer(t)
+	lb := NewLoadBalancer([]string{s1.listener.Addr().String(), s2.listener.Addr().String()}, BalanceRoundRobin)
+	dials := 0
+	lb.Dial = func(endpoint string) (*Conn, error) {
+		dials++
+		c, err := Connect(endpoint)
+		if err == nil {
+			c.RequireIndex = true
+		}
+		return c, err
+	}
+	defer lb.Close()
+
+	valid := &Message{Index: "main", Raw: "balanced message"}
+	for range 2 {
+		if err := lb.SendMessage(valid); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	for _, tt := range invalidMessages {
+		if err := lb.SendMessage(tt.m); !errors.Is(err, tt.wantErr) {
+			t.Errorf("SendMessage(%s) error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+	if len(lb.down) != 0 {
+		t.Errorf("endpoints marked down = %v, want none", lb.down)
+	}
+	for range 2 {
+		if err := lb.SendMessage(valid); err != nil {
+			t.Fatalf("SendMessage() after invalid messages error = %v", err)
+		}
+	}
+	if dials != 2 {
+		t.Errorf("dialed %d times, want 2", dials)
+	}
+	if n := s1.total() + s2.total(); n != 4 {
+		t.Errorf("servers received %d messages, want 4", n)
+	}
+}
@@ -0,0 +1,144 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// channelKey is the field used to carry the channel identifier of a message
+const channelKey = "__s2s_channel"
+
+var (
+	ErrChannelsUnsupported = errors.New("indexer does not support channels")
+	ErrChannelLimit        = errors.New("channel limit reached")
+	ErrChannelClosed       = errors.New("channel is closed")
+)
+
+// Channel is a stream of messages within a Conn whose acknowledgements are
+// tracked independently of other channels. Channels require UseAck and an
+// indexer that advertises idx_can_recv_token, which allows up to
+// Capabilities.ChannelLimit channels to be open at once.
+type Channel struct {
+	ID   uint64
+	conn *Conn
+	acks *ackTracker
+}
+
+// OpenChannel opens a new channel, performing the handshake if needed
+func (c *Conn) OpenChannel() (*Channel, error) {
+	if !c.UseAck {
+		return nil, ErrAckDisabled
+	}
+	if err := c.ensureHandshake(); err != nil {
+		return nil, err
+	}
+	if !c.Capabilities.CanReceiveToken {
+		return nil, ErrChannelsUnsupported
+	}
+
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+	if c.channelsClosed {
+		return nil, ErrAckConnClosed
+	}
+	if limit := c.Capabilities.ChannelLimit; limit > 0 && len(c.channels) >= limit {
+		return nil, fmt.Errorf("%w: indexer allows %d channels", ErrChannelLimit, limit)
+	}
+	c.lastChannel++
+	ch := &Channel{ID: c.lastChannel, conn: c, acks: newAckTracker()}
+	c.channels[ch.ID] = ch
+	return ch, nil
+}
+
+// SendMessageAsync sends a message on the channel and returns its
+// acknowledgement identifier without waiting. The acknowledgement is
+// delivered on Acks.
+func (ch *Channel) SendMessageAsync(m *Message) (uint64, error) {
+	return ch.send(m, nil)
+}
+
+// SendMessageAck sends a message on the channel and blocks until the indexer
+// acknowledges it
+func (ch *Channel) SendMessageAck(m *Message) error {
+	waiter := make(chan Ack, 1)
+	id, err := ch.send(m, waiter)
+	if err != nil {
+		return err
+	}
+	return ch.conn.waitAck(ch.acks, id, waiter)
+}
+
+// Acks returns a channel that receives acknowledgements for messages sent with
+// SendMessageAsync. It is closed when the channel or connection is closed, and
+// acknowledgements are dropped if it is full.
+func (ch *Channel) Acks() <-chan Ack {
+	return ch.acks.acks
+}
+
+// Close closes the channel, freeing it to be reopened under the channel limit.
+// Acknowledgements that arrive after the channel is closed are dropped.
+func (ch *Channel) Close() error {
+	c := ch.conn
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+	if c.channels[ch.ID] != ch {
+		return nil
+	}
+	delete(c.channels, ch.ID)
+	close(ch.acks.acks)
+	return nil
+}
+
+// send tags a message with the channel identifier and sends it
+func (ch *Channel) send(m *Message, waiter chan Ack) (uint64, error) {
+	if m == nil {
+		return 0, ErrNilMessage
+	}
+	c := ch.conn
+	c.channelMu.Lock()
+	open := c.channels[ch.ID] == ch
+	c.channelMu.Unlock()
+	if !open {
+		return 0, ErrChannelClosed
+	}
+	return c.sendWithAck(ch.acks, withField(m, channelKey, strconv.FormatUint(ch.ID, 10)), nil, waiter)
+}
+
+// deliverChannelAck passes an acknowledgement to its channel, dropping it if
+// the channel has been closed
+func (c *Conn) deliverChannelAck(ack Ack) {
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+	if ch, ok := c.channels[ack.Channel]; ok {
+		ch.acks.deliver(ack)
+	}
+}
+
+// closeChannels closes all open channels once acknowledgements stop arriving
+func (c *Conn) closeChannels() {
+	c.channelMu.Lock()
+	defer c.channelMu.Unlock()
+	c.channelsClosed = true
+	for id, ch := range c.channels {
+		delete(c.channels, id)
+		close(ch.acks.acks)
+	}
+}
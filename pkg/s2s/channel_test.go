@@ -0,0 +1,184 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startChannelIndexer starts a mock indexer with the given capabilities that
+// reads n messages and then acknowledges them in reverse order
+func startChannelIndexer(t *testing.T, capabilities string, n int) string {
+	t.Helper()
+	return startMockIndexer(t, func(conn net.Conn) {
+		m := &Message{}
+		if err := m.Read(conn); err != nil {
+			return
+		}
+		resp := &Message{Fields: map[string]string{controlMsgKey: capabilities}}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+
+		var received []*Message
+		for len(received) < n {
+			m := &Message{}
+			if err := m.Read(conn); err != nil {
+				return
+			}
+			received = append(received, m)
+		}
+		for i := len(received) - 1; i >= 0; i-- {
+			id, _ := strconv.ParseUint(received[i].Fields[ackIDKey], 10, 64)
+			channel, _ := strconv.ParseUint(received[i].Fields[channelKey], 10, 64)
+			if err := SendChannelAck(conn, channel, id, true); err != nil {
+				return
+			}
+		}
+		// wait for the client to close the connection
+		conn.Read(make([]byte, 1))
+	})
+}
+
+func TestChannelAcks(t *testing.T) {
+	endpoint := startChannelIndexer(t, "cap_response=success;idx_can_recv_token=true;channel_limit=2", 5)
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+
+	channels := make([]*Channel, 2)
+	for i := range channels {
+		if channels[i], err = c.OpenChannel(); err != nil {
+			t.Fatalf("OpenChannel() error = %v", err)
+		}
+	}
+	if channels[0].ID == channels[1].ID {
+		t.Fatalf("OpenChannel() returned duplicate ID %d", channels[0].ID)
+	}
+
+	// interleave messages so that each channel numbers its acks independently
+	sent := []int{0, 1, 0, 1, 0}
+	for _, i := range sent {
+		if _, err := channels[i].SendMessageAsync(&Message{Raw: "event"}); err != nil {
+			t.Fatalf("SendMessageAsync() error = %v", err)
+		}
+	}
+
+	for i, want := range []int{3, 2} {
+		ch := channels[i]
+		ids := make(map[uint64]bool)
+		for len(ids) < want {
+			select {
+			case ack := <-ch.Acks():
+				if ack.Channel != ch.ID || !ack.Success {
+					t.Errorf("channel %d ack = %+v, want Channel %d and Success", ch.ID, ack, ch.ID)
+				}
+				ids[ack.ID] = true
+			case <-time.After(5 * time.Second):
+				t.Fatalf("channel %d received %d acks, want %d", ch.ID, len(ids), want)
+			}
+		}
+		for id := uint64(1); id <= uint64(want); id++ {
+			if !ids[id] {
+				t.Errorf("channel %d missing ack %d, got %v", ch.ID, id, ids)
+			}
+		}
+	}
+	select {
+	case ack := <-c.Acks():
+		t.Errorf("Acks() received %+v, want no connection acks", ack)
+	default:
+	}
+}
+
+func TestOpenChannelLimit(t *testing.T) {
+	endpoint := startChannelIndexer(t, "cap_response=success;idx_can_recv_token=true;channel_limit=2", 0)
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+
+	first, err := c.OpenChannel()
+	if err != nil {
+		t.Fatalf("OpenChannel() error = %v", err)
+	}
+	if _, err := c.OpenChannel(); err != nil {
+		t.Fatalf("OpenChannel() error = %v", err)
+	}
+	if _, err := c.OpenChannel(); !errors.Is(err, ErrChannelLimit) {
+		t.Fatalf("OpenChannel() error = %v, want %v", err, ErrChannelLimit)
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if _, err := first.SendMessageAsync(&Message{Raw: "event"}); !errors.Is(err, ErrChannelClosed) {
+		t.Errorf("SendMessageAsync() error = %v, want %v", err, ErrChannelClosed)
+	}
+	if _, err := c.OpenChannel(); err != nil {
+		t.Errorf("OpenChannel() after Close() error = %v", err)
+	}
+}
+
+func TestOpenChannelUnsupported(t *testing.T) {
+	endpoint := startChannelIndexer(t, "cap_response=success", 0)
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+
+	if _, err := c.OpenChannel(); !errors.Is(err, ErrAckDisabled) {
+		t.Errorf("OpenChannel() without UseAck error = %v, want %v", err, ErrAckDisabled)
+	}
+	c.UseAck = true
+	if _, err := c.OpenChannel(); !errors.Is(err, ErrChannelsUnsupported) {
+		t.Errorf("OpenChannel() error = %v, want %v", err, ErrChannelsUnsupported)
+	}
+}
+
+func TestServerChannelAcks(t *testing.T) {
+	s := startTestServerWith(t, func(s *Server) {
+		s.Capabilities.CanReceiveToken = true
+	})
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+
+	for i := 0; i < 2; i++ {
+		ch, err := c.OpenChannel()
+		if err != nil {
+			t.Fatalf("OpenChannel() error = %v", err)
+		}
+		if err := ch.SendMessageAck(&Message{Raw: "acked message"}); err != nil {
+			t.Fatalf("SendMessageAck() error = %v", err)
+		}
+	}
+}
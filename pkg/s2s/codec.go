@@ -18,17 +18,132 @@
 package s2s
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var ErrInvalidData = errors.New("invalid data format")
 var ErrNilMessage = errors.New("message is nil")
+var ErrInvalidFieldName = errors.New("invalid field name")
+var ErrMissingIndex = errors.New("message has no index")
+var ErrReservedField = errors.New("field name is reserved")
+var ErrMessageTooLarge = errors.New("message exceeds size limit")
+
+// Keys and value prefixes used by Splunk to encode message metadata. Note that
+// only the index key has a leading underscore, and only its value is not prefixed.
+const (
+	metaIndexKey         = "_MetaData:Index"
+	metaHostKey          = "MetaData:Host"
+	metaSourceKey        = "MetaData:Source"
+	metaSourceTypeKey    = "MetaData:Sourcetype"
+	metaHostPrefix       = "host::"
+	metaSourcePrefix     = "source::"
+	metaSourceTypePrefix = "sourcetype::"
+)
+
+// MetadataKeys are the keys used to encode the Index, Host, Source and
+// SourceType of a message, and the prefixes added to their values. They can
+// be set on an Encoder or Decoder to interoperate with systems that emulate
+// the protocol with different conventions.
+type MetadataKeys struct {
+	IndexKey         string
+	HostKey          string
+	SourceKey        string
+	SourceTypeKey    string
+	IndexPrefix      string
+	HostPrefix       string
+	SourcePrefix     string
+	SourceTypePrefix string
+}
+
+// DefaultMetadataKeys are the metadata keys and value prefixes used by Splunk
+var DefaultMetadataKeys = MetadataKeys{
+	IndexKey:         metaIndexKey,
+	HostKey:          metaHostKey,
+	SourceKey:        metaSourceKey,
+	SourceTypeKey:    metaSourceTypeKey,
+	HostPrefix:       metaHostPrefix,
+	SourcePrefix:     metaSourcePrefix,
+	SourceTypePrefix: metaSourceTypePrefix,
+}
+
+// metadataKeys returns keys, or DefaultMetadataKeys if it is nil
+func metadataKeys(keys *MetadataKeys) *MetadataKeys {
+	if keys == nil {
+		return &DefaultMetadataKeys
+	}
+	return keys
+}
+
+// isKey returns true if k is one of the metadata keys
+func (keys *MetadataKeys) isKey(k string) bool {
+	return k == keys.IndexKey || k == keys.HostKey || k == keys.SourceKey || k == keys.SourceTypeKey
+}
+
+// reservedFields are the keys written by EncodeMessage for metadata, times
+// and _raw, and the _compressed marker, which would conflict with a field of
+// the same name
+var reservedFields = map[string]bool{
+	metaIndexKey:      true,
+	metaHostKey:       true,
+	metaSourceKey:     true,
+	metaSourceTypeKey: true,
+	"_time":           true,
+	"_indextime":      true,
+	"_done":           true,
+	"_raw":            true,
+	compressedRawKey:  true,
+}
+
+// isReservedField returns true if a field named k with value v would conflict
+// with a key written by EncodeMessage or interpreted by a Server. The
+// _compressed field is allowed only with the value set by CompressRaw.
+func isReservedField(k, v string) bool {
+	if k == compressedRawKey {
+		return v != gzipEncoding
+	}
+	return reservedFields[k]
+}
+
+const (
+	// DefaultMaxFields is the default limit on the number of fields in a decoded message
+	DefaultMaxFields = 4096
+
+	// DefaultMaxMessageSize is the default limit on the size of a decoded message
+	DefaultMaxMessageSize = 64 << 20
+)
+
+// DecodeLimits bound the resources used to decode a message, so that a
+// hostile peer cannot declare a huge message and exhaust memory. A limit of
+// zero means the default is used. If SkipOversized is set, a message larger
+// than MaxMessageSize is discarded without being buffered and
+// ErrMessageTooLarge is returned, so that the next message can be read.
+type DecodeLimits struct {
+	MaxFields      int
+	MaxMessageSize int
+	SkipOversized  bool
+}
+
+// withDefaults returns the limits with zero values replaced by the defaults
+func (l DecodeLimits) withDefaults() DecodeLimits {
+	if l.MaxFields <= 0 {
+		l.MaxFields = DefaultMaxFields
+	}
+	if l.MaxMessageSize <= 0 {
+		l.MaxMessageSize = DefaultMaxMessageSize
+	}
+	return l
+}
 
 // EncodeString writes a string to the given writer in the wire protocol format.
 // The format is: 4-byte length (big-endian uint32) + string contents + null terminator
@@ -51,35 +166,150 @@ func EncodeString(w io.Writer, s string) error {
 	return nil
 }
 
+// frameReader limits reads to the rest of a message and tracks the stream
+// offset of the next byte, so that decoding errors can say where they occurred
+type frameReader struct {
+	io.LimitedReader
+	end int64
+}
+
+// newFrameReader returns a reader for the size bytes of a message body that
+// starts at the given stream offset
+func newFrameReader(r io.Reader, size uint32, offset int64) *frameReader {
+	return &frameReader{
+		LimitedReader: io.LimitedReader{R: r, N: int64(size)},
+		end:           offset + int64(size),
+	}
+}
+
+// offset returns the stream offset of the next byte to be read
+func (f *frameReader) offset() int64 {
+	return f.end - f.N
+}
+
 // DecodeString reads a string from the given reader in the wire protocol format.
 // The format is: 4-byte length (big-endian uint32) + string contents + null terminator
+// Offsets in errors are relative to the start of the string unless it is
+// decoded as part of a message.
 func DecodeString(r io.Reader) (string, error) {
-	// Read length
-	var length uint32
-	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+	var b readBuffer
+	buf, err := b.readString(r)
+	if err != nil {
 		return "", err
 	}
+	return string(buf), nil
+}
+
+// maxInternedStrings bounds the number of strings interned by a readBuffer
+const maxInternedStrings = 1024
+
+// readBuffer reads wire protocol values into a reusable scratch buffer, so
+// that decoding a stream does not allocate for every length and string. Field
+// names and metadata values are interned if strings is not nil, since they
+// recur in most messages of a stream.
+type readBuffer struct {
+	scratch []byte
+	strings map[string]string
+}
 
-	// Read string contents
-	buf := make([]byte, length-1)
+// grow returns the scratch buffer resized to n bytes
+func (b *readBuffer) grow(n int) []byte {
+	if cap(b.scratch) < n {
+		// most strings are short, so start big enough to avoid regrowing
+		b.scratch = make([]byte, max(n, 2*cap(b.scratch), 128))
+	}
+	return b.scratch[:n]
+}
+
+// readUint32 reads a big-endian uint32
+func (b *readBuffer) readUint32(r io.Reader) (uint32, error) {
+	buf := b.grow(4)
 	if _, err := io.ReadFull(r, buf); err != nil {
-		return "", err
+		return 0, err
 	}
+	return binary.BigEndian.Uint32(buf), nil
+}
 
-	// Read and verify null terminator
-	nullByte := make([]byte, 1)
-	if _, err := io.ReadFull(r, nullByte); err != nil {
-		return "", err
+// maxUncheckedString is the largest string length that is allocated before
+// reading a string that is not part of a message
+const maxUncheckedString = 64 << 10
+
+// readGrowing reads the n-1 bytes of a string's contents into a buffer of n
+// bytes, which grows as the data is read so that a bogus length from a
+// truncated stream does not allocate n bytes
+func readGrowing(r io.Reader, n int) ([]byte, error) {
+	var buf bytes.Buffer
+	copied, err := io.CopyN(&buf, r, int64(n-1))
+	if err == io.EOF && copied > 0 {
+		err = io.ErrUnexpectedEOF
 	}
-	if nullByte[0] != 0 {
-		return "", ErrInvalidData
+	if err != nil {
+		return nil, err
 	}
+	buf.WriteByte(0)
+	return buf.Bytes(), nil
+}
 
-	return string(buf), nil
+// readString reads a string in the wire protocol format, returning its
+// contents without the null terminator. The contents are only valid until the
+// next read.
+func (b *readBuffer) readString(r io.Reader) ([]byte, error) {
+	// Read length, which includes the null terminator
+	length, err := b.readUint32(r)
+	if err != nil {
+		return nil, err
+	}
+	if length == 0 {
+		return nil, ErrInvalidData
+	}
+	fr, inFrame := r.(*frameReader)
+	if inFrame && int64(length) > fr.N {
+		// don't allocate more than the rest of the message
+		return nil, ErrInvalidData
+	}
+
+	// Read string contents, then the null terminator. Outside of a message
+	// a large length cannot be checked, so it is read as the data arrives.
+	var buf []byte
+	if inFrame || length <= maxUncheckedString {
+		buf = b.grow(int(length))
+		if _, err := io.ReadFull(r, buf[:length-1]); err != nil {
+			return nil, err
+		}
+	} else if buf, err = readGrowing(r, int(length)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, buf[length-1:]); err != nil {
+		return nil, err
+	}
+	if null := buf[length-1]; null != 0 {
+		offset := int64(length) + 3
+		if inFrame {
+			offset = fr.offset() - 1
+		}
+		return nil, fmt.Errorf("%w: invalid null terminator 0x%02x at offset %d", ErrInvalidData, null, offset)
+	}
+	return buf[:length-1], nil
+}
+
+// intern returns buf as a string, reusing an earlier copy if there is one
+func (b *readBuffer) intern(buf []byte) string {
+	if s, ok := b.strings[string(buf)]; ok {
+		return s
+	}
+	s := string(buf)
+	if b.strings != nil && len(b.strings) < maxInternedStrings {
+		b.strings[s] = s
+	}
+	return s
 }
 
 // EncodeKeyValue writes a key-value pair to the given writer in the wire protocol format.
+// The key must be valid UTF-8 without control characters, but the value may be anything.
 func EncodeKeyValue(w io.Writer, key string, value string) error {
+	if err := validateFieldName(key); err != nil {
+		return err
+	}
 	if err := EncodeString(w, key); err != nil {
 		return err
 	}
@@ -101,13 +331,60 @@ func DecodeKeyValue(r io.Reader, key *string, value *string) error {
 }
 
 // EncodeMessage writes an message to the given writer in the wire protocol format.
+// Fields must not use the keys reserved for metadata, times and _raw, such as
+// "_raw" or "_MetaData:Index"; set the corresponding Message field instead, or
+// ErrReservedField is returned.
 func EncodeMessage(w io.Writer, m *Message) error {
 	if m == nil {
 		return ErrNilMessage
 	}
+	return encodeMessage(w, m, nil, len(m.Raw), func(w io.Writer) error {
+		_, err := io.WriteString(w, m.Raw)
+		return err
+	})
+}
+
+// EncodeMessageReader writes a message like EncodeMessage, but streams the
+// rawLen bytes of its _raw value from raw instead of using m.Raw, so that
+// large payloads are not held in memory. If raw ends early, the message is
+// left incomplete and io.ErrUnexpectedEOF is returned.
+func EncodeMessageReader(w io.Writer, m *Message, raw io.Reader, rawLen int) error {
+	if m == nil {
+		return ErrNilMessage
+	}
+	if rawLen < 0 || int64(rawLen) > maxRawLen {
+		return fmt.Errorf("%w: raw length %d out of range", ErrInvalidData, rawLen)
+	}
+	return encodeMessage(w, m, nil, rawLen, func(w io.Writer) error {
+		_, err := io.CopyN(w, raw, int64(rawLen))
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+// maxRawLen is the largest _raw value that fits in a message alongside a
+// reasonable amount of metadata
+const maxRawLen = math.MaxUint32 - 1<<20
+
+// encodeMessage writes a message whose _raw value of rawLen bytes is written by
+// writeRaw, using meta to encode its metadata, or DefaultMetadataKeys if it is nil
+func encodeMessage(w io.Writer, m *Message, meta *MetadataKeys, rawLen int, writeRaw func(io.Writer) error) error {
+	meta = metadataKeys(meta)
+
+	// check field names before writing anything, so a bad one cannot leave a partial message
+	for k, v := range m.Fields {
+		if err := validateFieldName(k); err != nil {
+			return err
+		}
+		if isReservedField(k, v) || meta.isKey(k) {
+			return fmt.Errorf("%w: %q", ErrReservedField, k)
+		}
+	}
 
 	// write size and maps header fields
-	size, maps := getHeaderValues(m)
+	size, maps := headerValues(m, meta, rawLen)
 	if err := binary.Write(w, binary.BigEndian, size); err != nil {
 		return err
 	}
@@ -115,30 +392,30 @@ func EncodeMessage(w io.Writer, m *Message) error {
 		return err
 	}
 
-	// always write index (even if empty)
+	// write index if present; indexers use their default index otherwise
 	if m.Index != "" {
-		if err := EncodeKeyValue(w, "_MetaData:Index", m.Index); err != nil {
+		if err := EncodeKeyValue(w, meta.IndexKey, meta.IndexPrefix+m.Index); err != nil {
 			return err
 		}
 	}
 
 	// write host if present
 	if m.Host != "" {
-		if err := EncodeKeyValue(w, "MetaData:Host", "host::"+m.Host); err != nil {
+		if err := EncodeKeyValue(w, meta.HostKey, meta.HostPrefix+m.Host); err != nil {
 			return err
 		}
 	}
 
 	// write source if present
 	if m.Source != "" {
-		if err := EncodeKeyValue(w, "MetaData:Source", "source::"+m.Source); err != nil {
+		if err := EncodeKeyValue(w, meta.SourceKey, meta.SourcePrefix+m.Source); err != nil {
 			return err
 		}
 	}
 
 	// write source type if present
 	if m.SourceType != "" {
-		if err := EncodeKeyValue(w, "MetaData:Sourcetype", "sourcetype::"+m.SourceType); err != nil {
+		if err := EncodeKeyValue(w, meta.SourceTypeKey, meta.SourceTypePrefix+m.SourceType); err != nil {
 			return err
 		}
 	}
@@ -157,11 +434,27 @@ func EncodeMessage(w io.Writer, m *Message) error {
 		}
 	}
 
+	// write _indextime if present
+	if !m.IndexTime.IsZero() {
+		if err := EncodeKeyValue(w, "_indextime", fmt.Sprintf("%d", m.IndexTime.Unix())); err != nil {
+			return err
+		}
+	}
+
 	// write _done and _raw
 	if err := EncodeKeyValue(w, "_done", "_done"); err != nil {
 		return err
 	}
-	if err := EncodeKeyValue(w, "_raw", m.Raw); err != nil {
+	if err := EncodeString(w, "_raw"); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, uint32(rawLen+1)); err != nil {
+		return err
+	}
+	if err := writeRaw(w); err != nil {
+		return err
+	}
+	if _, err := w.Write([]byte{0}); err != nil {
 		return err
 	}
 
@@ -179,19 +472,137 @@ func EncodeMessage(w io.Writer, m *Message) error {
 }
 
 // DecodeMessage reads a message from the given reader in the wire protocol format.
+// Reads are limited to the declared message size, so that a malformed message
+// returns ErrInvalidData without consuming the message that follows it.
+// Messages that exceed the default DecodeLimits return ErrInvalidData.
 func DecodeMessage(r io.Reader, m *Message) error {
+	return DecodeMessageWithLimits(r, m, DecodeLimits{})
+}
+
+// maxPooledBufferSize is the largest buffer that MarshalMessage returns to its pool
+const maxPooledBufferSize = 1 << 20
+
+// bufferPool holds buffers for MarshalMessage
+var bufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// MarshalMessage returns the message encoded in the wire protocol format
+func MarshalMessage(m *Message) ([]byte, error) {
+	if m == nil {
+		return nil, ErrNilMessage
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		if buf.Cap() <= maxPooledBufferSize {
+			buf.Reset()
+			bufferPool.Put(buf)
+		}
+	}()
+	if err := EncodeMessage(buf, m); err != nil {
+		return nil, err
+	}
+	return bytes.Clone(buf.Bytes()), nil
+}
+
+// UnmarshalMessage decodes the message at the start of b into m, replacing
+// its contents, and returns the number of bytes consumed so that a buffer of
+// concatenated messages can be walked. It returns io.EOF if b is empty and
+// io.ErrUnexpectedEOF if b ends in the middle of a message. A malformed
+// message returns ErrInvalidData with the bytes consumed including the rest
+// of its declared size, so the next message can be decoded.
+func UnmarshalMessage(b []byte, m *Message) (int, error) {
+	if m == nil {
+		return 0, ErrNilMessage
+	}
+	m.Clear()
+	r := bytes.NewReader(b)
+	err := DecodeMessage(r, m)
+	return len(b) - r.Len(), err
+}
+
+// DecodeMessageWithLimits reads a message like DecodeMessage, returning
+// ErrInvalidData if it exceeds the given limits. An oversized message is
+// rejected before it is read, so the rest of the stream cannot be decoded
+// unless SkipOversized is set.
+func DecodeMessageWithLimits(r io.Reader, m *Message, limits DecodeLimits) error {
+	return decodeMessage(r, m, limits, nil, false, 0, &readBuffer{})
+}
+
+// errNonstandardTrailer is returned when a message decoded leniently does not
+// end with the _raw padding and trailer. The message itself is valid.
+var errNonstandardTrailer = errors.New("message does not end with the _raw padding and trailer")
+
+// rawTrailer is the padding and "_raw" trailer that end every message
+var rawTrailer = []byte{0, 0, 0, 0, 0, 0, 0, 5, '_', 'r', 'a', 'w', 0}
+
+// decodeMessage reads a message that starts at the given stream offset using
+// b, and keys to decode its metadata, or DefaultMetadataKeys if it is nil. If
+// lenient is set, whatever follows the fields is skipped instead of being
+// verified as the padding and trailer, and errNonstandardTrailer is returned
+// if they were missing.
+func decodeMessage(r io.Reader, m *Message, limits DecodeLimits, keys *MetadataKeys, lenient bool, offset int64, b *readBuffer) error {
 	if m == nil {
 		return ErrNilMessage
 	}
+	limits = limits.withDefaults()
 
-	// Read size and maps count
-	var size, maps uint32
-	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+	// Read size, which counts the bytes that follow it
+	size, err := b.readUint32(r)
+	if err != nil {
 		return err
 	}
-	if err := binary.Read(r, binary.BigEndian, &maps); err != nil {
+	if size < 4 {
+		return ErrInvalidData
+	}
+	if int64(size) > int64(limits.MaxMessageSize) {
+		if !limits.SkipOversized {
+			return fmt.Errorf("%w: message size %d exceeds limit of %d", ErrInvalidData, size, limits.MaxMessageSize)
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		return fmt.Errorf("%w: message size %d exceeds limit of %d", ErrMessageTooLarge, size, limits.MaxMessageSize)
+	}
+
+	lr := newFrameReader(r, size, offset+4)
+	err = decodeMessageBody(lr, m, metadataKeys(keys), limits.MaxFields, lenient, b)
+	switch {
+	case err == nil && lr.N > 0:
+		err = ErrInvalidData
+	case (err == io.EOF || err == io.ErrUnexpectedEOF) && lr.N == 0:
+		// the trailer was not reached within the declared size
+		return ErrInvalidData
+	case err == io.EOF:
+		return io.ErrUnexpectedEOF
+	}
+	if errors.Is(err, ErrInvalidData) {
+		// skip the rest of the message so the next one can be read
+		if _, discardErr := io.Copy(io.Discard, lr); discardErr != nil {
+			return discardErr
+		}
+	}
+	return err
+}
+
+// decodeMessageBody reads the maps count, fields and trailer of a message
+func decodeMessageBody(r *frameReader, m *Message, keys *MetadataKeys, maxFields int, lenient bool, b *readBuffer) error {
+	maps, err := b.readUint32(r)
+	if err != nil {
 		return err
 	}
+	if int64(maps) > int64(maxFields) {
+		return fmt.Errorf("%w: %d fields exceeds limit of %d", ErrInvalidData, maps, maxFields)
+	}
+	// each key and value is at least a length and a null terminator
+	if int64(maps)*10 > r.N {
+		return fmt.Errorf("%w: %d fields cannot fit in message", ErrInvalidData, maps)
+	}
 
 	// sanity check that Fields are initialized
 	if m.Fields == nil {
@@ -201,73 +612,128 @@ func DecodeMessage(r io.Reader, m *Message) error {
 	// Read all key-value pairs
 	var mapsRead uint32
 	for mapsRead < maps {
-		var key, value string
-		if err := DecodeKeyValue(r, &key, &value); err != nil {
+		buf, err := b.readString(r)
+		if err != nil {
+			return err
+		}
+		key := b.intern(buf)
+		value, err := b.readString(r)
+		if err != nil {
 			return err
 		}
 
 		// Handle special metadata fields
 		switch key {
-		case "_MetaData:Index":
-			m.Index = value
-		case "MetaData:Host":
-			if strings.HasPrefix(value, "host::") {
-				m.Host = strings.TrimPrefix(value, "host::")
-			} else {
-				m.Host = value
-			}
-		case "MetaData:Source":
-			if strings.HasPrefix(value, "source::") {
-				m.Source = strings.TrimPrefix(value, "source::")
-			} else {
-				m.Source = value
-			}
-		case "MetaData:Sourcetype":
-			if strings.HasPrefix(value, "sourcetype::") {
-				m.SourceType = strings.TrimPrefix(value, "sourcetype::")
-			} else {
-				m.SourceType = value
-			}
+		case keys.IndexKey:
+			m.Index = b.intern(bytes.TrimPrefix(value, []byte(keys.IndexPrefix)))
+		case keys.HostKey:
+			m.Host = b.intern(bytes.TrimPrefix(value, []byte(keys.HostPrefix)))
+		case keys.SourceKey:
+			m.Source = b.intern(bytes.TrimPrefix(value, []byte(keys.SourcePrefix)))
+		case keys.SourceTypeKey:
+			m.SourceType = b.intern(bytes.TrimPrefix(value, []byte(keys.SourceTypePrefix)))
 		case "_time":
-			t, err := strconv.ParseInt(value, 10, 64)
+			t, err := strconv.ParseInt(string(value), 10, 64)
 			if err != nil {
 				return ErrInvalidData
 			}
 			m.Time = time.Unix(t, 0)
+		case "_indextime":
+			t, err := strconv.ParseInt(string(value), 10, 64)
+			if err != nil {
+				return ErrInvalidData
+			}
+			m.IndexTime = time.Unix(t, 0)
 		case "_done":
 			// Skip _done=_done
 		case "_raw":
-			m.Raw = value
+			m.Raw = string(value)
 		default:
-			m.Fields[key] = value
+			m.Fields[key] = string(value)
 		}
 
 		mapsRead++
 	}
 
+	offset := r.offset()
+	if lenient {
+		// some senders omit the padding, so accept the message as soon as
+		// all of its fields have been read
+		rest := b.grow(int(r.N))
+		if _, err := io.ReadFull(r, rest); err != nil {
+			return err
+		}
+		if !bytes.Equal(rest, rawTrailer) {
+			return fmt.Errorf("%w at offset %d", errNonstandardTrailer, offset)
+		}
+		return nil
+	}
+
 	// Read and verify _raw null padding (4 bytes)
-	var padding uint32
-	if err := binary.Read(r, binary.BigEndian, &padding); err != nil {
+	padding, err := b.readUint32(r)
+	if err != nil {
 		return err
 	}
 	if padding != 0 {
-		return ErrInvalidData
+		return fmt.Errorf("%w: invalid padding 0x%08x at offset %d", ErrInvalidData, padding, offset)
 	}
 
 	// Read and verify _raw trailer
-	trailer, err := DecodeString(r)
+	offset = r.offset()
+	trailer, err := b.readString(r)
 	if err != nil {
 		return err
 	}
-	if trailer != "_raw" {
-		return ErrInvalidData
+	if string(trailer) != "_raw" {
+		return fmt.Errorf("%w: invalid trailer %q at offset %d", ErrInvalidData, trailer, offset)
 	}
 
 	return nil
 }
 
-// getHeader returns message size and number of maps
-func getHeaderValues(m *Message) (uint32, uint32) {
+// validateFieldName returns ErrInvalidFieldName if a field name is not valid
+// UTF-8 or contains control characters, such as a null byte that would be
+// mistaken for the string terminator
+func validateFieldName(key string) error {
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("%w: %q is not valid UTF-8", ErrInvalidFieldName, key)
+	}
+	if strings.IndexFunc(key, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: %q contains a control character", ErrInvalidFieldName, key)
+	}
+	return nil
+}
+
+// countFrames returns the number of encoded messages in b, checking that the
+// size prefix of each one is consistent with the length of the buffer
+func countFrames(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, fmt.Errorf("%w: empty buffer", ErrInvalidData)
+	}
+	n := 0
+	for len(b) > 0 {
+		if len(b) < 8 {
+			return 0, fmt.Errorf("%w: truncated message header", ErrInvalidData)
+		}
+		size := uint64(binary.BigEndian.Uint32(b))
+		if size < 4 || size > uint64(len(b)-4) {
+			return 0, fmt.Errorf("%w: message size %d exceeds buffer", ErrInvalidData, size)
+		}
+		b = b[4+size:]
+		n++
+	}
+	return n, nil
+}
+
+// getHeaderValues returns the size and number of maps of a message whose
+// _raw value is rawLen bytes
+func getHeaderValues(m *Message, rawLen int) (uint32, uint32) {
+	return headerValues(m, &DefaultMetadataKeys, rawLen)
+}
+
+// headerValues returns the size and number of maps of a message whose _raw
+// value is rawLen bytes and whose metadata is encoded using keys
+func headerValues(m *Message, keys *MetadataKeys, rawLen int) (uint32, uint32) {
 	if m == nil {
 		return 0, 0
 	}
@@ -283,24 +749,19 @@ func getHeaderValues(m *Message) (uint32, uint32) {
 	maps := uint32(0)
 
 	if m.Index != "" {
-		// key is "_MetaData:Index"
-		size += 15 + uint32(len(m.Index)) + kvOverhead
+		size += uint32(len(keys.IndexKey)+len(keys.IndexPrefix)+len(m.Index)) + kvOverhead
 		maps += 1
 	}
-
 	if m.Host != "" {
-		// key is "MetaData:Host", value prefix is "host::"
-		size += 13 + 6 + uint32(len(m.Host)) + kvOverhead
+		size += uint32(len(keys.HostKey)+len(keys.HostPrefix)+len(m.Host)) + kvOverhead
 		maps += 1
 	}
 	if m.Source != "" {
-		// key is "MetaData:Source", value prefix is "source::"
-		size += 15 + 8 + uint32(len(m.Source)) + kvOverhead
+		size += uint32(len(keys.SourceKey)+len(keys.SourcePrefix)+len(m.Source)) + kvOverhead
 		maps += 1
 	}
 	if m.SourceType != "" {
-		// key is "MetaData:Sourcetype", value prefix is "sourcetype::"
-		size += 19 + 12 + uint32(len(m.SourceType)) + kvOverhead
+		size += uint32(len(keys.SourceTypeKey)+len(keys.SourceTypePrefix)+len(m.SourceType)) + kvOverhead
 		maps += 1
 	}
 
@@ -310,12 +771,23 @@ func getHeaderValues(m *Message) (uint32, uint32) {
 		maps += 1
 	}
 
+	if !m.Time.IsZero() {
+		// key is "_time"
+		size += 5 + uint32(len(fmt.Sprintf("%d", m.Time.Unix()))) + kvOverhead
+		maps += 1
+	}
+	if !m.IndexTime.IsZero() {
+		// key is "_indextime"
+		size += 10 + uint32(len(fmt.Sprintf("%d", m.IndexTime.Unix()))) + kvOverhead
+		maps += 1
+	}
+
 	// _done=_done
 	size += 10 + kvOverhead
 	maps += 1
 
 	// _raw=<raw>
-	size += 4 + uint32(len(m.Raw)) + kvOverhead
+	size += 4 + uint32(rawLen) + kvOverhead
 	maps += 1
 
 	// extra null padding after _raw
@@ -19,9 +19,16 @@ package s2s
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestEncodeString(t *testing.T) {
@@ -118,6 +125,18 @@ func TestDecodeString(t *testing.T) {
 			wantErr:     true,
 			errContains: "EOF",
 		},
+		{
+			name:    "huge length",
+			input:   []byte{0xff, 0xff, 0xff, 0xff, 'a'}, // must not allocate 4GB
+			want:    "",
+			wantErr: true,
+		},
+		{
+			name:    "long string",
+			input:   append(append([]byte{0, 2, 0, 1}, bytes.Repeat([]byte{'x'}, 128<<10)...), 0),
+			want:    strings.Repeat("x", 128<<10),
+			wantErr: false,
+		},
 		{
 			name:        "invalid null terminator",
 			input:       []byte{0, 0, 0, 2, 'a', 'b'}, // length=2 but wrong null terminator
@@ -204,6 +223,44 @@ func TestEncodeKeyValue(t *testing.T) {
 	}
 }
 
+func TestEncodeKeyValueInvalidKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr error
+	}{
+		{"null byte in key", "bad\x00key", "value", ErrInvalidFieldName},
+		{"newline in key", "bad\nkey", "value", ErrInvalidFieldName},
+		{"invalid utf-8 in key", "bad\xffkey", "value", ErrInvalidFieldName},
+		{"unicode key", "ключ_名前", "value", nil},
+		{"null byte in value", "key", "value\x00", nil},
+		{"invalid utf-8 in value", "key", "\xff\xfe", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := EncodeKeyValue(&buf, tt.key, tt.value)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EncodeKeyValue() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && buf.Len() != 0 {
+				t.Errorf("EncodeKeyValue() wrote %d bytes on error, want 0", buf.Len())
+			}
+
+			// messages with invalid field names are rejected before anything is written
+			buf.Reset()
+			err = EncodeMessage(&buf, &Message{Fields: map[string]string{tt.key: tt.value}, Raw: "event"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EncodeMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && buf.Len() != 0 {
+				t.Errorf("EncodeMessage() wrote %d bytes on error, want 0", buf.Len())
+			}
+		})
+	}
+}
+
 func TestDecodeKeyValue(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -268,7 +325,7 @@ func TestDecodeKeyValue(t *testing.T) {
 				if err == nil {
 					t.Error("DecodeKeyValue() error = nil, wantErr true")
 				}
-				if tt.errContains != "" && tt.errContains != err.Error() {
+				if tt.errContains != "" && !strings.Contains(err.Error(), tt.errContains) {
 					t.Errorf("DecodeKeyValue() error = %v, want %v", err, tt.errContains)
 				}
 				return
@@ -370,6 +427,25 @@ func TestEncodeMessage(t *testing.T) {
 				return nil
 			},
 		},
+		{
+			name: "message with times",
+			message: &Message{
+				Index:     "main",
+				Raw:       "backfilled message",
+				Time:      time.Unix(1700000000, 0),
+				IndexTime: time.Unix(1700000100, 0),
+			},
+			wantErr: false,
+			validate: func(data []byte) error {
+				if !bytes.Contains(data, []byte("1700000000")) {
+					return errors.New("missing _time value")
+				}
+				if !bytes.Contains(data, []byte("_indextime")) {
+					return errors.New("missing _indextime")
+				}
+				return nil
+			},
+		},
 		{
 			name:    "nil message",
 			message: nil,
@@ -412,7 +488,7 @@ func TestEncodeMessage(t *testing.T) {
 			}
 
 			// Verify message size
-			size, _ := getHeaderValues(tt.message)
+			size, _ := getHeaderValues(tt.message, len(tt.message.Raw))
 			if size+4 != uint32(len(data)) {
 				t.Errorf("EncodeMessage() header message size = %v, want %v", size, len(data))
 			}
@@ -427,6 +503,35 @@ func TestEncodeMessage(t *testing.T) {
 	}
 }
 
+func TestEncodeMessageReservedField(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		wantErr error
+	}{
+		{"nil fields", nil, nil},
+		{"_raw", map[string]string{"_raw": "other event"}, ErrReservedField},
+		{"_done", map[string]string{"_done": "_done"}, ErrReservedField},
+		{"_time", map[string]string{"_time": "1700000000"}, ErrReservedField},
+		{"index metadata", map[string]string{"_MetaData:Index": "main"}, ErrReservedField},
+		{"_compressed", map[string]string{compressedRawKey: "yes"}, ErrReservedField},
+		{"_compressed by CompressRaw", map[string]string{compressedRawKey: gzipEncoding}, nil},
+		{"similar name", map[string]string{"raw": "ok", "_raw_len": "2"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := EncodeMessage(&buf, &Message{Raw: "event", Fields: tt.fields})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EncodeMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil && buf.Len() != 0 {
+				t.Errorf("EncodeMessage() wrote %d bytes on error", buf.Len())
+			}
+		})
+	}
+}
+
 // TestEncodeMessageRoundTrip tests that a message can be encoded and then decoded correctly
 func TestEncodeMessageRoundTrip(t *testing.T) {
 	original := &Message{
@@ -435,6 +540,8 @@ func TestEncodeMessageRoundTrip(t *testing.T) {
 		Source:     "testsource",
 		SourceType: "test:sourcetype",
 		Raw:        "test message data",
+		Time:       time.Unix(1700000000, 0),
+		IndexTime:  time.Unix(1700000100, 0),
 		Fields: map[string]string{
 			"field1": "value1",
 			"field2": "value2",
@@ -470,6 +577,12 @@ func TestEncodeMessageRoundTrip(t *testing.T) {
 	if decoded.Raw != original.Raw {
 		t.Errorf("Raw = %v, want %v", decoded.Raw, original.Raw)
 	}
+	if !decoded.Time.Equal(original.Time) {
+		t.Errorf("Time = %v, want %v", decoded.Time, original.Time)
+	}
+	if !decoded.IndexTime.Equal(original.IndexTime) {
+		t.Errorf("IndexTime = %v, want %v", decoded.IndexTime, original.IndexTime)
+	}
 
 	// Compare fields
 	if len(decoded.Fields) != len(original.Fields) {
@@ -481,3 +594,590 @@ func TestEncodeMessageRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+// TestCompressedMessageRoundTrip tests that a compressed message can be decoded correctly
+func TestCompressedMessageRoundTrip(t *testing.T) {
+	original := &Message{
+		Index:      "main",
+		Host:       "testhost",
+		Source:     "testsource",
+		SourceType: "test:sourcetype",
+		Raw:        strings.Repeat("compressible test message data ", 100),
+		Fields: map[string]string{
+			"field1": "value1",
+		},
+	}
+
+	// Encode two messages to the same compressed stream
+	var buf bytes.Buffer
+	cw := NewCompressedWriter(&buf)
+	for i := 0; i < 2; i++ {
+		if err := EncodeCompressedMessage(cw, original); err != nil {
+			t.Fatalf("EncodeCompressedMessage() error = %v", err)
+		}
+	}
+	if buf.Len() >= len(original.Raw) {
+		t.Errorf("compressed length = %v, want less than %v", buf.Len(), len(original.Raw))
+	}
+
+	// Decode both messages
+	zr, err := NewCompressedReader(&buf)
+	if err != nil {
+		t.Fatalf("NewCompressedReader() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		decoded := &Message{}
+		if err := decoded.Read(zr); err != nil {
+			t.Fatalf("Read() error = %v", err)
+		}
+		if decoded.String() != original.String() {
+			t.Errorf("decoded = %v, want %v", decoded, original)
+		}
+	}
+}
+
+func TestCompressRawRoundTrip(t *testing.T) {
+	original := &Message{
+		Index:  "main",
+		Raw:    strings.Repeat("large compressible event payload\n", 4096),
+		Fields: map[string]string{"field1": "value1"},
+	}
+	compressed, err := CompressRaw(original)
+	if err != nil {
+		t.Fatalf("CompressRaw() error = %v", err)
+	}
+	if compressed.Fields[compressedRawKey] != gzipEncoding || len(compressed.Raw) >= len(original.Raw)/10 {
+		t.Errorf("CompressRaw() = %d bytes with %s=%q, want gzip compressed", len(compressed.Raw),
+			compressedRawKey, compressed.Fields[compressedRawKey])
+	}
+	if _, ok := original.Fields[compressedRawKey]; ok {
+		t.Error("CompressRaw() modified the original message")
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeMessage(&buf, compressed); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+	decoded := &Message{}
+	if err := decoded.Read(&buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	if err := DecompressRaw(decoded); err != nil {
+		t.Fatalf("DecompressRaw() error = %v", err)
+	}
+	if !decoded.Equal(original) {
+		t.Errorf("decoded = %v, want %v", decoded, original)
+	}
+}
+
+func TestDecompressRawInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Message
+		want error
+	}{
+		{"not compressed", &Message{Raw: "plain"}, nil},
+		{"unknown encoding", &Message{Raw: "data", Fields: map[string]string{compressedRawKey: "zstd"}}, ErrUnknownRawEncoding},
+		{"corrupt", &Message{Raw: "not gzip", Fields: map[string]string{compressedRawKey: gzipEncoding}}, ErrInvalidData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := DecompressRaw(tt.m); !errors.Is(err, tt.want) {
+				t.Errorf("DecompressRaw() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountFrames(t *testing.T) {
+	var one, two bytes.Buffer
+	m := &Message{Index: "main", Host: "h", Fields: map[string]string{"a": "b"}, Raw: "event"}
+	EncodeMessage(&one, m)
+	EncodeMessage(&two, m)
+	EncodeMessage(&two, &Message{Raw: "second"})
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    int
+		wantErr bool
+	}{
+		{"single", one.Bytes(), 1, false},
+		{"multiple", two.Bytes(), 2, false},
+		{"empty", nil, 0, true},
+		{"truncated", one.Bytes()[:one.Len()-1], 0, true},
+		{"trailing bytes", append(append([]byte{}, one.Bytes()...), 0, 0), 0, true},
+		{"short header", []byte{0, 0, 0, 4}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := countFrames(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("countFrames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("countFrames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageBoundedBySize(t *testing.T) {
+	first := &Message{Index: "main", Fields: map[string]string{"a": "b"}, Raw: "first"}
+	second := &Message{Index: "main", Raw: "second"}
+
+	tests := []struct {
+		name    string
+		corrupt func(b []byte)
+	}{
+		// maps is the second uint32 of the header
+		{"maps count too high", func(b []byte) { b[7] += 10 }},
+		{"maps count too low", func(b []byte) { b[7] -= 2 }},
+		{"bad null terminator", func(b []byte) { b[len(b)-1] = 'x' }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeMessage(&buf, first); err != nil {
+				t.Fatalf("EncodeMessage() error = %v", err)
+			}
+			tt.corrupt(buf.Bytes())
+			if err := EncodeMessage(&buf, second); err != nil {
+				t.Fatalf("EncodeMessage() error = %v", err)
+			}
+
+			m := &Message{}
+			if err := DecodeMessage(&buf, m); !errors.Is(err, ErrInvalidData) {
+				t.Fatalf("DecodeMessage() error = %v, want %v", err, ErrInvalidData)
+			}
+			m = &Message{}
+			if err := DecodeMessage(&buf, m); err != nil {
+				t.Fatalf("DecodeMessage() of next message error = %v", err)
+			}
+			if m.Raw != second.Raw {
+				t.Errorf("DecodeMessage() Raw = %q, want %q", m.Raw, second.Raw)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeMessage(&buf, &Message{Raw: "event"}); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+	for _, n := range []int{4, 8, buf.Len() - 1} {
+		err := DecodeMessage(bytes.NewReader(buf.Bytes()[:n]), &Message{})
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("DecodeMessage() of %d bytes error = %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+}
+
+func TestDecodeMessageLimits(t *testing.T) {
+	header := func(size, maps uint32) []byte {
+		b := binary.BigEndian.AppendUint32(nil, size)
+		return binary.BigEndian.AppendUint32(b, maps)
+	}
+	// a key claiming a 1GB length inside a small message
+	hugeString := append(header(64, 1), binary.BigEndian.AppendUint32(nil, 1<<30)...)
+
+	tests := []struct {
+		name   string
+		data   []byte
+		limits DecodeLimits
+	}{
+		{"huge maps count", header(1<<20, 1<<31), DecodeLimits{}},
+		{"maps count exceeds body", header(64, 100), DecodeLimits{}},
+		{"maps count exceeds limit", header(1<<20, 10), DecodeLimits{MaxFields: 5}},
+		{"size exceeds default", header(1<<31, 1), DecodeLimits{}},
+		{"size exceeds limit", header(1024, 1), DecodeLimits{MaxMessageSize: 512}},
+		{"string exceeds message", hugeString, DecodeLimits{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the body is truncated, so any attempt to read it fails
+			err := DecodeMessageWithLimits(bytes.NewReader(tt.data), &Message{}, tt.limits)
+			if !errors.Is(err, ErrInvalidData) {
+				t.Errorf("DecodeMessageWithLimits() error = %v, want %v", err, ErrInvalidData)
+			}
+		})
+	}
+}
+
+func TestDecodeMessageSkipOversized(t *testing.T) {
+	var buf bytes.Buffer
+	large := &Message{Raw: strings.Repeat("x", 2048)}
+	small := &Message{Index: "main", Raw: "small event"}
+	for _, m := range []*Message{large, small} {
+		if err := EncodeMessage(&buf, m); err != nil {
+			t.Fatalf("EncodeMessage() error = %v", err)
+		}
+	}
+
+	limits := DecodeLimits{MaxMessageSize: 1024, SkipOversized: true}
+	m := &Message{}
+	if err := DecodeMessageWithLimits(&buf, m, limits); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("DecodeMessageWithLimits() error = %v, want %v", err, ErrMessageTooLarge)
+	}
+	if err := DecodeMessageWithLimits(&buf, m, limits); err != nil {
+		t.Fatalf("DecodeMessageWithLimits() after skipping error = %v", err)
+	}
+	if !m.Equal(small) {
+		t.Errorf("decoded %v, want %v", m, small)
+	}
+
+	// a truncated oversized message cannot be skipped
+	truncated := binary.BigEndian.AppendUint32(nil, 2048)
+	err := DecodeMessageWithLimits(bytes.NewReader(truncated), m, limits)
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("DecodeMessageWithLimits() truncated error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDecodeMessageWithinLimits(t *testing.T) {
+	var buf bytes.Buffer
+	in := &Message{Index: "main", Fields: map[string]string{"a": "b"}, Raw: "event"}
+	if err := EncodeMessage(&buf, in); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+	limits := DecodeLimits{MaxFields: 4, MaxMessageSize: buf.Len()}
+	m := &Message{}
+	if err := DecodeMessageWithLimits(&buf, m, limits); err != nil {
+		t.Fatalf("DecodeMessageWithLimits() error = %v", err)
+	}
+	if m.Raw != in.Raw {
+		t.Errorf("DecodeMessageWithLimits() Raw = %q, want %q", m.Raw, in.Raw)
+	}
+}
+
+func TestDecodeErrorOffset(t *testing.T) {
+	var buf bytes.Buffer
+	if err := EncodeMessage(&buf, &Message{Index: "main", Raw: "event"}); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+	n := buf.Len()
+
+	// a message ends with 4 bytes of padding and the "_raw" trailer string
+	tests := []struct {
+		name    string
+		corrupt func(b []byte)
+		want    string
+	}{
+		{"null terminator", func(b []byte) { b[n-1] = 'b' }, fmt.Sprintf("invalid null terminator 0x62 at offset %d", n-1)},
+		{"padding", func(b []byte) { b[n-13] = 1 }, fmt.Sprintf("invalid padding 0x01000000 at offset %d", n-13)},
+		{"trailer", func(b []byte) { b[n-2] = 'x' }, fmt.Sprintf(`invalid trailer "_rax" at offset %d`, n-9)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := bytes.Clone(buf.Bytes())
+			tt.corrupt(b)
+			err := DecodeMessage(bytes.NewReader(b), &Message{})
+			if !errors.Is(err, ErrInvalidData) {
+				t.Fatalf("DecodeMessage() error = %v, want %v", err, ErrInvalidData)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("DecodeMessage() error = %q, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+
+	t.Run("string", func(t *testing.T) {
+		_, err := DecodeString(bytes.NewReader([]byte{0, 0, 0, 3, 'a', 'b', 'c'}))
+		if !errors.Is(err, ErrInvalidData) {
+			t.Fatalf("DecodeString() error = %v, want %v", err, ErrInvalidData)
+		}
+		if want := "invalid null terminator 0x63 at offset 6"; !strings.Contains(err.Error(), want) {
+			t.Errorf("DecodeString() error = %q, want it to contain %q", err, want)
+		}
+	})
+}
+
+func TestUnmarshalMessage(t *testing.T) {
+	first := &Message{Index: "main", Fields: map[string]string{"a": "b"}, Raw: "first"}
+	second := &Message{Host: "host1", Raw: "second message"}
+	var buf bytes.Buffer
+	var sizes []int
+	for _, m := range []*Message{first, second} {
+		before := buf.Len()
+		if err := EncodeMessage(&buf, m); err != nil {
+			t.Fatalf("EncodeMessage() error = %v", err)
+		}
+		sizes = append(sizes, buf.Len()-before)
+	}
+
+	b := buf.Bytes()
+	m := &Message{}
+	for i, want := range []*Message{first, second} {
+		n, err := UnmarshalMessage(b, m)
+		if err != nil {
+			t.Fatalf("UnmarshalMessage() error = %v", err)
+		}
+		if n != sizes[i] {
+			t.Errorf("UnmarshalMessage() consumed %d bytes, want %d", n, sizes[i])
+		}
+		if !m.Equal(want) {
+			t.Errorf("UnmarshalMessage() = %v, want %v", m, want)
+		}
+		b = b[n:]
+	}
+	if n, err := UnmarshalMessage(b, m); n != 0 || err != io.EOF {
+		t.Errorf("UnmarshalMessage() of empty buffer = %d, %v, want 0, %v", n, err, io.EOF)
+	}
+
+	truncated := buf.Bytes()[:sizes[0]-1]
+	if _, err := UnmarshalMessage(truncated, m); err != io.ErrUnexpectedEOF {
+		t.Errorf("UnmarshalMessage() of truncated buffer error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestMarshalMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		m       *Message
+		wantErr error
+	}{
+		{"raw only", &Message{Raw: "event"}, nil},
+		{"full message", &Message{Index: "main", Host: "host1", Source: "src", SourceType: "st",
+			Time: time.Unix(1700000000, 0), Fields: map[string]string{"a": "b", "c": "d"}, Raw: "event"}, nil},
+		{"nil message", nil, ErrNilMessage},
+		{"invalid field name", &Message{Fields: map[string]string{"bad\x00key": "v"}, Raw: "event"}, ErrInvalidFieldName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := MarshalMessage(tt.m)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("MarshalMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// fields are encoded in map order, so compare the decoded message
+			decoded := &Message{}
+			if n, err := UnmarshalMessage(got, decoded); err != nil || n != len(got) {
+				t.Fatalf("UnmarshalMessage() = %d, %v, want %d, nil", n, err, len(got))
+			}
+			if !decoded.Equal(tt.m) {
+				t.Errorf("MarshalMessage() decoded = %v, want %v", decoded, tt.m)
+			}
+		})
+	}
+
+	// the returned bytes must not be reused by later calls
+	first, _ := MarshalMessage(&Message{Raw: "first"})
+	want := bytes.Clone(first)
+	MarshalMessage(&Message{Raw: "second"})
+	if !bytes.Equal(first, want) {
+		t.Error("MarshalMessage() result was modified by a later call")
+	}
+}
+
+func TestEncodeMessageReader(t *testing.T) {
+	m := &Message{Index: "main", Source: "big.bin", Fields: map[string]string{"a": "b"}}
+
+	t.Run("matches EncodeMessage", func(t *testing.T) {
+		withRaw := *m
+		withRaw.Raw = "small event"
+		var want, got bytes.Buffer
+		if err := EncodeMessage(&want, &withRaw); err != nil {
+			t.Fatalf("EncodeMessage() error = %v", err)
+		}
+		if err := EncodeMessageReader(&got, m, strings.NewReader(withRaw.Raw), len(withRaw.Raw)); err != nil {
+			t.Fatalf("EncodeMessageReader() error = %v", err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("EncodeMessageReader() = %v, want %v", got.Bytes(), want.Bytes())
+		}
+	})
+
+	t.Run("large payload", func(t *testing.T) {
+		pattern := []byte("0123456789abcdef\n")
+		const rawLen = 8 << 20
+		var buf bytes.Buffer
+		if err := EncodeMessageReader(&buf, m, &repeatReader{data: pattern}, rawLen); err != nil {
+			t.Fatalf("EncodeMessageReader() error = %v", err)
+		}
+		out := &Message{}
+		if err := DecodeMessage(&buf, out); err != nil {
+			t.Fatalf("DecodeMessage() error = %v", err)
+		}
+		if len(out.Raw) != rawLen {
+			t.Fatalf("DecodeMessage() Raw length = %d, want %d", len(out.Raw), rawLen)
+		}
+		want := bytes.Repeat(pattern, rawLen/len(pattern)+1)[:rawLen]
+		if out.Raw != string(want) {
+			t.Error("DecodeMessage() Raw does not match the streamed payload")
+		}
+		if out.Index != m.Index || out.Source != m.Source || out.Fields["a"] != "b" {
+			t.Errorf("DecodeMessage() metadata = %v, want %v", out, m)
+		}
+	})
+
+	t.Run("short reader", func(t *testing.T) {
+		err := EncodeMessageReader(io.Discard, m, strings.NewReader("short"), 100)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("EncodeMessageReader() error = %v, want %v", err, io.ErrUnexpectedEOF)
+		}
+	})
+
+	t.Run("negative length", func(t *testing.T) {
+		err := EncodeMessageReader(io.Discard, m, strings.NewReader(""), -1)
+		if !errors.Is(err, ErrInvalidData) {
+			t.Errorf("EncodeMessageReader() error = %v, want %v", err, ErrInvalidData)
+		}
+	})
+}
+
+func FuzzDecodeString(f *testing.F) {
+	for _, s := range []string{"", "hello", "_raw", "Hello 世界 🌍", strings.Repeat("x", 1000)} {
+		var buf bytes.Buffer
+		if err := EncodeString(&buf, s); err != nil {
+			f.Fatalf("EncodeString() error = %v", err)
+		}
+		f.Add(buf.Bytes())
+	}
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 'a'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bytes.NewReader(data)
+		s, err := DecodeString(r)
+		if err != nil {
+			return
+		}
+		// a decoded string must be re-encoded as the bytes it was read from
+		var buf bytes.Buffer
+		if err := EncodeString(&buf, s); err != nil {
+			t.Fatalf("EncodeString() error = %v", err)
+		}
+		if consumed := data[:len(data)-r.Len()]; !bytes.Equal(buf.Bytes(), consumed) {
+			t.Errorf("EncodeString(DecodeString()) = %v, want %v", buf.Bytes(), consumed)
+		}
+	})
+}
+
+func FuzzDecodeMessage(f *testing.F) {
+	for _, m := range []*Message{
+		{Raw: "event"},
+		{Index: "main", Host: "host1", Source: "src", SourceType: "st", Raw: "event",
+			Time: time.Unix(1700000000, 0), IndexTime: time.Unix(1700000001, 0)},
+		{Fields: map[string]string{capabilitiesKey: "ack=1;compression=0"}},
+		{Raw: "event", Fields: map[string]string{"a": "b", "c": ""}},
+	} {
+		b, err := MarshalMessage(m)
+		if err != nil {
+			f.Fatalf("MarshalMessage() error = %v", err)
+		}
+		f.Add(b)
+		f.Add(b[:len(b)/2])
+	}
+	f.Add([]byte{0, 0, 0, 8, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+
+	// small limits bound the memory used by hostile sizes and counts
+	limits := DecodeLimits{MaxFields: 64, MaxMessageSize: 1 << 16}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m := &Message{}
+		if err := DecodeMessageWithLimits(bytes.NewReader(data), m, limits); err != nil {
+			return
+		}
+		// a decoded message must survive a round trip
+		b, err := MarshalMessage(m)
+		if errors.Is(err, ErrInvalidFieldName) {
+			return
+		}
+		if err != nil {
+			t.Fatalf("MarshalMessage() error = %v", err)
+		}
+		got := &Message{}
+		if _, err := UnmarshalMessage(b, got); err != nil {
+			t.Fatalf("UnmarshalMessage() error = %v", err)
+		}
+		if !got.Equal(m) {
+			t.Errorf("round trip = %v, want %v", got, m)
+		}
+	})
+}
+
+// benchmarkSizes are the raw payload sizes and field counts of benchmarked messages
+var benchmarkSizes = []struct {
+	name    string
+	rawSize int
+	fields  int
+}{
+	{"small", 100, 0},
+	{"small_10_fields", 100, 10},
+	{"small_100_fields", 100, 100},
+	{"large", 64 << 10, 0},
+	{"large_10_fields", 64 << 10, 10},
+}
+
+// newBenchmarkMessage returns a message with a raw payload of rawSize bytes
+// and the given number of fields
+func newBenchmarkMessage(rawSize, fields int) *Message {
+	m := &Message{
+		Index:      "main",
+		Host:       "web-01",
+		Source:     "/var/log/app.log",
+		SourceType: "app",
+		Time:       time.Unix(1700000000, 0),
+		Raw:        strings.Repeat("x", rawSize),
+		Fields:     make(map[string]string, fields),
+	}
+	for i := 0; i < fields; i++ {
+		m.Fields[fmt.Sprintf("field%03d", i)] = fmt.Sprintf("value%d", i)
+	}
+	return m
+}
+
+func BenchmarkEncodeMessage(b *testing.B) {
+	for _, bc := range benchmarkSizes {
+		b.Run(bc.name, func(b *testing.B) {
+			m := newBenchmarkMessage(bc.rawSize, bc.fields)
+			size, _ := getHeaderValues(m, len(m.Raw))
+			b.SetBytes(int64(size) + 4)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := EncodeMessage(io.Discard, m); err != nil {
+					b.Fatalf("EncodeMessage() error = %v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkEncodeFields compares encoding fields from a map, which must be
+// sorted on every call for deterministic output, with encoding fields that
+// are already in order
+func BenchmarkEncodeFields(b *testing.B) {
+	fields := newBenchmarkMessage(0, 20).Fields
+	ordered := make([][2]string, 0, len(fields))
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		ordered = append(ordered, [2]string{k, fields[k]})
+	}
+
+	b.Run("map", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			keys := make([]string, 0, len(fields))
+			for k := range fields {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if err := EncodeKeyValue(io.Discard, k, fields[k]); err != nil {
+					b.Fatalf("EncodeKeyValue() error = %v", err)
+				}
+			}
+		}
+	})
+	b.Run("ordered", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, kv := range ordered {
+				if err := EncodeKeyValue(io.Discard, kv[0], kv[1]); err != nil {
+					b.Fatalf("EncodeKeyValue() error = %v", err)
+				}
+			}
+		}
+	})
+}
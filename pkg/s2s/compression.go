@@ -0,0 +1,143 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// When both sides advertise "compression=1" in the v3 capabilities exchange,
+// all data following the capabilities response is sent as a zlib stream in
+// each direction. The stream is flushed after every message so that the peer
+// can decode it without waiting for more data.
+
+// CompressedWriter zlib compresses data written to an underlying writer
+type CompressedWriter struct {
+	zw *zlib.Writer
+}
+
+// NewCompressedWriter returns a CompressedWriter that writes to w
+func NewCompressedWriter(w io.Writer) *CompressedWriter {
+	return &CompressedWriter{zw: zlib.NewWriter(w)}
+}
+
+// Write compresses p into the underlying writer
+func (cw *CompressedWriter) Write(p []byte) (int, error) {
+	return cw.zw.Write(p)
+}
+
+// Flush writes any pending compressed data to the underlying writer
+func (cw *CompressedWriter) Flush() error {
+	return cw.zw.Flush()
+}
+
+// Close flushes pending data and writes the zlib stream trailer
+func (cw *CompressedWriter) Close() error {
+	return cw.zw.Close()
+}
+
+// NewCompressedReader returns a reader that decompresses a zlib stream from r
+func NewCompressedReader(r io.Reader) (io.ReadCloser, error) {
+	return zlib.NewReader(r)
+}
+
+// EncodeCompressedMessage writes a message to a CompressedWriter and flushes it
+func EncodeCompressedMessage(cw *CompressedWriter, m *Message) error {
+	if err := EncodeMessage(cw, m); err != nil {
+		return err
+	}
+	return cw.Flush()
+}
+
+// Independently of the protocol, a large _raw value can be gzip compressed by
+// the sender and marked with a _compressed field, which a Server recognizes
+// and decompresses before the message is handled, delivering it unchanged if
+// it cannot be decompressed. Other receivers, such as Splunk indexers, see the
+// compressed bytes, so this should only be used when the receiver is a Server.
+// The field is reserved, so it cannot be set with any other value.
+
+// compressedRawKey is the field marking a message whose _raw is compressed
+const compressedRawKey = "_compressed"
+
+// gzipEncoding is the value of compressedRawKey for gzip compressed _raw
+const gzipEncoding = "gzip"
+
+// ErrUnknownRawEncoding is returned for a _compressed field that is not gzip
+var ErrUnknownRawEncoding = errors.New("unknown _raw compression")
+
+// CompressRaw returns a copy of the message with Raw gzip compressed and the
+// _compressed field set. Messages that already have the field are returned
+// unchanged.
+func CompressRaw(m *Message) (*Message, error) {
+	if _, ok := m.Fields[compressedRawKey]; ok {
+		return m, nil
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := io.WriteString(zw, m.Raw); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	c := withField(m, compressedRawKey, gzipEncoding)
+	c.Raw = buf.String()
+	return c, nil
+}
+
+// DecompressRaw replaces a Raw compressed by CompressRaw with its contents
+// and removes the _compressed field. Messages without the field are not
+// changed. Contents larger than DefaultMaxMessageSize return ErrInvalidData.
+func DecompressRaw(m *Message) error {
+	return decompressRaw(m, DefaultMaxMessageSize)
+}
+
+// decompressRaw decompresses Raw like DecompressRaw, limiting its contents
+// to maxSize bytes
+func decompressRaw(m *Message, maxSize int) error {
+	encoding, ok := m.Fields[compressedRawKey]
+	if !ok {
+		return nil
+	}
+	if encoding != gzipEncoding {
+		return fmt.Errorf("%w: %q", ErrUnknownRawEncoding, encoding)
+	}
+
+	zr, err := gzip.NewReader(strings.NewReader(m.Raw))
+	if err != nil {
+		return fmt.Errorf("%w: compressed _raw: %v", ErrInvalidData, err)
+	}
+	defer zr.Close()
+	var sb strings.Builder
+	n, err := io.Copy(&sb, io.LimitReader(zr, int64(maxSize)+1))
+	if err != nil {
+		return fmt.Errorf("%w: compressed _raw: %v", ErrInvalidData, err)
+	}
+	if n > int64(maxSize) {
+		return fmt.Errorf("%w: compressed _raw exceeds %d bytes", ErrInvalidData, maxSize)
+	}
+	m.Raw = sb.String()
+	delete(m.Fields, compressedRawKey)
+	return nil
+}
@@ -18,171 +18,1263 @@
 package s2s
 
 import (
+	"cmp"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
+	"maps"
 	"net"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 const (
 	ConnectionTimeout = 10 * time.Second
+
+	// DefaultHandshakeTimeout is how long to wait for a v3 server's
+	// capabilities before falling back to v2, if Conn.HandshakeTimeout is not set
+	DefaultHandshakeTimeout = 2 * time.Second
+
+	// UnixPrefix is the endpoint prefix used for Unix domain sockets
+	UnixPrefix = "unix://"
+
+	// TCPPrefix is an optional endpoint prefix for TCP connections
+	TCPPrefix = "tcp://"
+
+	// DefaultMinTLSVersion is the minimum TLS version used by clients and servers
+	DefaultMinTLSVersion = tls.VersionTLS12
+
+	// DefaultRetryDelay is the default delay before a send is first retried
+	DefaultRetryDelay = 100 * time.Millisecond
 )
 
 var (
 	ErrInvalidEndpoint = errors.New("invalid endpoint format")
 	ErrTLSCertificate  = errors.New("invalid client certificate")
+	ErrPingUnsupported = errors.New("ping requires the s2s v3 protocol")
+	ErrInvalidVersion  = errors.New("protocol version must be 2 or 3")
+	ErrCertRequired    = errors.New("server requested a client certificate")
+	ErrCannotRedial    = errors.New("connection cannot be redialed")
+	ErrNotRegularFile  = errors.New("not a regular file")
+	ErrNoCapabilities  = errors.New("server did not respond to the v3 capabilities request")
 )
 
-// Conn is a splunk-to-splunk connection
+// Conn is a splunk-to-splunk connection. It is safe to send messages from
+// multiple goroutines: the handshake is performed once and each message is
+// written whole, so messages are never interleaved on the wire. Exported
+// fields should be set before the first message is sent.
 type Conn struct {
-	Endpoint     string
-	Encrypted    bool
-	Version      int
-	conn         net.Conn
-	didHandshake bool
+	// Endpoint is the address the connection was dialed to
+	Endpoint string
+
+	// Encrypted is true if the connection uses TLS
+	Encrypted bool
+
+	// Version is the protocol version, which is 3 unless the server only speaks v2
+	Version int
+
+	// ServerName and ManagementPort identify the client in the handshake; they
+	// default to the local Hostname and the port of Endpoint
+	ServerName     string
+	ManagementPort string
+
+	// UseAck requests acknowledgements from the indexer, which are delivered
+	// on the Acks channel
+	UseAck bool
+
+	// Compressed requests zlib compression, which is only used if the server
+	// agrees to it
+	Compressed bool
+
+	// Capabilities are the capabilities negotiated with the server
+	Capabilities Capabilities
+
+	// CollisionPolicy determines how Fields that duplicate metadata are handled
+	CollisionPolicy CollisionPolicy
+
+	// UseSequence adds a per-connection sequence number to every message
+	UseSequence bool
+
+	// AutoTimestamp is shorthand for a TimeMode of TimeAlways
+	AutoTimestamp bool
+
+	// TimeMode determines whether messages are sent with a Time
+	TimeMode TimeMode
+
+	// RequireIndex fails messages without an Index with ErrMissingIndex
+	// instead of sending them to the indexer's default index
+	RequireIndex bool
+
+	// UseMeta sends Fields as indexed fields packed into _meta, as universal
+	// forwarders do
+	UseMeta bool
+
+	// DefaultIndex, DefaultHost, DefaultSource, DefaultSourceType and
+	// DefaultFields are used for any metadata or fields a message does not set
+	DefaultIndex      string
+	DefaultHost       string
+	DefaultSource     string
+	DefaultSourceType string
+	DefaultFields     map[string]string
+
+	// UseHostname sends messages without a Host or DefaultHost with the local
+	// Hostname, as universal forwarders do
+	UseHostname bool
+
+	// RateLimiter, if set, makes sending wait for it or fail with ErrRateLimited
+	RateLimiter *RateLimiter
+
+	// MaxRetries is how many times a message sent without UseAck that fails
+	// with a transient error, such as a connection reset, is retried on a
+	// freshly dialed connection. Retried messages may be received twice.
+	MaxRetries int
+
+	// RetryDelay is the wait before the first retry, which doubles after each one
+	RetryDelay time.Duration
+
+	// HandshakeTimeout is how long to wait for a v3 server's capabilities,
+	// defaulting to DefaultHandshakeTimeout. A v2 server never responds, so if it
+	// expires the Endpoint is redialed with a v2 signature.
+	HandshakeTimeout time.Duration
+
+	// WriteTimeout, if set, is how long the handshake and each message have to
+	// be written before sending fails with an error wrapping
+	// os.ErrDeadlineExceeded. The connection should then be closed, since part
+	// of the message may have been written.
+	WriteTimeout time.Duration
+
+	// CompressRawOver, if set, gzip compresses a Raw longer than it with
+	// CompressRaw, which a Server decompresses even without negotiating compression
+	CompressRawOver int
+
+	// ObeyThrottle reads control messages from a v3 indexer while sending, so
+	// that a "throttle=<ms>" message pauses sending for that many milliseconds,
+	// at most a minute, or resumes it if it is 0
+	ObeyThrottle bool
+
+	// StructuredLogger, if set, logs handshakes and reconnects
+	StructuredLogger *slog.Logger
+
+	conn           net.Conn
+	dial           func(ctx context.Context) (net.Conn, error)
+	clientCert     bool
+	serverCaps     map[string]string
+	writer         *CompressedWriter
+	didHandshake   bool
+	lastSequence   uint64
+	acks           *ackTracker
+	ackDone        chan struct{}
+	channelMu      sync.Mutex
+	channels       map[uint64]*Channel
+	lastChannel    uint64
+	channelsClosed bool
+	writeMu        sync.Mutex
+	done           chan struct{}
+	closeOnce      sync.Once
+	throttleUntil  atomic.Int64
+	stats          connCounters
 }
 
+// DialFunc dials a network connection, with the same signature as net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
 // Connect establishes a new splunk-to-splunk connection
 func Connect(endpoint string) (*Conn, error) {
-	if !strings.Contains(endpoint, ":") {
-		return nil, ErrInvalidEndpoint
+	return ConnectWithDialer(endpoint, nil)
+}
+
+// ConnectVersion establishes a new splunk-to-splunk connection that uses the
+// given protocol version, which must be 2 or 3. Version 2 skips the
+// capabilities exchange and sends only the signature before events.
+func ConnectVersion(endpoint string, version int) (*Conn, error) {
+	if version != 2 && version != 3 {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidVersion, version)
+	}
+	c, err := ConnectWithDialer(endpoint, nil)
+	if err != nil {
+		return nil, err
 	}
+	c.Version = version
+	return c, nil
+}
 
-	c := &Conn{
-		Endpoint:     endpoint,
-		Encrypted:    false,
-		Version:      3,
-		didHandshake: false,
+// ConnectWithDialer establishes a new splunk-to-splunk connection using dial,
+// which allows the source address, resolver or transport to be customized.
+// If dial is nil, a net.Dialer with ConnectionTimeout is used.
+func ConnectWithDialer(endpoint string, dial DialFunc) (*Conn, error) {
+	network, address, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
 	}
-	var err error
-	c.conn, err = net.DialTimeout("tcp", endpoint, ConnectionTimeout)
+
+	dialConn := func(ctx context.Context) (net.Conn, error) {
+		return dialer(dial)(ctx, network, address)
+	}
+	conn, err := dialTimeout(dialConn)
 	if err != nil {
 		return nil, err
 	}
 
+	c := newConn(endpoint, conn, false)
+	c.dial = dialConn
 	return c, nil
 }
 
+// TLSOptions configures a TLS splunk-to-splunk connection. Certificates and
+// keys are PEM encoded. ClientCert and ClientKey are used for mutual TLS.
+// MinVersion defaults to DefaultMinTLSVersion, and CipherSuites defaults to
+// the crypto/tls defaults. DialContext is used to establish the underlying
+// network connection, as with ConnectWithDialer. SessionCache stores TLS
+// sessions so that reconnecting resumes a session instead of performing a
+// full handshake; it defaults to a cache shared by all connections. If a v3
+// server requests a client certificate and none is configured, the handshake
+// fails with ErrCertRequired. Unencrypted connections ignore the request.
+type TLSOptions struct {
+	CACert             string
+	ServerName         string
+	InsecureSkipVerify bool
+	ClientCert         string
+	ClientKey          string
+	MinVersion         uint16
+	CipherSuites       []uint16
+	DialContext        DialFunc
+	SessionCache       tls.ClientSessionCache
+}
+
+// defaultSessionCache is the TLS session cache shared by connections that do
+// not set TLSOptions.SessionCache
+var defaultSessionCache = tls.NewLRUClientSessionCache(0)
+
 // ConnectTLS establishes a new splunk-to-splunk connection using TLS
 func ConnectTLS(endpoint, cert, serverName string, insecureSkipVerify bool) (*Conn, error) {
-	if !strings.Contains(endpoint, ":") {
-		return nil, ErrInvalidEndpoint
+	return ConnectTLSWithOptions(endpoint, TLSOptions{
+		CACert:             cert,
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	})
+}
+
+// ConnectTLSWithOptions establishes a new splunk-to-splunk connection using TLS
+func ConnectTLSWithOptions(endpoint string, opts TLSOptions) (*Conn, error) {
+	network, address, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
 	}
 
+	serverName := opts.ServerName
 	if serverName == "" {
 		serverName = "SplunkServerDefaultCert"
 	}
 
+	minVersion := opts.MinVersion
+	if minVersion == 0 {
+		minVersion = DefaultMinTLSVersion
+	}
+
+	sessionCache := opts.SessionCache
+	if sessionCache == nil {
+		sessionCache = defaultSessionCache
+	}
+
 	tlsConfig := &tls.Config{
 		ServerName:         serverName,
-		InsecureSkipVerify: insecureSkipVerify,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+		MinVersion:         minVersion,
+		CipherSuites:       opts.CipherSuites,
+		ClientSessionCache: sessionCache,
 	}
 
-	if len(cert) > 0 {
+	if len(opts.CACert) > 0 {
 		certPool := x509.NewCertPool()
-		if !certPool.AppendCertsFromPEM([]byte(cert)) {
+		if !certPool.AppendCertsFromPEM([]byte(opts.CACert)) {
 			return nil, ErrTLSCertificate
 		}
 		tlsConfig.RootCAs = certPool
 	}
 
-	c := &Conn{
-		Endpoint:     endpoint,
-		Encrypted:    true,
-		Version:      3,
-		didHandshake: false,
+	if len(opts.ClientCert) > 0 || len(opts.ClientKey) > 0 {
+		clientCert, err := tls.X509KeyPair([]byte(opts.ClientCert), []byte(opts.ClientKey))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrTLSCertificate, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
 	}
-	var err error
-	c.conn, err = tls.Dial("tcp", endpoint, tlsConfig)
+
+	dialConn := func(ctx context.Context) (net.Conn, error) {
+		conn, err := dialer(opts.DialContext)(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+	conn, err := dialTimeout(dialConn)
 	if err != nil {
 		return nil, err
 	}
 
+	c := newConn(endpoint, conn, true)
+	c.dial = dialConn
+	c.clientCert = len(tlsConfig.Certificates) > 0
 	return c, nil
 }
 
-// Close closes the splunk-to-splunk connection
+// dialTimeout calls dial with a context that expires after ConnectionTimeout
+func dialTimeout(dial func(ctx context.Context) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ConnectionTimeout)
+	defer cancel()
+	return dial(ctx)
+}
+
+// newConn creates a splunk-to-splunk connection using an established network connection
+func newConn(endpoint string, conn net.Conn, encrypted bool) *Conn {
+	c := &Conn{
+		Endpoint:     endpoint,
+		Encrypted:    encrypted,
+		Version:      3,
+		RetryDelay:   DefaultRetryDelay,
+		didHandshake: false,
+		acks:         newAckTracker(),
+		ackDone:      make(chan struct{}),
+		channels:     make(map[uint64]*Channel),
+		done:         make(chan struct{}),
+	}
+	c.conn = &countingConn{Conn: conn, n: &c.stats.bytesWritten}
+	return c
+}
+
+// KeepAliveDialer returns a DialFunc for ConnectWithDialer or
+// TLSOptions.DialContext that sends TCP keep-alive probes every period. A
+// negative period disables keep-alives.
+func KeepAliveDialer(period time.Duration) DialFunc {
+	d := &net.Dialer{Timeout: ConnectionTimeout, KeepAlive: period}
+	return d.DialContext
+}
+
+// dialer returns dial, or the default dialer if it is nil
+func dialer(dial DialFunc) DialFunc {
+	if dial != nil {
+		return dial
+	}
+	d := &net.Dialer{Timeout: ConnectionTimeout}
+	return d.DialContext
+}
+
+// Close gracefully closes the splunk-to-splunk connection. Pending writes are
+// flushed and, for v3 connections, a disconnect control message is sent so
+// the indexer sees a clean shutdown rather than a reset.
 func (c *Conn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		c.stop()
+		// don't wait forever for a write blocked by an unresponsive indexer
+		if deadlineErr := c.conn.SetWriteDeadline(time.Now().Add(ConnectionTimeout)); deadlineErr != nil {
+			err = deadlineErr
+			return
+		}
+		c.writeMu.Lock()
+		defer c.writeMu.Unlock()
+		if c.didHandshake && c.Version >= 3 {
+			err = c.writeLocked(&Message{
+				Fields: map[string]string{
+					controlMsgKey: disconnectValue,
+				},
+			})
+		}
+		if c.writer != nil {
+			if closeErr := c.writer.Close(); err == nil {
+				err = closeErr
+			}
+		}
+	})
+	if closeErr := c.conn.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// CloseNow closes the splunk-to-splunk connection immediately, without
+// flushing pending writes or notifying the indexer
+func (c *Conn) CloseNow() error {
+	c.closeOnce.Do(c.stop)
 	return c.conn.Close()
 }
 
-// SendMessage sends a message over the splunk-to-splunk connection
+// stop signals background goroutines that the connection is closing
+func (c *Conn) stop() {
+	if c.done != nil {
+		close(c.done)
+	}
+}
+
+// Stats returns a snapshot of the counters for the connection. BytesWritten
+// includes the handshake and heartbeats, but MessagesSent only counts messages.
+func (c *Conn) Stats() ConnStats {
+	return c.stats.snapshot()
+}
+
+// IsAlive returns true if the connection looks usable, without sending
+// anything or consuming data sent by the indexer. It returns false once the
+// connection is closed, or if the indexer has closed or reset it, which can be
+// used to evict half-open connections from a pool before sending. IsAlive
+// cannot detect an indexer that has gone away without closing the connection;
+// use KeepAlive or a dialer with TCP keep-alives for that.
+func (c *Conn) IsAlive() bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.UseAck && c.didHandshake {
+		// the acknowledgement reader stops when the connection fails
+		select {
+		case <-c.ackDone:
+			return false
+		default:
+		}
+	}
+	if err := peekConn(c.conn); err != nil {
+		c.stats.setError(err)
+		return false
+	}
+	return true
+}
+
+// ServerCapabilities returns every key and value in the control message the
+// server sent in response to the capabilities exchange, including those not
+// parsed into Capabilities. It returns nil before the handshake, or if the
+// server did not respond because it only supports the v2 protocol.
+func (c *Conn) ServerCapabilities() map[string]string {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return maps.Clone(c.serverCaps)
+}
+
+// LastError returns the most recent error from sending a message, performing
+// the handshake or checking the connection with IsAlive, or nil if there has
+// been none
+func (c *Conn) LastError() error {
+	return c.stats.lastError()
+}
+
+// Throttled returns true if sending is paused by a throttle control message
+// from the indexer. It is always false unless ObeyThrottle is set.
+func (c *Conn) Throttled() bool {
+	return time.Now().UnixNano() < c.throttleUntil.Load()
+}
+
+// throttle pauses sending for d, or resumes sending if d is zero
+func (c *Conn) throttle(d time.Duration) {
+	if d == 0 {
+		c.throttleUntil.Store(0)
+	} else {
+		c.throttleUntil.Store(time.Now().Add(d).UnixNano())
+	}
+	logAttrs(c.StructuredLogger, slog.LevelDebug, "throttled", slog.String(LogKeyEndpoint, c.Endpoint),
+		slog.Duration(LogKeyDuration, d))
+}
+
+// waitThrottle waits until sending is no longer paused by a throttle control
+// message, or returns net.ErrClosed if the connection is closed first
+func (c *Conn) waitThrottle() error {
+	for {
+		d := time.Until(time.Unix(0, c.throttleUntil.Load()))
+		if d <= 0 {
+			return nil
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return net.ErrClosed
+		}
+	}
+}
+
+// socketConn returns the network connection underlying conn
+func socketConn(conn net.Conn) net.Conn {
+	if cc, ok := conn.(*countingConn); ok {
+		conn = cc.Conn
+	}
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	return conn
+}
+
+// Ping sends a heartbeat control message, which keeps an idle connection
+// from being reaped by firewalls or indexers without sending an event
+func (c *Conn) Ping() error {
+	if err := c.ensureHandshake(); err != nil {
+		return err
+	}
+	if c.Version < 3 {
+		return ErrPingUnsupported
+	}
+	return c.write(&Message{
+		Fields: map[string]string{
+			controlMsgKey: heartbeatValue,
+		},
+	})
+}
+
+// KeepAlive sends a heartbeat every interval in a background goroutine,
+// until the connection is closed or a heartbeat fails
+func (c *Conn) KeepAlive(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.done:
+				return
+			case <-ticker.C:
+				if err := c.Ping(); err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// SendMessage sends a message over the splunk-to-splunk connection, applying
+// the Conn's defaults and options. If UseAck is enabled, it returns once the
+// message is written, and its acknowledgement is delivered on the Acks channel.
 func (c *Conn) SendMessage(m *Message) error {
-	if !c.didHandshake {
-		if err := c.doHandshake(); err != nil {
+	if m == nil {
+		return ErrNilMessage
+	}
+	if c.UseAck {
+		_, err := c.SendMessageAsync(m)
+		return err
+	}
+
+	err := c.sendMessage(m)
+	delay := c.RetryDelay
+	for retry := 0; retry < c.MaxRetries && isTransient(err); retry++ {
+		logAttrs(c.StructuredLogger, slog.LevelWarn, "reconnecting", slog.String(LogKeyEndpoint, c.Endpoint),
+			slog.Int(LogKeyAttempt, retry+1), errorAttr(err))
+		select {
+		case <-c.done:
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if err = c.redial(); err == nil {
+			logAttrs(c.StructuredLogger, slog.LevelInfo, "reconnected", slog.String(LogKeyEndpoint, c.Endpoint),
+				slog.Int(LogKeyAttempt, retry+1))
+			err = c.sendMessage(m)
+		}
+	}
+	return err
+}
+
+// sendMessage performs the handshake if needed and sends a message once
+func (c *Conn) sendMessage(m *Message) error {
+	if err := c.ensureHandshake(); err != nil {
+		return err
+	}
+	return c.writeMessage(m, nil)
+}
+
+// redial replaces the network connection with a new one, which performs the
+// handshake again before the next message is sent
+func (c *Conn) redial() error {
+	if c.dial == nil {
+		return ErrCannotRedial
+	}
+	conn, err := dialTimeout(c.dial)
+	if err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.Close()
+	c.conn = &countingConn{Conn: conn, n: &c.stats.bytesWritten}
+	c.writer = nil
+	c.didHandshake = false
+	c.throttleUntil.Store(0)
+	return nil
+}
+
+// Reconnect dials Endpoint again with the same options, such as its TLS
+// settings and dialer, and replaces the network connection, reusing the Conn
+// and its configuration instead of allocating a new one. If the dial fails,
+// the existing connection is kept. The handshake is performed
+// again before the next message is sent. Reconnect returns ErrCannotRedial if
+// the Conn was not dialed by it, as with ConnectPipe, or UseAck is set, since
+// acknowledgements cannot be carried over to a new connection, and
+// net.ErrClosed if the Conn has been closed.
+func (c *Conn) Reconnect() error {
+	if c.dial == nil {
+		return ErrCannotRedial
+	}
+	if c.UseAck {
+		return fmt.Errorf("%w: acknowledgements are tied to the connection", ErrCannotRedial)
+	}
+	select {
+	case <-c.done:
+		return net.ErrClosed
+	default:
+	}
+
+	if err := c.redial(); err != nil {
+		c.stats.setError(err)
+		return err
+	}
+	logAttrs(c.StructuredLogger, slog.LevelInfo, "reconnected", slog.String(LogKeyEndpoint, c.Endpoint))
+	return nil
+}
+
+// isTransient returns true if a send failed because the connection was reset
+// or closed by the peer, so it may succeed on a new connection
+func isTransient(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNABORTED)
+}
+
+// SendString sends raw as a message with the default metadata and fields
+func (c *Conn) SendString(raw string) error {
+	return c.SendMessage(&Message{Raw: raw})
+}
+
+// SendMessageAt sends a message with its time set to t, unless TimeMode is TimeNever
+func (c *Conn) SendMessageAt(m *Message, t time.Time) error {
+	if m == nil {
+		return ErrNilMessage
+	}
+	return c.SendMessage(withTime(m, t))
+}
+
+// SendMessageNow sends a message with its time set to the current time
+func (c *Conn) SendMessageNow(m *Message) error {
+	return c.SendMessageAt(m, time.Now())
+}
+
+// SendMessageReader sends a message like SendMessage, but streams the rawLen
+// bytes of its _raw value from raw instead of using m.Raw, so that large
+// payloads are not held in memory. It is not retried on failure, since raw
+// cannot be read again. If raw ends before rawLen bytes, the message cannot be
+// completed, so the connection is closed and io.ErrUnexpectedEOF is returned.
+// If UseAck is enabled, the acknowledgement is delivered on Acks.
+func (c *Conn) SendMessageReader(m *Message, raw io.Reader, rawLen int) error {
+	if m == nil {
+		return ErrNilMessage
+	}
+	r := &rawReader{r: raw, n: rawLen}
+	if c.UseAck {
+		_, err := c.sendWithAck(c.acks, m, r, nil)
+		return err
+	}
+	if err := c.ensureHandshake(); err != nil {
+		return err
+	}
+	return c.writeMessage(m, r)
+}
+
+// SendFile sends the contents of the file at path as a single message, such
+// as a config file or stack trace that should not be split into lines. The
+// message has the metadata and fields of m, which may be nil, with Source set
+// to path unless m sets it. The file is streamed with SendMessageReader, up to
+// its size when it was opened; if it is truncated while being sent, the
+// connection is closed and an error wrapping io.ErrUnexpectedEOF is returned.
+func (c *Conn) SendFile(m *Message, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%w: %s", ErrNotRegularFile, path)
+	}
+
+	fm := &Message{}
+	if m != nil {
+		fm = m.Clone()
+		fm.Raw = ""
+	}
+	if fm.Source == "" {
+		fm.Source = path
+	}
+	size := info.Size()
+	err = c.SendMessageReader(fm, io.LimitReader(file, size), int(size))
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %s is shorter than its size of %d bytes", err, path, size)
+	}
+	return err
+}
+
+// SendRaw writes one or more pre-encoded messages to the connection verbatim,
+// performing the handshake if needed. The length prefix of each message is
+// checked so that a malformed buffer does not corrupt the stream. Messages
+// sent with SendRaw are not assigned acknowledgement or sequence identifiers.
+func (c *Conn) SendRaw(b []byte) error {
+	n, err := countFrames(b)
+	if err != nil {
+		return err
+	}
+	err = c.waitThrottle()
+	if err == nil && c.RateLimiter != nil {
+		err = c.RateLimiter.wait(c.done, n, len(b))
+	}
+	if err != nil {
+		c.stats.record(err)
+		return err
+	}
+	if err := c.ensureHandshake(); err != nil {
+		return err
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	err = c.withWriteDeadline(func() error {
+		if c.writer != nil {
+			if _, err := c.writer.Write(b); err != nil {
+				return err
+			}
+			return c.writer.Flush()
+		}
+		_, err := c.conn.Write(b)
+		return err
+	})
+	if err != nil {
+		c.stats.record(err)
+		return err
+	}
+	for i := 0; i < n; i++ {
+		c.stats.record(nil)
+	}
+	return nil
+}
+
+// SendMessageAsync sends a message requesting an acknowledgement and returns
+// its identifier without waiting. The acknowledgement is delivered on Acks.
+func (c *Conn) SendMessageAsync(m *Message) (uint64, error) {
+	return c.sendWithAck(c.acks, m, nil, nil)
+}
+
+// SendMessageAck sends a message and blocks until the indexer acknowledges it
+func (c *Conn) SendMessageAck(m *Message) error {
+	waiter := make(chan Ack, 1)
+	id, err := c.sendWithAck(c.acks, m, nil, waiter)
+	if err != nil {
+		return err
+	}
+	return c.waitAck(c.acks, id, waiter)
+}
+
+// waitAck waits for the acknowledgement of id to be delivered to waiter
+func (c *Conn) waitAck(t *ackTracker, id uint64, waiter chan Ack) error {
+	timer := time.NewTimer(AckTimeout)
+	defer timer.Stop()
+
+	var ack Ack
+	select {
+	case ack = <-waiter:
+	case <-c.ackDone:
+		select {
+		case ack = <-waiter:
+		default:
+			return ErrAckConnClosed
+		}
+	case <-timer.C:
+		t.cancel(id)
+		return ErrAckTimeout
+	}
+
+	if !ack.Success {
+		return ErrAckFailed
+	}
+	return nil
+}
+
+// Acks returns a channel that receives acknowledgements for messages sent
+// with SendMessage or SendMessageAsync while UseAck is enabled. The channel is
+// closed when the connection is closed, and acknowledgements are dropped if
+// it is full.
+func (c *Conn) Acks() <-chan Ack {
+	return c.acks.acks
+}
+
+// sendWithAck assigns an acknowledgement identifier from t to a message and
+// sends it. If waiter is not nil, the acknowledgement is delivered to it
+// instead of the tracker's buffered channel.
+func (c *Conn) sendWithAck(t *ackTracker, m *Message, raw *rawReader, waiter chan Ack) (uint64, error) {
+	if !c.UseAck {
+		return 0, ErrAckDisabled
+	}
+	if m == nil {
+		return 0, ErrNilMessage
+	}
+
+	if err := c.ensureHandshake(); err != nil {
+		return 0, err
+	}
+
+	id := t.next(waiter)
+	if err := c.writeMessage(withField(m, ackIDKey, strconv.FormatUint(id, 10)), raw); err != nil {
+		t.cancel(id)
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// readAcks reads acknowledgements from the indexer until the connection is closed
+func (c *Conn) readAcks() {
+	defer c.closeChannels()
+	defer close(c.acks.acks)
+	defer close(c.ackDone)
+
+	var r io.Reader = c.conn
+	if c.Compressed {
+		zr, err := NewCompressedReader(c.conn)
+		if err != nil {
+			return
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	for {
+		m := &Message{}
+		if err := m.Read(r); err != nil {
+			return
+		}
+		ack, ok := parseAck(m)
+		if !ok {
+			c.handleControl(m)
+			continue
+		}
+		if ack.Channel != 0 {
+			c.deliverChannelAck(ack)
+			continue
+		}
+		c.acks.deliver(ack)
+	}
+}
+
+// readControl reads control messages sent by the indexer on conn until it is
+// closed. It is used instead of readAcks when ObeyThrottle is set without
+// UseAck, and a new one is started for each redialed connection.
+func (c *Conn) readControl(conn net.Conn, compressed bool) {
+	var r io.Reader = conn
+	if compressed {
+		zr, err := NewCompressedReader(conn)
+		if err != nil {
+			return
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	for {
+		m := &Message{}
+		if err := m.Read(r); err != nil {
+			return
+		}
+		c.handleControl(m)
+	}
+}
+
+// handleControl applies a control message read from the indexer
+func (c *Conn) handleControl(m *Message) {
+	if !c.ObeyThrottle {
+		return
+	}
+	if d, ok := parseThrottle(m); ok {
+		c.throttle(d)
+	}
+}
+
+// rawReader is a _raw value streamed from a reader instead of Message.Raw
+type rawReader struct {
+	r io.Reader
+	n int
+}
+
+// writeMessage writes a message to the connection and records the result.
+// If raw is not nil, the _raw value is streamed from it.
+func (c *Conn) writeMessage(m *Message, raw *rawReader) error {
+	err := c.waitThrottle()
+	if err == nil && c.RateLimiter != nil {
+		rawLen := len(m.Raw)
+		if raw != nil {
+			rawLen = raw.n
+		}
+		size, _ := getHeaderValues(m, rawLen)
+		err = c.RateLimiter.wait(c.done, 1, int(size)+4)
+	}
+	if err == nil {
+		err = c.writeEvent(m, raw)
+	}
+	c.stats.record(err)
+	return err
+}
+
+// writeEvent writes a message to the connection, compressing it if negotiated
+func (c *Conn) writeEvent(m *Message, raw *rawReader) error {
+	m, err := applyCollisionPolicy(c.withDefaults(m), c.CollisionPolicy)
+	if err != nil {
+		return err
+	}
+	if c.RequireIndex && m.Index == "" {
+		return ErrMissingIndex
+	}
+	if c.UseMeta {
+		if m, err = packMeta(m); err != nil {
 			return err
 		}
-		c.didHandshake = true
 	}
+	mode := c.TimeMode
+	if c.AutoTimestamp && mode == TimeAuto {
+		mode = TimeAlways
+	}
+	m = applyTimeMode(m, mode)
+	if c.CompressRawOver > 0 && raw == nil && len(m.Raw) > c.CompressRawOver {
+		if m, err = CompressRaw(m); err != nil {
+			return err
+		}
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.UseSequence {
+		c.lastSequence++
+		m = withField(m, sequenceKey, strconv.FormatUint(c.lastSequence, 10))
+	}
+	return c.withWriteDeadline(func() error {
+		return c.encodeLocked(m, raw)
+	})
+}
+
+// hostname caches the result of os.Hostname
+var hostname = sync.OnceValue(func() string {
+	name, _ := os.Hostname()
+	return name
+})
+
+// Hostname returns the name of the local host, or an empty string if it
+// cannot be determined. The name is looked up once and then cached.
+func Hostname() string {
+	return hostname()
+}
+
+// withDefaults returns the message, or a copy with the default metadata and
+// fields filled in where the message does not set them
+func (c *Conn) withDefaults(m *Message) *Message {
+	needsFields := false
+	for k := range c.DefaultFields {
+		if _, ok := m.Fields[k]; !ok {
+			needsFields = true
+			break
+		}
+	}
+	defaultHost := c.DefaultHost
+	if defaultHost == "" && c.UseHostname {
+		defaultHost = Hostname()
+	}
+	needsMetadata := (m.Index == "" && c.DefaultIndex != "") ||
+		(m.Host == "" && defaultHost != "") ||
+		(m.Source == "" && c.DefaultSource != "") ||
+		(m.SourceType == "" && c.DefaultSourceType != "")
+	if !needsFields && !needsMetadata {
+		return m
+	}
+
+	d := m.Clone()
+	d.Index = cmp.Or(d.Index, c.DefaultIndex)
+	d.Host = cmp.Or(d.Host, defaultHost)
+	d.Source = cmp.Or(d.Source, c.DefaultSource)
+	d.SourceType = cmp.Or(d.SourceType, c.DefaultSourceType)
+	if needsFields {
+		if d.Fields == nil {
+			d.Fields = make(map[string]string, len(c.DefaultFields))
+		}
+		for k, v := range c.DefaultFields {
+			if _, ok := d.Fields[k]; !ok {
+				d.Fields[k] = v
+			}
+		}
+	}
+	return d
+}
+
+// write writes a message to the connection, serializing it with other writes
+// so that heartbeats never interleave with a message
+func (c *Conn) write(m *Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.withWriteDeadline(func() error {
+		return c.writeLocked(m)
+	})
+}
 
-	if err := m.Write(c.conn); err != nil {
+// withWriteDeadline calls write with a write deadline of WriteTimeout, if it
+// is set, while holding writeMu
+func (c *Conn) withWriteDeadline(write func() error) error {
+	if c.WriteTimeout <= 0 {
+		return write()
+	}
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.WriteTimeout)); err != nil {
 		return err
 	}
+	err := write()
+	if clearErr := c.conn.SetWriteDeadline(time.Time{}); err == nil {
+		err = clearErr
+	}
+	return err
+}
+
+// writeLocked writes a message to the connection while holding writeMu
+func (c *Conn) writeLocked(m *Message) error {
+	return c.encodeLocked(m, nil)
+}
+
+// encodeLocked writes a message to the connection while holding writeMu,
+// streaming its _raw value from raw if it is not nil
+func (c *Conn) encodeLocked(m *Message, raw *rawReader) error {
+	var w io.Writer = c.conn
+	if c.writer != nil {
+		w = c.writer
+	}
+	var err error
+	if raw != nil {
+		err = EncodeMessageReader(w, m, raw.r, raw.n)
+		if err == io.ErrUnexpectedEOF {
+			// the message cannot be completed, so the stream is unusable
+			c.conn.Close()
+			return err
+		}
+	} else {
+		err = EncodeMessage(w, m)
+	}
+	if err == nil && c.writer != nil {
+		err = c.writer.Flush()
+	}
+	return err
+}
 
+// Handshake performs the protocol handshake, so that connection and
+// capability exchange failures are reported before any message is sent.
+// Sending a message performs the handshake if it has not been done. It is
+// performed once per network connection, so Handshake returns nil if it has
+// already been done, until the connection is redialed after a send is retried.
+func (c *Conn) Handshake() error {
+	return c.ensureHandshake()
+}
+
+// ensureHandshake performs the protocol handshake if it has not been done yet
+func (c *Conn) ensureHandshake() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.didHandshake {
+		return nil
+	}
+	if err := c.withWriteDeadline(c.doHandshake); err != nil {
+		c.stats.setError(err)
+		return err
+	}
+	logAttrs(c.StructuredLogger, slog.LevelDebug, "handshake complete", slog.String(LogKeyEndpoint, c.Endpoint),
+		slog.Int(LogKeyVersion, c.Version))
+	c.didHandshake = true
+	if c.UseAck {
+		go c.readAcks()
+	} else if c.ObeyThrottle && c.Version >= 3 {
+		go c.readControl(c.conn, c.Compressed)
+	}
 	return nil
 }
 
 // doHandshake performs a splunk-to-splunk protocol handshake
 func (c *Conn) doHandshake() error {
 	// send the signature header
-	if err := writeSignature(c.conn, c.Endpoint, c.Version); err != nil {
+	if err := c.writeSignature(); err != nil {
 		return err
 	}
 	if c.Version < 3 {
-		return nil
+		return c.downgrade()
 	}
 
 	// send s2s capabilities to the server
+	ack, compression := 0, 0
+	if c.UseAck {
+		ack = 1
+	}
+	if c.Compressed {
+		compression = 1
+	}
 	clientMsg := &Message{
 		Fields: map[string]string{
-			"__s2s_capabilities": "ack=0;compression=0",
+			capabilitiesKey: fmt.Sprintf("ack=%d;compression=%d", ack, compression),
 		},
 	}
 	if err := clientMsg.Write(c.conn); err != nil {
 		return fmt.Errorf("s2s v3 handshake failure: %v", err)
 	}
 
-	// read the s2s capabilities from the server
+	// read the s2s capabilities from the server; v2 servers never respond
+	if err := c.conn.SetReadDeadline(time.Now().Add(cmp.Or(c.HandshakeTimeout, DefaultHandshakeTimeout))); err != nil {
+		return err
+	}
 	serverMsg := &Message{}
-	if err := serverMsg.Read(c.conn); err != nil {
+	err := serverMsg.Read(c.conn)
+	if err := c.conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return c.redialV2()
+	}
+	if err != nil {
 		return fmt.Errorf("s2s v3 handshake failure: %v", err)
 	}
 
-	return nil
-}
+	c.serverCaps = parseControlValues(serverMsg.Fields[controlMsgKey])
+	c.Capabilities = parseCapabilities(serverMsg.Fields[controlMsgKey])
+	if c.Capabilities.Version < 3 {
+		return c.downgrade()
+	}
 
-// writeSignature writes a splunk-to-splunk signature to the writer
-func writeSignature(w io.Writer, endpoint string, version int) error {
-	var signature [128]byte
-	var serverName [256]byte
-	var mgmtPort [16]byte
+	// a client certificate can only be presented during the TLS handshake,
+	// so one requested over TLS must already have been sent
+	if c.Capabilities.RequestCertificate && c.Encrypted && !c.clientCert {
+		return fmt.Errorf("%w: configure TLSOptions.ClientCert", ErrCertRequired)
+	}
 
-	endpointParts := strings.Split(endpoint, ":")
-	if len(endpointParts) != 2 {
-		return ErrInvalidEndpoint
+	// only compress if the server also agreed to it
+	c.Compressed = c.Compressed && c.Capabilities.Compression
+	if c.Compressed {
+		c.writer = NewCompressedWriter(c.conn)
 	}
-	copy(signature[:], fmt.Sprintf("--splunk-cooked-mode-v%d--", version))
-	copy(serverName[:], endpointParts[0])
-	copy(mgmtPort[:], endpointParts[1])
 
-	_, err := w.Write(signature[:])
+	return nil
+}
+
+// redialV2 replaces a connection whose server did not respond to the v3
+// capabilities request with one that sends a v2 signature, since the server
+// has already been told to expect v3. It must be called holding writeMu.
+func (c *Conn) redialV2() error {
+	if c.UseAck {
+		return fmt.Errorf("%w, and acknowledgements require v3", ErrNoCapabilities)
+	}
+	if c.dial == nil {
+		return ErrNoCapabilities
+	}
+	conn, err := dialTimeout(c.dial)
 	if err != nil {
+		return fmt.Errorf("%w: %w", ErrNoCapabilities, err)
+	}
+	c.conn.Close()
+	c.conn = &countingConn{Conn: conn, n: &c.stats.bytesWritten}
+	if err := c.downgrade(); err != nil {
 		return err
 	}
+	logAttrs(c.StructuredLogger, slog.LevelInfo, "redialed for v2", slog.String(LogKeyEndpoint, c.Endpoint))
+	return c.writeSignature()
+}
+
+// downgrade falls back to the v2 protocol, which has no capabilities exchange
+func (c *Conn) downgrade() error {
+	if c.UseAck {
+		return ErrAckDisabled
+	}
+	c.Version = 2
+	c.Compressed = false
+	c.Capabilities = Capabilities{Version: 2}
+	return nil
+}
+
+// splitEndpoint returns the network and address for an endpoint, which is
+// either "host:port" or "tcp://host:port" for TCP, or "unix://<path>" for a
+// Unix domain socket. IPv6 hosts must be bracketed, as in "[::1]:9997".
+func splitEndpoint(endpoint string) (string, string) {
+	if strings.HasPrefix(endpoint, UnixPrefix) {
+		return "unix", strings.TrimPrefix(endpoint, UnixPrefix)
+	}
+	return "tcp", strings.TrimPrefix(endpoint, TCPPrefix)
+}
+
+// parseEndpoint splits an endpoint like splitEndpoint, returning
+// ErrInvalidEndpoint if a TCP address does not have a host and port
+func parseEndpoint(endpoint string) (string, string, error) {
+	network, address := splitEndpoint(endpoint)
+	if network == "tcp" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return "", "", fmt.Errorf("%w: %v", ErrInvalidEndpoint, err)
+		}
+	}
+	return network, address, nil
+}
+
+// signatureEndpoint returns the "host:port" sent in the signature. Unix domain
+// socket connections have no port, so they are identified as "localhost:0".
+func signatureEndpoint(endpoint string) string {
+	network, address := splitEndpoint(endpoint)
+	if network == "unix" {
+		return "localhost:0"
+	}
+	return address
+}
 
-	_, err = w.Write(serverName[:])
+// writeSignature writes the signature identifying the connection, using
+// ServerName and ManagementPort if they are set
+func (c *Conn) writeSignature() error {
+	h, err := signatureHandshake(c.Endpoint, c.Version)
 	if err != nil {
 		return err
 	}
+	h.ServerName = cmp.Or(c.ServerName, Hostname(), h.ServerName)
+	h.ManagementPort = cmp.Or(c.ManagementPort, h.ManagementPort)
+	return WriteHandshake(c.conn, h)
+}
 
-	_, err = w.Write(mgmtPort[:])
+// writeSignature writes a splunk-to-splunk signature for a v2 or v3 client
+// identifying endpoint to the writer
+func writeSignature(w io.Writer, endpoint string, version int) error {
+	h, err := signatureHandshake(endpoint, version)
 	if err != nil {
 		return err
 	}
+	return WriteHandshake(w, h)
+}
 
-	return nil
+// signatureHandshake returns the handshake for a v2 or v3 client that uses
+// the host and port of endpoint as its server name and management port
+func signatureHandshake(endpoint string, version int) (Handshake, error) {
+	if version != 2 && version != 3 {
+		return Handshake{}, fmt.Errorf("%w: %d", ErrInvalidVersion, version)
+	}
+	host, port, err := net.SplitHostPort(signatureEndpoint(endpoint))
+	if err != nil {
+		return Handshake{}, fmt.Errorf("%w: %v", ErrInvalidEndpoint, err)
+	}
+	return Handshake{
+		Version:        version,
+		ServerName:     host,
+		ManagementPort: port,
+	}, nil
 }
@@ -19,7 +19,30 @@ package s2s
 
 import (
 	"bytes"
+	"cmp"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 )
 
 // createFixedSizeBytes creates a byte slice of the specified size with the given content
@@ -31,66 +54,2062 @@ func createFixedSizeBytes(content string, size int) []byte {
 
 func TestWriteSignature(t *testing.T) {
 	tests := []struct {
-		name          string
-		endpoint      string
-		version       int
-		wantErr       bool
-		wantSignature []byte
+		name           string
+		endpoint       string
+		version        int
+		wantErr        error
+		wantSignature  string
+		wantServerName string
+		wantMgmtPort   string
 	}{
+		{"v2", "test-server:8089", 2, nil, "--splunk-cooked-mode-v2--", "test-server", "8089"},
+		{"v3", "test-server:8089", 3, nil, "--splunk-cooked-mode-v3--", "test-server", "8089"},
+		{"zero port", "test-server:0", 3, nil, "--splunk-cooked-mode-v3--", "test-server", "0"},
+		{"bracketed ipv6", "[2001:db8::1]:9997", 3, nil, "--splunk-cooked-mode-v3--", "2001:db8::1", "9997"},
+		{"tcp scheme", "tcp://test-server:8089", 3, nil, "--splunk-cooked-mode-v3--", "test-server", "8089"},
+		{"unix socket", "unix:///tmp/s2s.sock", 3, nil, "--splunk-cooked-mode-v3--", "localhost", "0"},
+		{"unbracketed ipv6", "2001:db8::1:9997", 3, ErrInvalidEndpoint, "", "", ""},
+		{"empty server name", "", 2, ErrInvalidEndpoint, "", "", ""},
+		{"unset version", "test-server:8089", 0, ErrInvalidVersion, "", "", ""},
+		{"unsupported version", "test-server:8089", 4, ErrInvalidVersion, "", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := writeSignature(&buf, tt.endpoint, tt.version)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("writeSignature() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if buf.Len() != 0 {
+					t.Errorf("writeSignature() wrote %d bytes on error", buf.Len())
+				}
+				return
+			}
+
+			// 128 byte signature, 256 byte server name and 16 byte management port
+			got := buf.Bytes()
+			if len(got) != 128+256+16 {
+				t.Fatalf("writeSignature() length = %v, want %v", len(got), 128+256+16)
+			}
+			fields := []struct {
+				name string
+				got  []byte
+				want []byte
+			}{
+				{"signature", got[:128], createFixedSizeBytes(tt.wantSignature, 128)},
+				{"server name", got[128:384], createFixedSizeBytes(tt.wantServerName, 256)},
+				{"management port", got[384:], createFixedSizeBytes(tt.wantMgmtPort, 16)},
+			}
+			for _, f := range fields {
+				if !bytes.Equal(f.got, f.want) {
+					t.Errorf("writeSignature() %s = %q, want %q", f.name, f.got, f.want)
+				}
+			}
+		})
+	}
+}
+
+// startMockIndexer starts a listener that passes each accepted connection to
+// handle after reading the signature, and returns its endpoint
+func startMockIndexer(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				signature := make([]byte, 128+256+16)
+				if _, err := io.ReadFull(conn, signature); err != nil {
+					return
+				}
+				handle(conn)
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestSendMessageAck(t *testing.T) {
+	capabilities := make(chan string, 1)
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		m := &Message{}
+		if err := m.Read(conn); err != nil {
+			return
+		}
+		capabilities <- m.Fields[capabilitiesKey]
+		resp := &Message{Fields: map[string]string{controlMsgKey: "cap_response=success"}}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+
+		for {
+			if err := m.Read(conn); err != nil {
+				return
+			}
+			status := "success"
+			if m.Raw == "fail" {
+				status = "failure"
+			}
+			ack := &Message{Fields: map[string]string{
+				controlMsgKey: "ack_id=" + m.Fields[ackIDKey] + ";ack_status=" + status,
+			}}
+			if err := ack.Write(conn); err != nil {
+				return
+			}
+		}
+	})
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+
+	if err := c.SendMessageAck(&Message{Raw: "first"}); err != nil {
+		t.Fatalf("SendMessageAck() error = %v", err)
+	}
+	if got := <-capabilities; !strings.Contains(got, "ack=1") {
+		t.Errorf("capabilities = %q, want ack=1", got)
+	}
+
+	if err := c.SendMessageAck(&Message{Raw: "fail"}); err != ErrAckFailed {
+		t.Errorf("SendMessageAck() error = %v, want %v", err, ErrAckFailed)
+	}
+
+	id, err := c.SendMessageAsync(&Message{Raw: "async"})
+	if err != nil {
+		t.Fatalf("SendMessageAsync() error = %v", err)
+	}
+	ack := <-c.Acks()
+	if ack.ID != id || !ack.Success {
+		t.Errorf("Acks() = %+v, want ID %d success", ack, id)
+	}
+}
+
+func TestSendMessageAckDisabled(t *testing.T) {
+	c := &Conn{}
+	if err := c.SendMessageAck(&Message{Raw: "test"}); err != ErrAckDisabled {
+		t.Errorf("SendMessageAck() error = %v, want %v", err, ErrAckDisabled)
+	}
+}
+
+func TestParseAck(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		want   Ack
+		wantOk bool
+	}{
+		{"success", "ack_id=42;ack_status=success", Ack{ID: 42, Success: true}, true},
+		{"failure", "ack_id=7;ack_status=failure", Ack{ID: 7, Success: false}, true},
+		{"missing id", "cap_response=success", Ack{}, false},
+		{"invalid id", "ack_id=abc;ack_status=success", Ack{}, false},
+		{"channel", "ack_id=3;ack_status=success;channel=5", Ack{ID: 3, Channel: 5, Success: true}, true},
+		{"invalid channel", "ack_id=3;ack_status=success;channel=x", Ack{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{Fields: map[string]string{controlMsgKey: tt.value}}
+			got, ok := parseAck(m)
+			if ok != tt.wantOk || got != tt.want {
+				t.Errorf("parseAck() = %+v, %v, want %+v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestSendAck(t *testing.T) {
+	var buf bytes.Buffer
+	if err := SendAck(&buf, 99, false); err != nil {
+		t.Fatalf("SendAck() error = %v", err)
+	}
+	m := &Message{}
+	if err := m.Read(&buf); err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+	got, ok := parseAck(m)
+	if !ok || got != (Ack{ID: 99, Success: false}) {
+		t.Errorf("parseAck() = %+v, %v, want ID 99 failure", got, ok)
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	tests := []struct {
+		name        string
+		response    string
+		wantVersion int
+		wantCaps    Capabilities
+		wantMap     map[string]string
+	}{
+		{
+			name:        "v3 server",
+			response:    "cap_response=success;cap_flush_key=false;idx_can_send_hb=true;v4=false;channel_limit=300;pl=7",
+			wantVersion: 3,
+			wantCaps: Capabilities{
+				Version:          3,
+				ChannelLimit:     300,
+				PipelineLevel:    7,
+				CanSendHeartbeat: true,
+			},
+			wantMap: map[string]string{
+				"cap_response":    "success",
+				"cap_flush_key":   "false",
+				"idx_can_send_hb": "true",
+				"v4":              "false",
+				"channel_limit":   "300",
+				"pl":              "7",
+			},
+		},
 		{
-			name:     "basic signature",
-			endpoint: "test-server:8089",
-			version:  2,
-			wantErr:  false,
-			wantSignature: bytes.Join([][]byte{
-				createFixedSizeBytes("--splunk-cooked-mode-v2--", 128),
-				createFixedSizeBytes("test-server", 256),
-				createFixedSizeBytes("8089", 16),
-			}, nil),
+			name:        "v4 server",
+			response:    "cap_response=success;v4=true;channel_limit=100",
+			wantVersion: 3,
+			wantCaps:    Capabilities{Version: 3, V4: true, ChannelLimit: 100},
+			wantMap:     map[string]string{"cap_response": "success", "v4": "true", "channel_limit": "100"},
 		},
 		{
-			name:     "empty server name",
-			endpoint: "",
-			version:  2,
-			wantErr:  true,
+			name:        "unparsed keys",
+			response:    "cap_response=success;idx_build=9.4.1;ack_timeout=300",
+			wantVersion: 3,
+			wantCaps:    Capabilities{Version: 3},
+			wantMap:     map[string]string{"cap_response": "success", "idx_build": "9.4.1", "ack_timeout": "300"},
 		},
 		{
-			name:     "zero port",
-			endpoint: "test-server:0",
-			version:  3,
-			wantErr:  false,
-			wantSignature: bytes.Join([][]byte{
-				createFixedSizeBytes("--splunk-cooked-mode-v3--", 128),
-				createFixedSizeBytes("test-server", 256),
-				createFixedSizeBytes("0", 16),
-			}, nil),
+			name:        "v2 server",
+			response:    "unknown",
+			wantVersion: 2,
+			wantCaps:    Capabilities{Version: 2},
+			wantMap:     map[string]string{"unknown": ""},
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			var buf bytes.Buffer
-			err := writeSignature(&buf, tt.endpoint, tt.version)
+			endpoint := startMockIndexer(t, func(conn net.Conn) {
+				m := &Message{}
+				if err := m.Read(conn); err != nil {
+					return
+				}
+				resp := &Message{Fields: map[string]string{controlMsgKey: tt.response}}
+				if err := resp.Write(conn); err != nil {
+					return
+				}
+				for m.Read(conn) == nil {
+				}
+			})
 
-			if tt.wantErr {
-				if err == nil {
-					t.Error("writeSignature() error = nil, wantErr true")
+			c, err := Connect(endpoint)
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+
+			if err := c.SendMessage(&Message{Raw: "test"}); err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+			if c.Version != tt.wantVersion {
+				t.Errorf("Version = %v, want %v", c.Version, tt.wantVersion)
+			}
+			if c.Capabilities != tt.wantCaps {
+				t.Errorf("Capabilities = %+v, want %+v", c.Capabilities, tt.wantCaps)
+			}
+			if got := c.ServerCapabilities(); !maps.Equal(got, tt.wantMap) {
+				t.Errorf("ServerCapabilities() = %v, want %v", got, tt.wantMap)
+			}
+		})
+	}
+}
+
+func TestSendMessageSequence(t *testing.T) {
+	sequences := make(chan string, 3)
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		m := &Message{}
+		if err := m.Read(conn); err != nil {
+			return
+		}
+		resp := &Message{Fields: map[string]string{controlMsgKey: "cap_response=success"}}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+		for m.Read(conn) == nil {
+			sequences <- m.Fields[sequenceKey]
+		}
+	})
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseSequence = true
+
+	m := &Message{Raw: "test"}
+	for i := 0; i < 3; i++ {
+		if err := c.SendMessage(m); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	for _, want := range []string{"1", "2", "3"} {
+		if got := <-sequences; got != want {
+			t.Errorf("sequence = %q, want %q", got, want)
+		}
+	}
+	if _, ok := m.Fields[sequenceKey]; ok {
+		t.Error("SendMessage() modified the original message")
+	}
+}
+
+// testCert is a PEM encoded certificate and key for TLS tests
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM string
+	keyPEM  string
+}
+
+// newTestCert creates a certificate signed by parent, or a self-signed CA if parent is nil
+func newTestCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error = %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error = %v", err)
+	}
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func TestConnectTLSClientCertificate(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "indexer", ca)
+	clientCert := newTestCert(t, "forwarder", ca)
+
+	serverKeyPair, err := tls.X509KeyPair([]byte(serverCert.certPEM), []byte(serverCert.keyPEM))
+	if err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatalf("tls.Listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	// report the verified client certificate name, or the handshake error
+	peers := make(chan string, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err != nil {
+				peers <- "error"
+			} else {
+				peers <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+				io.Copy(io.Discard, conn)
+			}
+			conn.Close()
+		}
+	}()
+	endpoint := listener.Addr().String()
+
+	c, err := ConnectTLSWithOptions(endpoint, TLSOptions{
+		CACert:     ca.certPEM,
+		ServerName: "indexer",
+		ClientCert: clientCert.certPEM,
+		ClientKey:  clientCert.keyPEM,
+	})
+	if err != nil {
+		t.Fatalf("ConnectTLSWithOptions() error = %v", err)
+	}
+	c.Version = 2
+	if err := c.SendMessage(&Message{Raw: "test"}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	c.Close()
+	if got := <-peers; got != "forwarder" {
+		t.Errorf("server saw client certificate %q, want forwarder", got)
+	}
+
+	// without a client certificate the server should reject the handshake
+	c, err = ConnectTLS(endpoint, ca.certPEM, "indexer", false)
+	if err == nil {
+		c.Close()
+	}
+	if got := <-peers; got != "error" {
+		t.Errorf("server saw client certificate %q, want handshake error", got)
+	}
+}
+
+func TestConnectTLSRequestCertificate(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "indexer", ca)
+	clientCert := newTestCert(t, "forwarder", ca)
+	serverKeyPair, err := tls.X509KeyPair([]byte(serverCert.certPEM), []byte(serverCert.keyPEM))
+	if err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatalf("tls.Listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	// advertise request_certificate in the capabilities response
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := ReadHandshake(conn); err != nil {
+					return
+				}
+				m := &Message{}
+				if err := m.Read(conn); err != nil {
+					return
+				}
+				resp := &Message{Fields: map[string]string{
+					controlMsgKey: "cap_response=success;request_certificate=true",
+				}}
+				if err := resp.Write(conn); err != nil {
+					return
 				}
+				io.Copy(io.Discard, conn)
+			}()
+		}
+	}()
+	endpoint := listener.Addr().String()
+
+	tests := []struct {
+		name    string
+		opts    TLSOptions
+		wantErr error
+	}{
+		{"with client certificate", TLSOptions{
+			CACert:     ca.certPEM,
+			ServerName: "indexer",
+			ClientCert: clientCert.certPEM,
+			ClientKey:  clientCert.keyPEM,
+		}, nil},
+		{"without client certificate", TLSOptions{
+			CACert:     ca.certPEM,
+			ServerName: "indexer",
+		}, ErrCertRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := ConnectTLSWithOptions(endpoint, tt.opts)
+			if err != nil {
+				t.Fatalf("ConnectTLSWithOptions() error = %v", err)
+			}
+			defer c.Close()
+			err = c.SendMessage(&Message{Raw: "test"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("SendMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if !c.Capabilities.RequestCertificate {
+				t.Errorf("Capabilities.RequestCertificate = false, want true")
+			}
+		})
+	}
+}
+
+func TestConnectTLSSessionResumption(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "indexer", ca)
+	serverKeyPair, err := tls.X509KeyPair([]byte(serverCert.certPEM), []byte(serverCert.keyPEM))
+	if err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverKeyPair}})
+	if err != nil {
+		t.Fatalf("tls.Listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	// report whether each connection resumed a session, after a v3 handshake
+	// so that the client reads the session ticket sent after the TLS handshake
+	resumed := make(chan bool, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
 				return
 			}
+			tlsConn := conn.(*tls.Conn)
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				continue
+			}
+			resumed <- tlsConn.ConnectionState().DidResume
+			if _, err := ReadHandshake(conn); err == nil {
+				m := &Message{}
+				if m.Read(conn) == nil {
+					resp := &Message{Fields: map[string]string{controlMsgKey: "cap_response=success"}}
+					resp.Write(conn)
+				}
+			}
+			io.Copy(io.Discard, conn)
+			conn.Close()
+		}
+	}()
+
+	opts := TLSOptions{
+		CACert:       ca.certPEM,
+		ServerName:   "indexer",
+		SessionCache: tls.NewLRUClientSessionCache(1),
+		DialContext:  KeepAliveDialer(15 * time.Second),
+	}
+	for i, want := range []bool{false, true} {
+		c, err := ConnectTLSWithOptions(listener.Addr().String(), opts)
+		if err != nil {
+			t.Fatalf("ConnectTLSWithOptions() error = %v", err)
+		}
+		if err := c.SendMessage(&Message{Raw: "test"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+		c.Close()
+		if got := <-resumed; got != want {
+			t.Errorf("connection %d DidResume = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestConnectTLSInvalidClientCertificate(t *testing.T) {
+	_, err := ConnectTLSWithOptions("localhost:9997", TLSOptions{ClientCert: "invalid", ClientKey: "invalid"})
+	if !errors.Is(err, ErrTLSCertificate) {
+		t.Errorf("ConnectTLSWithOptions() error = %v, want %v", err, ErrTLSCertificate)
+	}
+}
+
+func TestConnectTLSMinVersion(t *testing.T) {
+	ca := newTestCert(t, "test-ca", nil)
+	serverCert := newTestCert(t, "indexer", ca)
+	serverKeyPair, err := tls.X509KeyPair([]byte(serverCert.certPEM), []byte(serverCert.keyPEM))
+	if err != nil {
+		t.Fatalf("X509KeyPair() error = %v", err)
+	}
+
+	// a legacy server that only speaks TLS 1.1
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverKeyPair},
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS11,
+	})
+	if err != nil {
+		t.Fatalf("tls.Listen() error = %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
 			if err != nil {
-				t.Errorf("writeSignature() error = %v, wantErr %v", err, false)
 				return
 			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
 
-			got := buf.Bytes()
-			wantLen := 128 + 256 + 16
-			if len(got) != wantLen {
-				t.Errorf("writeSignature() length = %v, want %v", len(got), wantLen)
+	c, err := ConnectTLSWithOptions(listener.Addr().String(), TLSOptions{
+		CACert:     ca.certPEM,
+		ServerName: "indexer",
+	})
+	if err == nil {
+		c.Close()
+		t.Fatal("ConnectTLSWithOptions() error = nil, want protocol version error")
+	}
+
+	// explicitly allowing TLS 1.1 should succeed
+	c, err = ConnectTLSWithOptions(listener.Addr().String(), TLSOptions{
+		CACert:     ca.certPEM,
+		ServerName: "indexer",
+		MinVersion: tls.VersionTLS11,
+	})
+	if err != nil {
+		t.Fatalf("ConnectTLSWithOptions() error = %v", err)
+	}
+	c.Close()
+}
+
+func TestParseEndpoint(t *testing.T) {
+	tests := []struct {
+		endpoint    string
+		wantNetwork string
+		wantAddress string
+		wantErr     error
+	}{
+		{"indexer:9997", "tcp", "indexer:9997", nil},
+		{"tcp://indexer:9997", "tcp", "indexer:9997", nil},
+		{"[2001:db8::1]:9997", "tcp", "[2001:db8::1]:9997", nil},
+		{"tcp://[::1]:9997", "tcp", "[::1]:9997", nil},
+		{"unix:///var/run/s2s.sock", "unix", "/var/run/s2s.sock", nil},
+		{"indexer", "", "", ErrInvalidEndpoint},
+		{"tcp://indexer", "", "", ErrInvalidEndpoint},
+		{"2001:db8::1", "", "", ErrInvalidEndpoint},
+		{"", "", "", ErrInvalidEndpoint},
+	}
+	for _, tt := range tests {
+		network, address, err := parseEndpoint(tt.endpoint)
+		if !errors.Is(err, tt.wantErr) {
+			t.Errorf("parseEndpoint(%q) error = %v, want %v", tt.endpoint, err, tt.wantErr)
+			continue
+		}
+		if network != tt.wantNetwork || address != tt.wantAddress {
+			t.Errorf("parseEndpoint(%q) = %q, %q, want %q, %q", tt.endpoint, network, address, tt.wantNetwork, tt.wantAddress)
+		}
+	}
+}
+
+func TestConnectEndpointForms(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Logf("skipping %s: %v", address, err)
+			continue
+		}
+		defer listener.Close()
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}
+		}()
+
+		for _, endpoint := range []string{listener.Addr().String(), TCPPrefix + listener.Addr().String()} {
+			c, err := ConnectVersion(endpoint, 2)
+			if err != nil {
+				t.Errorf("ConnectVersion(%q) error = %v", endpoint, err)
+				continue
+			}
+			if err := c.SendMessage(&Message{Raw: "test"}); err != nil {
+				t.Errorf("SendMessage() to %q error = %v", endpoint, err)
+			}
+			c.Close()
+		}
+	}
+}
+
+func TestConnectVersion(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	// a v2 indexer reads only the signature and events, never responding
+	versions := make(chan int, 1)
+	received := make(chan *Message, 2)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		h, err := ReadHandshake(conn)
+		if err != nil {
+			return
+		}
+		versions <- h.Version
+		for {
+			m := &Message{}
+			if err := m.Read(conn); err != nil {
 				return
 			}
-			if !bytes.Equal(got, tt.wantSignature) {
-				t.Errorf("writeSignature() = %v, want %v", got, tt.wantSignature)
+			received <- m
+		}
+	}()
+
+	c, err := ConnectVersion(listener.Addr().String(), 2)
+	if err != nil {
+		t.Fatalf("ConnectVersion() error = %v", err)
+	}
+	defer c.Close()
+	for _, raw := range []string{"first", "second"} {
+		if err := c.SendMessage(&Message{Raw: raw}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+
+	if got := <-versions; got != 2 {
+		t.Errorf("signature version = %d, want 2", got)
+	}
+	for _, want := range []string{"first", "second"} {
+		m := <-received
+		if _, ok := m.Fields[capabilitiesKey]; ok {
+			t.Errorf("received capabilities %q, want none", m.Fields[capabilitiesKey])
+		}
+		if m.Raw != want {
+			t.Errorf("received Raw = %q, want %q", m.Raw, want)
+		}
+	}
+	if c.Capabilities.Version != 2 {
+		t.Errorf("Capabilities.Version = %d, want 2", c.Capabilities.Version)
+	}
+
+	for _, version := range []int{0, 1, 4} {
+		if _, err := ConnectVersion(listener.Addr().String(), version); !errors.Is(err, ErrInvalidVersion) {
+			t.Errorf("ConnectVersion(%d) error = %v, want %v", version, err, ErrInvalidVersion)
+		}
+	}
+}
+
+func TestConnSignatureIdentity(t *testing.T) {
+	tests := []struct {
+		name           string
+		serverName     string
+		managementPort string
+		wantName       string
+		wantPort       string
+	}{
+		{"custom", "forwarder-01", "8090", "forwarder-01", "8090"},
+		{"default", "", "", cmp.Or(Hostname(), "127.0.0.1"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handshakes := make(chan Handshake, 1)
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("net.Listen() error = %v", err)
+			}
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if h, err := ReadHandshake(conn); err == nil {
+					handshakes <- h
+				}
+				io.Copy(io.Discard, conn)
+			}()
+
+			c, err := ConnectVersion(listener.Addr().String(), 2)
+			if err != nil {
+				t.Fatalf("ConnectVersion() error = %v", err)
+			}
+			defer c.Close()
+			c.ServerName = tt.serverName
+			c.ManagementPort = tt.managementPort
+			if err := c.SendMessage(&Message{Raw: "test"}); err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+
+			_, wantPort, _ := net.SplitHostPort(listener.Addr().String())
+			wantPort = cmp.Or(tt.wantPort, wantPort)
+			h := <-handshakes
+			if h.ServerName != tt.wantName {
+				t.Errorf("ServerName = %q, want %q", h.ServerName, tt.wantName)
+			}
+			if h.ManagementPort != wantPort {
+				t.Errorf("ManagementPort = %q, want %q", h.ManagementPort, wantPort)
+			}
+		})
+	}
+}
+
+func TestSendMessageRetry(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	// reset the first connection after one event, then accept events on the next
+	reset := make(chan struct{})
+	received := make(chan string, 3)
+	go func() {
+		for i := 0; ; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := ReadHandshake(conn); err != nil {
+				conn.Close()
+				return
+			}
+			m := &Message{}
+			for m.Read(conn) == nil {
+				received <- m.Raw
+				if i == 0 {
+					conn.(*net.TCPConn).SetLinger(0)
+					conn.Close()
+					close(reset)
+					break
+				}
+			}
+		}
+	}()
+
+	c, err := ConnectVersion(listener.Addr().String(), 2)
+	if err != nil {
+		t.Fatalf("ConnectVersion() error = %v", err)
+	}
+	defer c.Close()
+	c.MaxRetries = 2
+	c.RetryDelay = time.Millisecond
+	h := &recordHandler{}
+	c.StructuredLogger = slog.New(h)
+
+	if err := c.SendMessage(&Message{Raw: "first"}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	<-reset
+	time.Sleep(50 * time.Millisecond)
+	if err := c.SendMessage(&Message{Raw: "second"}); err != nil {
+		t.Fatalf("SendMessage() after reset error = %v", err)
+	}
+
+	for _, want := range []string{"first", "second"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	if got := c.Stats().MessagesSent; got != 2 {
+		t.Errorf("Stats().MessagesSent = %d, want 2", got)
+	}
+	attrs, ok := h.attrs("reconnecting")
+	if !ok {
+		t.Fatal("no reconnecting record")
+	}
+	if got := attrs[LogKeyAttempt].Int64(); got != 1 {
+		t.Errorf("reconnecting %s = %d, want 1", LogKeyAttempt, got)
+	}
+	if _, ok := h.attrs("reconnected"); !ok {
+		t.Error("no reconnected record")
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection reset", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.ECONNRESET)}, true},
+		{"broken pipe", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"closed", net.ErrClosed, false},
+		{"missing index", ErrMissingIndex, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("isTransient(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestConnectWithDialer(t *testing.T) {
+	endpoint := startMockIndexer(t, func(conn net.Conn) {})
+
+	var dialed []string
+	dial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		var d net.Dialer
+		return d.DialContext(ctx, network, address)
+	}
+
+	c, err := ConnectWithDialer(endpoint, dial)
+	if err != nil {
+		t.Fatalf("ConnectWithDialer() error = %v", err)
+	}
+	c.Close()
+
+	errDial := errors.New("dial refused")
+	failingDial := func(ctx context.Context, network, address string) (net.Conn, error) {
+		dialed = append(dialed, network+" "+address)
+		return nil, errDial
+	}
+	if _, err := ConnectTLSWithOptions(endpoint, TLSOptions{DialContext: failingDial}); !errors.Is(err, errDial) {
+		t.Errorf("ConnectTLSWithOptions() error = %v, want %v", err, errDial)
+	}
+
+	want := []string{"tcp " + endpoint, "tcp " + endpoint}
+	if len(dialed) != len(want) {
+		t.Fatalf("dialed %v, want %v", dialed, want)
+	}
+	for i := range want {
+		if dialed[i] != want[i] {
+			t.Errorf("dialed[%d] = %v, want %v", i, dialed[i], want[i])
+		}
+	}
+}
+
+func TestSendMessageAutoTimestamp(t *testing.T) {
+	times := make(chan time.Time, 4)
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		m := &Message{}
+		if err := m.Read(conn); err != nil {
+			return
+		}
+		resp := &Message{Fields: map[string]string{controlMsgKey: "cap_response=success"}}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+		for m.Read(conn) == nil {
+			times <- m.Time
+		}
+	})
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+
+	historical := time.Unix(1600000000, 0)
+	m := &Message{Raw: "test"}
+	if err := c.SendMessage(m); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	c.AutoTimestamp = true
+	before := time.Now().Truncate(time.Second)
+	if err := c.SendMessage(m); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if err := c.SendMessage(&Message{Raw: "test", Time: historical}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if err := c.SendMessageAt(m, historical); err != nil {
+		t.Fatalf("SendMessageAt() error = %v", err)
+	}
+
+	if got := <-times; !got.IsZero() {
+		t.Errorf("Time without AutoTimestamp = %v, want zero", got)
+	}
+	if got := <-times; got.Before(before) {
+		t.Errorf("Time with AutoTimestamp = %v, want at least %v", got, before)
+	}
+	if got := <-times; !got.Equal(historical) {
+		t.Errorf("Time with AutoTimestamp = %v, want %v", got, historical)
+	}
+	if got := <-times; !got.Equal(historical) {
+		t.Errorf("Time with SendMessageAt = %v, want %v", got, historical)
+	}
+	if !m.Time.IsZero() {
+		t.Error("SendMessage() modified the original message")
+	}
+}
+
+func TestSendString(t *testing.T) {
+	s := startTestServer(t)
+	received := s.Messages()
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.DefaultIndex = "main"
+	c.DefaultHost = "web-01"
+	c.DefaultSource = "/var/log/app.log"
+	c.DefaultSourceType = "app"
+
+	if err := c.SendString("log line"); err != nil {
+		t.Fatalf("SendString() error = %v", err)
+	}
+	want := &Message{Index: "main", Host: "web-01", Source: "/var/log/app.log", SourceType: "app", Raw: "log line"}
+	select {
+	case m := <-received:
+		if !m.Equal(want) {
+			t.Errorf("received %v, want %v", m, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+func TestSendMessageDefaults(t *testing.T) {
+	s := startTestServer(t)
+	received := s.Messages()
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.DefaultIndex = "main"
+	c.DefaultHost = "web-01"
+	c.DefaultSource = "/var/log/app.log"
+	c.DefaultSourceType = "app"
+	c.DefaultFields = map[string]string{"env": "prod", "region": "us-east"}
+
+	tests := []struct {
+		name string
+		in   *Message
+		want *Message
+	}{
+		{
+			name: "raw only",
+			in:   &Message{Raw: "first"},
+			want: &Message{Index: "main", Host: "web-01", Source: "/var/log/app.log", SourceType: "app",
+				Fields: map[string]string{"env": "prod", "region": "us-east"}, Raw: "first"},
+		},
+		{
+			name: "overrides",
+			in: &Message{Index: "audit", SourceType: "json",
+				Fields: map[string]string{"env": "dev"}, Raw: "second"},
+			want: &Message{Index: "audit", Host: "web-01", Source: "/var/log/app.log", SourceType: "json",
+				Fields: map[string]string{"env": "dev", "region": "us-east"}, Raw: "second"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := tt.in.Clone()
+			if err := c.SendMessage(tt.in); err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+			if !tt.in.Equal(orig) {
+				t.Error("SendMessage() modified the original message")
+			}
+			select {
+			case m := <-received:
+				if !m.Equal(tt.want) {
+					t.Errorf("received %v, want %v", m, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for message")
+			}
+		})
+	}
+}
+
+func TestUseHostname(t *testing.T) {
+	name, err := os.Hostname()
+	if err != nil || name == "" {
+		t.Skipf("os.Hostname() = %q, %v", name, err)
+	}
+	if got := Hostname(); got != name {
+		t.Errorf("Hostname() = %q, want %q", got, name)
+	}
+
+	tests := []struct {
+		name        string
+		useHostname bool
+		defaultHost string
+		host        string
+		want        string
+	}{
+		{"disabled", false, "", "", ""},
+		{"enabled", true, "", "", name},
+		{"default host overrides", true, "web-01", "", "web-01"},
+		{"message host overrides", true, "web-01", "web-02", "web-02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Conn{UseHostname: tt.useHostname, DefaultHost: tt.defaultHost}
+			var buf bytes.Buffer
+			if err := EncodeMessage(&buf, c.withDefaults(&Message{Host: tt.host, Raw: "event"})); err != nil {
+				t.Fatalf("EncodeMessage() error = %v", err)
+			}
+			m := &Message{}
+			if err := m.Read(&buf); err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+			if m.Host != tt.want {
+				t.Errorf("Host = %q, want %q", m.Host, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendMessageTimeNever(t *testing.T) {
+	times := make(chan time.Time, 2)
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		m := &Message{}
+		if err := m.Read(conn); err != nil {
+			return
+		}
+		resp := &Message{Fields: map[string]string{controlMsgKey: "cap_response=success"}}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+		for m.Read(conn) == nil {
+			times <- m.Time
+		}
+	})
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+
+	// TimeNever takes precedence over AutoTimestamp
+	c.TimeMode = TimeNever
+	c.AutoTimestamp = true
+	if err := c.SendMessage(&Message{Raw: "test"}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if err := c.SendMessageAt(&Message{Raw: "test"}, time.Unix(1600000000, 0)); err != nil {
+		t.Fatalf("SendMessageAt() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-times; !got.IsZero() {
+			t.Errorf("Time with TimeNever = %v, want zero", got)
+		}
+	}
+}
+
+func TestSendMessageRequireIndex(t *testing.T) {
+	indexes := make(chan string, 4)
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		m := &Message{}
+		if err := m.Read(conn); err != nil {
+			return
+		}
+		resp := &Message{Fields: map[string]string{controlMsgKey: "cap_response=success"}}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+		for m.Read(conn) == nil {
+			indexes <- m.Index
+		}
+	})
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+
+	tests := []struct {
+		name         string
+		requireIndex bool
+		index        string
+		wantErr      error
+	}{
+		{"default index allowed", false, "", nil},
+		{"explicit index", true, "main", nil},
+		{"missing index", true, "", ErrMissingIndex},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c.RequireIndex = tt.requireIndex
+			err := c.SendMessage(&Message{Index: tt.index, Raw: "test"})
+			if err != tt.wantErr {
+				t.Fatalf("SendMessage() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if got := <-indexes; got != tt.index {
+				t.Errorf("Index = %q, want %q", got, tt.index)
+			}
+		})
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	heartbeats := make(chan *Message, 10)
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		m := &Message{}
+		if err := m.Read(conn); err != nil {
+			return
+		}
+		resp := &Message{Fields: map[string]string{controlMsgKey: "cap_response=success"}}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+		for {
+			m := &Message{}
+			if err := m.Read(conn); err != nil {
+				return
+			}
+			heartbeats <- m
+		}
+	})
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.KeepAlive(10 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case m := <-heartbeats:
+			if !isControlMessage(m) || m.Fields[controlMsgKey] != heartbeatValue {
+				t.Errorf("heartbeat = %v, want control message %q", m, heartbeatValue)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for heartbeat")
+		}
+	}
+}
+
+func TestPingRequiresV3(t *testing.T) {
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.Version = 2
+
+	if err := c.Ping(); err != ErrPingUnsupported {
+		t.Errorf("Ping() error = %v, want %v", err, ErrPingUnsupported)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		m := &Message{}
+		if err := m.Read(conn); err != nil {
+			return
+		}
+		resp := &Message{Fields: map[string]string{controlMsgKey: "cap_response=success"}}
+		if err := resp.Write(conn); err != nil {
+			return
+		}
+		io.Copy(io.Discard, conn)
+	})
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	if got := c.Stats(); got != (ConnStats{}) {
+		t.Errorf("Stats() = %+v, want zero", got)
+	}
+
+	const n = 5
+	var want bytes.Buffer
+	writeSignature(&want, endpoint, 3)
+	(&Message{Fields: map[string]string{capabilitiesKey: "ack=0;compression=0"}}).Write(&want)
+	before := time.Now()
+	for i := 0; i < n; i++ {
+		m := &Message{Index: "main", Raw: fmt.Sprintf("event %d", i)}
+		if err := c.SendMessage(m); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+		m.Write(&want)
+	}
+
+	stats := c.Stats()
+	if stats.MessagesSent != n {
+		t.Errorf("Stats().MessagesSent = %d, want %d", stats.MessagesSent, n)
+	}
+	if stats.BytesWritten != uint64(want.Len()) {
+		t.Errorf("Stats().BytesWritten = %d, want %d", stats.BytesWritten, want.Len())
+	}
+	if stats.LastSend.Before(before) {
+		t.Errorf("Stats().LastSend = %v, want after %v", stats.LastSend, before)
+	}
+
+	c.Close()
+	if err := c.SendMessage(&Message{Raw: "closed"}); err == nil {
+		t.Fatal("SendMessage() on closed connection succeeded")
+	}
+	stats = c.Stats()
+	if stats.MessagesSent != n || stats.SendErrors != 1 {
+		t.Errorf("Stats() = %+v, want %d sent and 1 error", stats, n)
+	}
+}
+
+func TestSendRaw(t *testing.T) {
+	want := &Message{
+		Index:      "main",
+		Host:       "host1",
+		Source:     "/var/log/test.log",
+		SourceType: "test",
+		Time:       time.Unix(1700000000, 0),
+		Fields:     map[string]string{"field": "value"},
+		Raw:        "raw event",
+	}
+	var encoded bytes.Buffer
+	if err := EncodeMessage(&encoded, want); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+
+	for _, compressed := range []bool{false, true} {
+		received := make(chan *Message, 1)
+		s := startTestServerWith(t, withCompression)
+		s.Logger = nil
+		s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+			received <- m.Clone()
+			return nil
+		})
+
+		c, err := Connect(s.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		c.Compressed = compressed
+		if err := c.SendRaw(encoded.Bytes()); err != nil {
+			t.Fatalf("SendRaw() error = %v", err)
+		}
+		if err := c.SendRaw([]byte{0, 0, 1, 0}); !errors.Is(err, ErrInvalidData) {
+			t.Errorf("SendRaw() error = %v, want %v", err, ErrInvalidData)
+		}
+
+		select {
+		case got := <-received:
+			var gotEncoded bytes.Buffer
+			EncodeMessage(&gotEncoded, got)
+			if !bytes.Equal(gotEncoded.Bytes(), encoded.Bytes()) {
+				t.Errorf("compressed=%v: received %v, want %v", compressed, got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("compressed=%v: timed out waiting for message", compressed)
+		}
+		if got := c.Stats().MessagesSent; got != 1 {
+			t.Errorf("Stats().MessagesSent = %d, want 1", got)
+		}
+		c.Close()
+	}
+}
+
+func TestCloseDeliversPendingMessages(t *testing.T) {
+	const n = 50
+	tests := []struct {
+		name      string
+		close     func(c *Conn) error
+		wantClean bool
+	}{
+		{"Close", (*Conn).Close, true},
+		{"CloseNow", (*Conn).CloseNow, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			received := 0
+			logger := &captureLogger{}
+			s := startTestServerWith(t, withCompression)
+			s.Logger = logger
+			s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+				mu.Lock()
+				defer mu.Unlock()
+				received++
+				return nil
+			})
+
+			c, err := Connect(s.listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			c.Compressed = true
+			for i := 0; i < n; i++ {
+				if err := c.SendMessage(&Message{Raw: fmt.Sprintf("event %d", i)}); err != nil {
+					t.Fatalf("SendMessage() error = %v", err)
+				}
+			}
+			if err := tt.close(c); err != nil {
+				t.Fatalf("%s() error = %v", tt.name, err)
+			}
+			waitForActive(t, s, 0)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if received != n {
+				t.Errorf("server received %d messages, want %d", received, n)
+			}
+			if got := logger.contains(disconnectValue); got != tt.wantClean {
+				t.Errorf("server logged disconnect = %v, want %v", got, tt.wantClean)
+			}
+			if got := !logger.contains("Error reading message"); got != tt.wantClean {
+				t.Errorf("server closed cleanly = %v, want %v", got, tt.wantClean)
+			}
+		})
+	}
+}
+
+func TestConnConcurrentSend(t *testing.T) {
+	const senders, perSender = 16, 100
+	for _, compressed := range []bool{false, true} {
+		var received atomic.Int64
+		s := startTestServerWith(t, withCompression)
+		s.Logger = nil
+		s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+			received.Add(1)
+			return nil
+		})
+
+		c, err := Connect(s.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		c.Compressed = compressed
+		c.UseSequence = true
+		c.KeepAlive(time.Millisecond)
+
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perSender; j++ {
+					m := &Message{Raw: fmt.Sprintf("sender %d message %d %s", i, j, strings.Repeat("x", j))}
+					if err := c.SendMessage(m); err != nil {
+						t.Errorf("SendMessage() error = %v", err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if err := c.Close(); err != nil {
+			t.Fatalf("Close() error = %v", err)
+		}
+		waitForActive(t, s, 0)
+
+		stats := s.Stats()
+		if stats.DecodeErrors != 0 {
+			t.Errorf("compressed=%v: server had %d decode errors", compressed, stats.DecodeErrors)
+		}
+		if got, want := received.Load(), int64(senders*perSender); got != want {
+			t.Errorf("compressed=%v: server received %d messages, want %d", compressed, got, want)
+		}
+	}
+}
+
+func TestSendMessageWriteTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	// accept the connection but never read from it
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	defer func() {
+		select {
+		case conn := <-accepted:
+			conn.Close()
+		default:
+		}
+	}()
+
+	c, err := ConnectVersion(listener.Addr().String(), 2)
+	if err != nil {
+		t.Fatalf("ConnectVersion() error = %v", err)
+	}
+	defer c.CloseNow()
+	c.WriteTimeout = 50 * time.Millisecond
+
+	m := &Message{Raw: strings.Repeat("x", 1<<20)}
+	start := time.Now()
+	for i := 0; i < 256; i++ {
+		if err = c.SendMessage(m); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("SendMessage() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("SendMessage() took %v to time out", elapsed)
+	}
+	if got := c.Stats().SendErrors; got != 1 {
+		t.Errorf("Stats().SendErrors = %d, want 1", got)
+	}
+}
+
+func TestConnSendFile(t *testing.T) {
+	content := "Exception in thread \"main\" java.lang.NullPointerException\n" +
+		strings.Repeat("\tat com.example.App.run(App.java:42)\n", 5000)
+	path := filepath.Join(t.TempDir(), "trace.log")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		compressed bool
+		m          *Message
+		wantSource string
+	}{
+		{"no template", false, nil, path},
+		{"compressed", true, nil, path},
+		{"template", false, &Message{Index: "main", Source: "app", Raw: "ignored", Fields: map[string]string{"env": "test"}}, "app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan *Message, 1)
+			s := startTestServerWith(t, withCompression)
+			s.Logger = nil
+			s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+				received <- m.Clone()
+				return nil
+			})
+
+			c, err := Connect(s.listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+			c.Compressed = tt.compressed
+
+			if err := c.SendFile(tt.m, path); err != nil {
+				t.Fatalf("SendFile() error = %v", err)
+			}
+			select {
+			case m := <-received:
+				if m.Raw != content {
+					t.Errorf("Raw has %d bytes, want the %d bytes of the file", len(m.Raw), len(content))
+				}
+				if m.Source != tt.wantSource {
+					t.Errorf("Source = %q, want %q", m.Source, tt.wantSource)
+				}
+				if tt.m != nil && (m.Index != tt.m.Index || m.Fields["env"] != "test") {
+					t.Errorf("message = %v, want the metadata and fields of %v", m, tt.m)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for the file")
+			}
+			if got := c.Stats().MessagesSent; got != 1 {
+				t.Errorf("Stats().MessagesSent = %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestConnSendMessageReaderShort(t *testing.T) {
+	var messages <-chan *Message
+	s := startTestServerWith(t, func(s *Server) { messages = s.Messages() })
+	s.Logger = nil
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.SendString("before"); err != nil {
+		t.Fatalf("SendString() error = %v", err)
+	}
+
+	err = c.SendMessageReader(&Message{}, strings.NewReader("short"), 100)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("SendMessageReader() error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if err := c.SendString("after"); err == nil {
+		t.Error("SendString() after an incomplete message error = nil, want the connection closed")
+	}
+	select {
+	case m := <-messages:
+		if m.Raw != "before" {
+			t.Errorf("Raw = %q, want %q", m.Raw, "before")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the first message")
+	}
+	select {
+	case m := <-messages:
+		t.Errorf("received %q after an incomplete message, want nothing", m.Raw)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestConnSendFileNotRegular(t *testing.T) {
+	endpoint := startMockIndexer(t, func(conn net.Conn) {})
+	c, err := ConnectVersion(endpoint, 2)
+	if err != nil {
+		t.Fatalf("ConnectVersion() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.SendFile(nil, t.TempDir()); !errors.Is(err, ErrNotRegularFile) {
+		t.Errorf("SendFile() error = %v, want %v", err, ErrNotRegularFile)
+	}
+}
+
+func TestConnHandshake(t *testing.T) {
+	tests := []struct {
+		name     string
+		response []byte
+		wantErr  bool
+	}{
+		{"success", encodeControl(t, "cap_response=success;channel_limit=10"), false},
+		{"invalid response", []byte{0, 0, 0, 8, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan string, 1)
+			endpoint := startMockIndexer(t, func(conn net.Conn) {
+				m := &Message{}
+				if err := m.Read(conn); err != nil {
+					return
+				}
+				if _, err := conn.Write(tt.response); err != nil {
+					return
+				}
+				for m.Read(conn) == nil {
+					received <- m.Raw
+				}
+			})
+
+			c, err := Connect(endpoint)
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+
+			err = c.Handshake()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Handshake() error = nil, want an error")
+				}
+				if got := c.LastError(); got != err {
+					t.Errorf("LastError() = %v, want %v", got, err)
+				}
+				if got := c.Stats().MessagesSent; got != 0 {
+					t.Errorf("Stats().MessagesSent = %d, want 0", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Handshake() error = %v", err)
+			}
+			if c.Capabilities.ChannelLimit != 10 {
+				t.Errorf("Capabilities.ChannelLimit = %d, want 10", c.Capabilities.ChannelLimit)
+			}
+			if err := c.Handshake(); err != nil {
+				t.Errorf("second Handshake() error = %v", err)
+			}
+
+			// sending does not repeat the handshake
+			if err := c.SendString("event"); err != nil {
+				t.Fatalf("SendString() error = %v", err)
+			}
+			select {
+			case raw := <-received:
+				if raw != "event" {
+					t.Errorf("received %q, want %q", raw, "event")
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for event")
+			}
+		})
+	}
+}
+
+// encodeControl returns an encoded server control message
+func encodeControl(t *testing.T, value string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	m := &Message{Fields: map[string]string{controlMsgKey: value}}
+	if err := m.Write(&buf); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestParseThrottle(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields map[string]string
+		want   time.Duration
+		wantOk bool
+	}{
+		{"pause", map[string]string{controlMsgKey: "throttle=250"}, 250 * time.Millisecond, true},
+		{"resume", map[string]string{controlMsgKey: "throttle=0"}, 0, true},
+		{"capped", map[string]string{controlMsgKey: "throttle=3600000"}, maxThrottle, true},
+		{"overflow", map[string]string{controlMsgKey: "throttle=9223372036854775807"}, maxThrottle, true},
+		{"negative", map[string]string{controlMsgKey: "throttle=-1"}, 0, false},
+		{"invalid", map[string]string{controlMsgKey: "throttle=soon"}, 0, false},
+		{"other control", map[string]string{controlMsgKey: heartbeatValue}, 0, false},
+		{"event", map[string]string{"throttle": "250"}, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseThrottle(&Message{Fields: tt.fields})
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseThrottle() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestConnThrottle(t *testing.T) {
+	const (
+		pause    = 300 * time.Millisecond
+		messages = 5
+	)
+	tests := []struct {
+		name         string
+		obeyThrottle bool
+		sendRaw      bool
+		wantSlow     bool
+	}{
+		{"obeyed", true, false, true},
+		{"obeyed raw", true, true, true},
+		{"ignored", false, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// encode on the test goroutine, since encodeControl may call t.Fatalf
+			capabilities := encodeControl(t, "cap_response=success")
+			throttle := encodeControl(t, fmt.Sprintf("throttle=%d", pause.Milliseconds()))
+			throttled := make(chan struct{})
+			endpoint := startMockIndexer(t, func(conn net.Conn) {
+				m := &Message{}
+				if err := m.Read(conn); err != nil {
+					return
+				}
+				if _, err := conn.Write(capabilities); err != nil {
+					return
+				}
+				// throttle the client after its first event
+				if err := m.Read(conn); err != nil {
+					return
+				}
+				if _, err := conn.Write(throttle); err != nil {
+					return
+				}
+				close(throttled)
+				for m.Read(conn) == nil {
+				}
+			})
+
+			c, err := Connect(endpoint)
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+			c.ObeyThrottle = tt.obeyThrottle
+
+			if err := c.SendString("first"); err != nil {
+				t.Fatalf("SendString() error = %v", err)
+			}
+			<-throttled
+			if tt.obeyThrottle {
+				deadline := time.Now().Add(time.Second)
+				for !c.Throttled() && time.Now().Before(deadline) {
+					time.Sleep(time.Millisecond)
+				}
+				if !c.Throttled() {
+					t.Fatal("Throttled() = false, want true")
+				}
+			} else {
+				time.Sleep(50 * time.Millisecond)
+				if c.Throttled() {
+					t.Error("Throttled() = true, want false")
+				}
+			}
+
+			start := time.Now()
+			for i := range messages {
+				m := &Message{Raw: fmt.Sprintf("event %d", i)}
+				if tt.sendRaw {
+					b, err := MarshalMessage(m)
+					if err != nil {
+						t.Fatalf("MarshalMessage() error = %v", err)
+					}
+					if err := c.SendRaw(b); err != nil {
+						t.Fatalf("SendRaw() error = %v", err)
+					}
+				} else if err := c.SendMessage(m); err != nil {
+					t.Fatalf("SendMessage() error = %v", err)
+				}
+			}
+			elapsed := time.Since(start)
+			if slow := elapsed >= pause/2; slow != tt.wantSlow {
+				t.Errorf("sending %d messages took %v, want slow = %t", messages, elapsed, tt.wantSlow)
+			}
+			if c.Throttled() {
+				t.Error("Throttled() after sending = true, want false")
+			}
+		})
+	}
+}
+
+func TestConnReconnect(t *testing.T) {
+	first := startTestServer(t)
+	endpoint := first.listener.Addr().String()
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.DefaultIndex = "reconnected"
+	if err := c.SendString("before restart"); err != nil {
+		t.Fatalf("SendString() error = %v", err)
+	}
+	// stop the server without waiting for the client, then restart it on the same address
+	first.StopTimeout = time.Millisecond
+	if err := first.Stop(); !errors.Is(err, ErrStopTimeout) {
+		t.Fatalf("Stop() error = %v, want %v", err, ErrStopTimeout)
+	}
+
+	second := NewServer(endpoint)
+	messages := second.Messages()
+	if err := second.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer second.Stop()
+
+	if err := c.Reconnect(); err != nil {
+		t.Fatalf("Reconnect() error = %v", err)
+	}
+	for i := range 3 {
+		if err := c.SendString(fmt.Sprintf("after restart %d", i)); err != nil {
+			t.Fatalf("SendString() after Reconnect error = %v", err)
+		}
+	}
+	for i := range 3 {
+		select {
+		case m := <-messages:
+			if want := fmt.Sprintf("after restart %d", i); m.Raw != want {
+				t.Errorf("message %d Raw = %q, want %q", i, m.Raw, want)
+			}
+			if m.Index != c.DefaultIndex {
+				t.Errorf("message %d Index = %q, want %q", i, m.Index, c.DefaultIndex)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+	if got := c.Stats().MessagesSent; got != 4 {
+		t.Errorf("Stats().MessagesSent = %d, want 4", got)
+	}
+
+	c.Close()
+	if err := c.Reconnect(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Reconnect() after Close error = %v, want %v", err, net.ErrClosed)
+	}
+}
+
+func TestConnReconnectDialFails(t *testing.T) {
+	var messages <-chan *Message
+	s := startTestServerWith(t, func(s *Server) { messages = s.Messages() })
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.SendString("before"); err != nil {
+		t.Fatalf("SendString() error = %v", err)
+	}
+
+	errDial := errors.New("dial failed")
+	c.dial = func(context.Context) (net.Conn, error) { return nil, errDial }
+	if err := c.Reconnect(); !errors.Is(err, errDial) {
+		t.Fatalf("Reconnect() error = %v, want %v", err, errDial)
+	}
+	if err := c.SendString("after"); err != nil {
+		t.Fatalf("SendString() after failed Reconnect error = %v", err)
+	}
+	for _, want := range []string{"before", "after"} {
+		select {
+		case m := <-messages:
+			if m.Raw != want {
+				t.Errorf("Raw = %q, want %q", m.Raw, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestConnReconnectUnsupported(t *testing.T) {
+	s := startTestServer(t)
+	endpoint := s.listener.Addr().String()
+
+	acked, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer acked.Close()
+	acked.UseAck = true
+	if err := acked.Reconnect(); !errors.Is(err, ErrCannotRedial) {
+		t.Errorf("Reconnect() with UseAck error = %v, want %v", err, ErrCannotRedial)
+	}
+
+	piped, messages := ConnectPipe()
+	go func() {
+		for range messages {
+		}
+	}()
+	defer piped.Close()
+	if err := piped.Reconnect(); !errors.Is(err, ErrCannotRedial) {
+		t.Errorf("Reconnect() of piped conn error = %v, want %v", err, ErrCannotRedial)
+	}
+}
+
+func TestHandshakeTimeoutRedialsV2(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer listener.Close()
+
+	// the indexer reads the capabilities request but never responds, as v2
+	// indexers do, and then accepts events on the next connection
+	versions := make(chan int, 2)
+	received := make(chan *Message, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				h, err := ReadHandshake(conn)
+				if err != nil {
+					return
+				}
+				versions <- h.Version
+				for {
+					m := &Message{}
+					if err := m.Read(conn); err != nil {
+						return
+					}
+					if h.Version == 2 {
+						received <- m
+					}
+				}
+			}()
+		}
+	}()
+
+	c, err := Connect(listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.HandshakeTimeout = 50 * time.Millisecond
+
+	if err := c.SendString("event"); err != nil {
+		t.Fatalf("SendString() error = %v", err)
+	}
+	if c.Version != 2 {
+		t.Errorf("Version = %d, want 2", c.Version)
+	}
+	for i, want := range []int{3, 2} {
+		if got := <-versions; got != want {
+			t.Errorf("connection %d signature version = %d, want %d", i, got, want)
+		}
+	}
+	select {
+	case m := <-received:
+		if m.Raw != "event" {
+			t.Errorf("Raw = %q, want %q", m.Raw, "event")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message on the v2 connection")
+	}
+}
+
+func TestHandshakeTimeoutCannotRedial(t *testing.T) {
+	tests := []struct {
+		name   string
+		useAck bool
+		noDial bool
+	}{
+		{"no dialer", false, true},
+		{"acknowledgements", true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := startMockIndexer(t, func(conn net.Conn) {
+				io.Copy(io.Discard, conn)
+			})
+
+			c, err := Connect(endpoint)
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+			c.HandshakeTimeout = 50 * time.Millisecond
+			c.UseAck = tt.useAck
+			if tt.noDial {
+				c.dial = nil
+			}
+
+			if err := c.Handshake(); !errors.Is(err, ErrNoCapabilities) {
+				t.Errorf("Handshake() error = %v, want %v", err, ErrNoCapabilities)
+			}
+			if c.Version != 3 {
+				t.Errorf("Version = %d, want 3", c.Version)
 			}
 		})
 	}
@@ -0,0 +1,148 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// capabilitiesKey is the field used by clients to advertise v3 capabilities
+	capabilitiesKey = "__s2s_capabilities"
+
+	// controlMsgKey is the field used by servers for v3 control messages
+	controlMsgKey = "__s2s_control_msg"
+
+	// heartbeatValue is the control message sent by clients to keep a connection alive
+	heartbeatValue = "heartbeat=1"
+
+	// disconnectValue is the control message sent by clients before closing a connection
+	disconnectValue = "disconnect=1"
+
+	// throttleKey is the control value used by servers to ask clients to pause
+	// sending for a number of milliseconds, or to resume sending if it is 0
+	throttleKey = "throttle"
+
+	// maxThrottle caps how long a single throttle control message pauses sending
+	maxThrottle = time.Minute
+)
+
+// parseControlValues parses a control message value of the form "k1=v1;k2=v2"
+func parseControlValues(s string) map[string]string {
+	values := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(part, "=")
+		values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return values
+}
+
+// parseThrottle returns how long a server's throttle control message asks a
+// client to pause sending, and false if the message is not a throttle
+func parseThrottle(m *Message) (time.Duration, bool) {
+	if !isControlMessage(m) {
+		return 0, false
+	}
+	v, ok := parseControlValues(m.Fields[controlMsgKey])[throttleKey]
+	if !ok {
+		return 0, false
+	}
+	ms, err := strconv.Atoi(v)
+	if err != nil || ms < 0 {
+		return 0, false
+	}
+	// clamp before converting, so that a huge value cannot overflow
+	return time.Duration(min(ms, int(maxThrottle/time.Millisecond))) * time.Millisecond, true
+}
+
+// isControlMessage returns true if the message is a v3 control message
+func isControlMessage(m *Message) bool {
+	if m.Raw != "" {
+		return false
+	}
+	_, isCapabilities := m.Fields[capabilitiesKey]
+	_, isControl := m.Fields[controlMsgKey]
+	return isCapabilities || isControl
+}
+
+// Capabilities are the protocol capabilities negotiated with a server.
+// ChannelLimit (channel_limit) caps the channels a Conn can have open with
+// OpenChannel, and PipelineLevel (pl) caps the connections a Pool makes to
+// the server. Zero means the server did not advertise a limit.
+type Capabilities struct {
+	Version            int
+	V4                 bool
+	ChannelLimit       int
+	PipelineLevel      int
+	FlushKey           bool
+	CanSendHeartbeat   bool
+	CanReceiveToken    bool
+	RequestCertificate bool
+	Compression        bool
+}
+
+// DefaultServerCapabilities are the capabilities advertised by a Server.
+// Set CanReceiveToken or Compression in a Server's Capabilities to let
+// clients open Channels or compress the connection.
+// from pcap: "cap_response=success;cap_flush_key=true;idx_can_send_hb=true;idx_can_recv_token=true;request_certificate=true;v4=true;channel_limit=300;pl=7"
+var DefaultServerCapabilities = Capabilities{
+	Version:       3,
+	ChannelLimit:  300,
+	PipelineLevel: 7,
+}
+
+// String returns the capabilities formatted as a server control message
+func (c Capabilities) String() string {
+	response := "success"
+	if c.Version < 3 {
+		response = "failure"
+	}
+	s := fmt.Sprintf("cap_response=%s;cap_flush_key=%t;idx_can_send_hb=%t;idx_can_recv_token=%t;request_certificate=%t;v4=%t;channel_limit=%d;pl=%d",
+		response, c.FlushKey, c.CanSendHeartbeat, c.CanReceiveToken, c.RequestCertificate, c.V4, c.ChannelLimit, c.PipelineLevel)
+	if c.Compression {
+		s += ";compression=1"
+	}
+	return s
+}
+
+// parseCapabilities parses a server's capabilities response. The version is
+// 3 if the server responded successfully, otherwise it is 2.
+func parseCapabilities(s string) Capabilities {
+	values := parseControlValues(s)
+	caps := Capabilities{
+		Version:            2,
+		V4:                 values["v4"] == "true",
+		FlushKey:           values["cap_flush_key"] == "true",
+		CanSendHeartbeat:   values["idx_can_send_hb"] == "true",
+		CanReceiveToken:    values["idx_can_recv_token"] == "true",
+		RequestCertificate: values["request_certificate"] == "true",
+		Compression:        values["compression"] == "1",
+	}
+	if values["cap_response"] == "success" {
+		caps.Version = 3
+	}
+	caps.ChannelLimit, _ = strconv.Atoi(values["channel_limit"])
+	caps.PipelineLevel, _ = strconv.Atoi(values["pl"])
+	return caps
+}
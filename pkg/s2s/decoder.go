@@ -0,0 +1,159 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Decoder reads messages from a splunk-to-splunk stream, such as a capture
+// file or pipe. A protocol signature at the start of the stream is skipped.
+// If SkipControl is set, v3 control messages are skipped too. Messages that
+// exceed Limits return ErrInvalidData. Errors for malformed messages give
+// their offset from the start of the stream. If ParseMeta is set, indexed
+// fields packed into _meta are unpacked into Fields. If LenientDecode is set,
+// messages are accepted once all of their fields are read, even if the padding
+// and trailer that should follow them are missing, as in captures from some
+// older senders; a warning is logged to Logger if it is not nil. Metadata is
+// decoded using MetadataKeys, or DefaultMetadataKeys if it is nil.
+type Decoder struct {
+	SkipControl   bool
+	ParseMeta     bool
+	LenientDecode bool
+	Limits        DecodeLimits
+	MetadataKeys  *MetadataKeys
+	Logger        Logger
+	r             *bufio.Reader
+	closers       []io.Closer
+	started       bool
+	offset        int64
+	counter       countingReader
+	buf           readBuffer
+}
+
+// NewDecoder creates a new Decoder that reads from r, which may be any
+// stream, such as a network connection or a gzip.Reader
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:   bufio.NewReader(r),
+		buf: readBuffer{strings: make(map[string]string)},
+	}
+}
+
+// OpenCaptureFile opens a capture file and returns a Decoder that reads from
+// it. Files ending in ".gz" are decompressed as they are read. The Decoder
+// must be closed to close the file.
+func OpenCaptureFile(path string) (*Decoder, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		d := NewDecoder(file)
+		d.closers = []io.Closer{file}
+		return d, nil
+	}
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	d := NewDecoder(zr)
+	d.closers = []io.Closer{zr, file}
+	return d, nil
+}
+
+// Close closes the file opened by OpenCaptureFile. It does nothing for a
+// Decoder created with NewDecoder.
+func (d *Decoder) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	d.closers = nil
+	return err
+}
+
+// Decode reads the next message from the stream into m. It returns io.EOF
+// if the stream ends between messages, and io.ErrUnexpectedEOF if it ends in
+// the middle of the signature or a message. The Fields map of m is cleared
+// and reused, so decoding each message into the same m avoids most allocations.
+func (d *Decoder) Decode(m *Message) error {
+	if m == nil {
+		return ErrNilMessage
+	}
+	if !d.started {
+		d.started = true
+		if isSignature(d.r) {
+			if _, err := d.r.Discard(handshakeSize); err != nil {
+				return io.ErrUnexpectedEOF
+			}
+			d.offset = handshakeSize
+		}
+	}
+
+	for {
+		// a clean end of stream can only occur between messages
+		if _, err := d.r.Peek(1); err != nil {
+			return err
+		}
+		m.reset()
+		d.counter = countingReader{r: d.r}
+		err := decodeMessage(&d.counter, m, d.Limits, d.MetadataKeys, d.LenientDecode, d.offset, &d.buf)
+		d.offset += d.counter.n
+		if errors.Is(err, errNonstandardTrailer) {
+			if d.Logger != nil {
+				d.Logger.Printf("Warning: %v", err)
+			}
+			err = nil
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if d.SkipControl && isControlMessage(m) {
+			continue
+		}
+		if d.ParseMeta {
+			return unpackMeta(m)
+		}
+		return nil
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,460 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecoder(t *testing.T) {
+	messages := []*Message{
+		{Index: "main", Host: "host1", Raw: "first message"},
+		{Index: "main", Time: time.Unix(1700000000, 0), Raw: "second message", Fields: map[string]string{"key": "value"}},
+		{SourceType: "type3", Raw: "third message"},
+	}
+	var plain bytes.Buffer
+	for _, m := range messages {
+		if err := m.Write(&plain); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	stream := encodeStream(t, messages)
+
+	tests := []struct {
+		name        string
+		input       []byte
+		skipControl bool
+		wantCount   int
+		wantErr     error
+	}{
+		{"messages only", plain.Bytes(), false, 3, io.EOF},
+		{"with signature", stream, true, 3, io.EOF},
+		{"with control message", stream, false, 4, io.EOF},
+		{"truncated", plain.Bytes()[:plain.Len()-10], false, 2, io.ErrUnexpectedEOF},
+		{"signature only", stream[:handshakeSize], false, 0, io.EOF},
+		{"truncated signature", stream[:100], false, 0, io.ErrUnexpectedEOF},
+		{"empty", nil, false, 0, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dec := NewDecoder(bytes.NewReader(tt.input))
+			dec.SkipControl = tt.skipControl
+
+			var got []*Message
+			var err error
+			for {
+				m := &Message{}
+				if err = dec.Decode(m); err != nil {
+					break
+				}
+				got = append(got, m)
+			}
+			if err != tt.wantErr {
+				t.Errorf("Decode() error = %v, want %v", err, tt.wantErr)
+			}
+			if len(got) != tt.wantCount {
+				t.Fatalf("Decode() returned %d messages, want %d", len(got), tt.wantCount)
+			}
+
+			// the control message, if present, precedes the events
+			got = got[len(got)-min(len(got), len(messages)):]
+			for i, m := range got {
+				if !m.Equal(messages[i]) {
+					t.Errorf("message %d = %v, want %v", i, m, messages[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	messages := []*Message{
+		{Index: "main", Host: "host1", Raw: "first message"},
+		{Index: "main", Time: time.Unix(1700000000, 0), Raw: "second message", Fields: map[string]string{"key": "value"}},
+		{SourceType: "type3", Raw: "third message"},
+	}
+
+	for _, version := range []int{2, 3} {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.Version = version
+		for _, m := range messages {
+			if err := enc.Encode(m); err != nil {
+				t.Fatalf("Encode() error = %v", err)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Encode() wrote %d bytes before Flush(), want 0", buf.Len())
+		}
+		if err := enc.Flush(); err != nil {
+			t.Fatalf("Flush() error = %v", err)
+		}
+
+		if want := fmt.Sprintf("--splunk-cooked-mode-v%d--", version); !bytes.HasPrefix(buf.Bytes(), []byte(want)) {
+			t.Errorf("stream does not start with signature %q", want)
+		}
+
+		dec := NewDecoder(&buf)
+		for i, want := range messages {
+			got := &Message{}
+			if err := dec.Decode(got); err != nil {
+				t.Fatalf("Decode() error = %v", err)
+			}
+			if !got.Equal(want) {
+				t.Errorf("message %d = %v, want %v", i, got, want)
+			}
+		}
+		if err := dec.Decode(&Message{}); err != io.EOF {
+			t.Errorf("Decode() at end error = %v, want %v", err, io.EOF)
+		}
+	}
+}
+
+func TestDecoderErrorOffset(t *testing.T) {
+	messages := []*Message{{Raw: "first message"}, {Raw: "second message"}}
+	stream := encodeStream(t, messages)
+	// corrupt the null terminator at the end of the last message
+	stream[len(stream)-1] = 'b'
+
+	dec := NewDecoder(bytes.NewReader(stream))
+	dec.SkipControl = true
+	var err error
+	for err == nil {
+		err = dec.Decode(&Message{})
+	}
+	if !errors.Is(err, ErrInvalidData) {
+		t.Fatalf("Decode() error = %v, want %v", err, ErrInvalidData)
+	}
+	want := fmt.Sprintf("at offset %d", len(stream)-1)
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("Decode() error = %q, want it to contain %q", err, want)
+	}
+}
+
+// trimTrailer encodes a message and removes n bytes starting from bytes
+// before its end, adjusting its size, as some older senders do
+func trimTrailer(t *testing.T, m *Message, from, n int) []byte {
+	t.Helper()
+	b, err := MarshalMessage(m)
+	if err != nil {
+		t.Fatalf("MarshalMessage() error = %v", err)
+	}
+	start := len(b) - from
+	b = append(b[:start], b[start+n:]...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-4))
+	return b
+}
+
+func TestDecoderLenient(t *testing.T) {
+	messages := []*Message{
+		{Index: "main", Raw: "no padding"},
+		{Index: "main", Raw: "standard"},
+		{Index: "main", Raw: "no padding or trailer"},
+	}
+	var stream []byte
+	stream = append(stream, trimTrailer(t, messages[0], len(rawTrailer), 4)...)
+	standard, _ := MarshalMessage(messages[1])
+	stream = append(stream, standard...)
+	stream = append(stream, trimTrailer(t, messages[2], len(rawTrailer), len(rawTrailer))...)
+
+	// strict decoding rejects the missing padding
+	if err := NewDecoder(bytes.NewReader(stream)).Decode(&Message{}); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("Decode() error = %v, want %v", err, ErrInvalidData)
+	}
+
+	logger := &captureLogger{}
+	dec := NewDecoder(bytes.NewReader(stream))
+	dec.LenientDecode = true
+	dec.Logger = logger
+	for i, want := range messages {
+		got := &Message{}
+		if err := dec.Decode(got); err != nil {
+			t.Fatalf("Decode() message %d error = %v", i, err)
+		}
+		if !got.Equal(want) {
+			t.Errorf("Decode() message %d = %v, want %v", i, got, want)
+		}
+	}
+	if err := dec.Decode(&Message{}); err != io.EOF {
+		t.Errorf("Decode() at end error = %v, want %v", err, io.EOF)
+	}
+	if len(logger.messages) != 2 {
+		t.Errorf("logged %q, want 2 warnings", logger.messages)
+	}
+}
+
+// gzipBytes returns b compressed with gzip
+func gzipBytes(t *testing.T, b []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(b); err != nil {
+		t.Fatalf("gzip Write() error = %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzip Close() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decodeAll decodes data messages until the end of the stream
+func decodeAll(t *testing.T, dec *Decoder) []*Message {
+	t.Helper()
+	dec.SkipControl = true
+	var got []*Message
+	for {
+		m := &Message{}
+		err := dec.Decode(m)
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+		got = append(got, m)
+	}
+}
+
+func TestDecoderGzip(t *testing.T) {
+	messages := []*Message{
+		{Index: "main", Raw: "first message"},
+		{Index: "main", Raw: "second message", Fields: map[string]string{"key": "value"}},
+	}
+	stream := encodeStream(t, messages)
+	compressed := gzipBytes(t, stream)
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatalf("gzip.NewReader() error = %v", err)
+	}
+	if got := decodeAll(t, NewDecoder(zr)); !slices.EqualFunc(got, messages, (*Message).Equal) {
+		t.Errorf("Decode() = %v, want %v", got, messages)
+	}
+
+	// capture files are only decompressed if they end in .gz
+	dir := t.TempDir()
+	files := map[string][]byte{"capture.s2s": stream, "capture.s2s.gz": compressed}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		dec, err := OpenCaptureFile(path)
+		if err != nil {
+			t.Fatalf("OpenCaptureFile(%s) error = %v", name, err)
+		}
+		if got := decodeAll(t, dec); !slices.EqualFunc(got, messages, (*Message).Equal) {
+			t.Errorf("OpenCaptureFile(%s) decoded %v, want %v", name, got, messages)
+		}
+		if err := dec.Close(); err != nil {
+			t.Errorf("Close() error = %v", err)
+		}
+	}
+
+	if _, err := OpenCaptureFile(filepath.Join(dir, "missing.gz")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("OpenCaptureFile() error = %v, want %v", err, os.ErrNotExist)
+	}
+}
+
+// repeatReader endlessly repeats a byte slice
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := copy(p, r.data[r.off:])
+	r.off = (r.off + n) % len(r.data)
+	return n, nil
+}
+
+// benchmarkMessage returns an encoded message typical of forwarded events
+func benchmarkMessage(tb testing.TB) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	m := &Message{
+		Index:      "main",
+		Host:       "web-01",
+		Source:     "/var/log/access.log",
+		SourceType: "access_combined",
+		Time:       time.Unix(1700000000, 0),
+		Fields:     map[string]string{"env": "prod", "region": "us-east-1"},
+		Raw:        `127.0.0.1 - - [14/Nov/2023:22:13:20 +0000] "GET / HTTP/1.1" 200 512`,
+	}
+	if err := m.Write(&buf); err != nil {
+		tb.Fatalf("Write() error = %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecoderAllocs(t *testing.T) {
+	data := benchmarkMessage(t)
+	r := bytes.NewReader(data)
+	m := &Message{}
+	perMessage := testing.AllocsPerRun(100, func() {
+		r.Reset(data)
+		if err := DecodeMessage(r, m); err != nil {
+			t.Fatalf("DecodeMessage() error = %v", err)
+		}
+	})
+
+	dec := NewDecoder(&repeatReader{data: data})
+	dec.Decode(m)
+	reused := testing.AllocsPerRun(100, func() {
+		if err := dec.Decode(m); err != nil {
+			t.Fatalf("Decode() error = %v", err)
+		}
+	})
+	if reused >= perMessage {
+		t.Errorf("Decode() allocs = %v, want fewer than DecodeMessage() allocs = %v", reused, perMessage)
+	}
+}
+
+func BenchmarkDecodeMessage(b *testing.B) {
+	b.Run("typical", func(b *testing.B) {
+		benchmarkDecodeMessage(b, benchmarkMessage(b))
+	})
+	for _, bc := range benchmarkSizes {
+		b.Run(bc.name, func(b *testing.B) {
+			data, err := MarshalMessage(newBenchmarkMessage(bc.rawSize, bc.fields))
+			if err != nil {
+				b.Fatalf("MarshalMessage() error = %v", err)
+			}
+			benchmarkDecodeMessage(b, data)
+		})
+	}
+}
+
+// benchmarkDecodeMessage decodes an encoded message b.N times
+func benchmarkDecodeMessage(b *testing.B, data []byte) {
+	r := bytes.NewReader(data)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		if err := DecodeMessage(r, &Message{}); err != nil {
+			b.Fatalf("DecodeMessage() error = %v", err)
+		}
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	data := benchmarkMessage(b)
+	dec := NewDecoder(&repeatReader{data: data})
+	m := &Message{}
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := dec.Decode(m); err != nil {
+			b.Fatalf("Decode() error = %v", err)
+		}
+	}
+}
+
+func TestEncoderRequireIndex(t *testing.T) {
+	tests := []struct {
+		name         string
+		requireIndex bool
+		index        string
+		wantErr      error
+	}{
+		{"default index allowed", false, "", nil},
+		{"explicit index", true, "main", nil},
+		{"missing index", true, "", ErrMissingIndex},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			enc := NewEncoder(&buf)
+			enc.RequireIndex = tt.requireIndex
+			if err := enc.Encode(&Message{Index: tt.index, Raw: "test"}); err != tt.wantErr {
+				t.Errorf("Encode() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestEncoderDecoderMetadataKeys(t *testing.T) {
+	custom := &MetadataKeys{
+		IndexKey:         "meta:index",
+		HostKey:          "meta:host",
+		SourceKey:        "meta:source",
+		SourceTypeKey:    "meta:sourcetype",
+		IndexPrefix:      "index=",
+		HostPrefix:       "host=",
+		SourcePrefix:     "source=",
+		SourceTypePrefix: "sourcetype=",
+	}
+	m := &Message{
+		Index:      "main",
+		Host:       "web01",
+		Source:     "/var/log/app.log",
+		SourceType: "app",
+		Fields:     map[string]string{"user": "alice"},
+		Raw:        "custom metadata",
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.MetadataKeys = custom
+	if err := enc.Encode(m); err != nil {
+		t.Fatalf("Encode() error = %v", err)
+	}
+	if err := enc.Encode(&Message{Fields: map[string]string{custom.HostKey: "x"}}); !errors.Is(err, ErrReservedField) {
+		t.Errorf("Encode() with custom key as field error = %v, want %v", err, ErrReservedField)
+	}
+	if err := enc.Flush(); err != nil {
+		t.Fatalf("Flush() error = %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("host=web01")) || bytes.Contains(buf.Bytes(), []byte("host::")) {
+		t.Errorf("stream does not use custom host prefix: %q", buf.Bytes())
+	}
+	stream := buf.Bytes()
+
+	dec := NewDecoder(bytes.NewReader(stream))
+	dec.MetadataKeys = custom
+	got := &Message{}
+	if err := dec.Decode(got); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !got.Equal(m) {
+		t.Errorf("Decode() = %v, want %v", got, m)
+	}
+
+	// the default keys treat custom metadata as ordinary fields
+	dec = NewDecoder(bytes.NewReader(stream))
+	got = &Message{}
+	if err := dec.Decode(got); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if got.Host != "" || got.Fields[custom.HostKey] != "host=web01" {
+		t.Errorf("Decode() with default keys Host = %q, %s = %q, want \"\", %q",
+			got.Host, custom.HostKey, got.Fields[custom.HostKey], "host=web01")
+	}
+}
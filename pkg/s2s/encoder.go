@@ -0,0 +1,72 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bufio"
+	"io"
+)
+
+// Encoder writes messages to a splunk-to-splunk stream, such as a capture
+// file or pipe, preceded by a protocol signature for Version identifying
+// Endpoint. Output is buffered until Flush is called. If RequireIndex is set,
+// messages without an Index return ErrMissingIndex. Metadata is encoded using
+// MetadataKeys, or DefaultMetadataKeys if it is nil.
+type Encoder struct {
+	Endpoint     string
+	Version      int
+	RequireIndex bool
+	MetadataKeys *MetadataKeys
+	w            *bufio.Writer
+	started      bool
+}
+
+// NewEncoder creates a new Encoder that writes a v3 signature to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		Endpoint: "localhost:0",
+		Version:  3,
+		w:        bufio.NewWriter(w),
+	}
+}
+
+// Encode writes a message to the stream, writing the signature first if
+// this is the first message
+func (e *Encoder) Encode(m *Message) error {
+	if m == nil {
+		return ErrNilMessage
+	}
+	if e.RequireIndex && m.Index == "" {
+		return ErrMissingIndex
+	}
+	if !e.started {
+		if err := writeSignature(e.w, e.Endpoint, e.Version); err != nil {
+			return err
+		}
+		e.started = true
+	}
+	return encodeMessage(e.w, m, e.MetadataKeys, len(m.Raw), func(w io.Writer) error {
+		_, err := io.WriteString(w, m.Raw)
+		return err
+	})
+}
+
+// Flush writes any buffered data to the underlying writer
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
@@ -0,0 +1,37 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s_test
+
+import (
+	"log"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+func ExampleHandlerFunc() {
+	server := s2s.NewServer("localhost:9997")
+	server.Handler = s2s.HandlerFunc(func(info s2s.ConnInfo, m *s2s.Message) error {
+		log.Printf("%s sent %q to index %s", info.ServerName, m.Raw, m.Index)
+		return nil
+	})
+
+	if err := server.Start(); err != nil {
+		log.Fatalf("Failed to start S2S server: %v", err)
+	}
+	defer server.Stop()
+}
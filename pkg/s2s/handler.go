@@ -0,0 +1,163 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// DefaultMessageBufferSize is the default buffer size of Server.Messages
+const DefaultMessageBufferSize = 100
+
+// ErrMessageDropped is returned when a message is dropped because a consumer is too slow
+var ErrMessageDropped = errors.New("message dropped: channel is full")
+
+// ConnInfo describes the client connection a message was received on,
+// including the server name and management port from its handshake
+type ConnInfo struct {
+	RemoteAddr     net.Addr
+	Version        int
+	ServerName     string
+	ManagementPort string
+}
+
+// Handler processes messages received by a Server. The message is reused
+// after HandleMessage returns, so handlers that keep it must Clone it.
+type Handler interface {
+	HandleMessage(info ConnInfo, m *Message) error
+}
+
+// DisconnectReason classifies why a client connection was closed
+type DisconnectReason int
+
+const (
+	// DisconnectClosed means the client closed the connection cleanly
+	DisconnectClosed DisconnectReason = iota
+	// DisconnectNetworkError means the connection failed or timed out
+	DisconnectNetworkError
+	// DisconnectProtocolError means the client sent data that could not be
+	// decoded, such as bad framing or an oversized field
+	DisconnectProtocolError
+)
+
+// String returns a description of the reason
+func (r DisconnectReason) String() string {
+	switch r {
+	case DisconnectClosed:
+		return "closed by client"
+	case DisconnectNetworkError:
+		return "network error"
+	case DisconnectProtocolError:
+		return "protocol error"
+	}
+	return fmt.Sprintf("DisconnectReason(%d)", int(r))
+}
+
+// disconnectReason classifies the error that ended a connection, where nil
+// means it was closed cleanly
+func disconnectReason(err error) DisconnectReason {
+	var netErr net.Error
+	switch {
+	case err == nil || errors.Is(err, io.EOF):
+		return DisconnectClosed
+	case errors.As(err, &netErr) || errors.Is(err, net.ErrClosed):
+		return DisconnectNetworkError
+	}
+	return DisconnectProtocolError
+}
+
+// DisconnectHandler may be implemented by a Handler to be told when a client
+// connection that completed its handshake is closed, and why
+type DisconnectHandler interface {
+	OnDisconnect(info ConnInfo, reason DisconnectReason)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface
+type HandlerFunc func(info ConnInfo, m *Message) error
+
+// HandleMessage calls f(info, m)
+func (f HandlerFunc) HandleMessage(info ConnInfo, m *Message) error {
+	return f(info, m)
+}
+
+// PrintHandler is a Handler that prints each received message to stdout, as
+// the s2s command does in server mode
+var PrintHandler = HandlerFunc(func(info ConnInfo, m *Message) error {
+	fmt.Printf("Received message: %s\n", m.String())
+	return nil
+})
+
+// channelHandler is a Handler that delivers messages to a channel
+type channelHandler struct {
+	ch     chan *Message
+	drop   bool
+	stop   <-chan struct{}
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newChannelHandler creates a channelHandler that stops blocking when stop is closed
+func newChannelHandler(size int, drop bool, stop <-chan struct{}) *channelHandler {
+	return &channelHandler{
+		ch:   make(chan *Message, size),
+		drop: drop,
+		stop: stop,
+	}
+}
+
+// HandleMessage delivers the message to the channel, blocking until there is
+// room unless drop is enabled
+func (h *channelHandler) HandleMessage(info ConnInfo, m *Message) error {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if h.closed {
+		return ErrMessageDropped
+	}
+	// the server reuses m once this returns
+	m = m.Clone()
+
+	if h.drop {
+		select {
+		case h.ch <- m:
+			return nil
+		default:
+			return ErrMessageDropped
+		}
+	}
+
+	select {
+	case h.ch <- m:
+		return nil
+	case <-h.stop:
+		return ErrMessageDropped
+	}
+}
+
+// close closes the channel once no more messages are being delivered
+func (h *channelHandler) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed {
+		h.closed = true
+		close(h.ch)
+	}
+}
@@ -0,0 +1,92 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// signaturePrefix is the common prefix of all protocol signatures
+	signaturePrefix = "--splunk-cooked-mode-v"
+
+	// handshakeSize is the size of the signature, server name and management port
+	handshakeSize = signatureSize + serverNameSize + mgmtPortSize
+
+	signatureSize  = 128
+	serverNameSize = 256
+	mgmtPortSize   = 16
+)
+
+// ErrInvalidSignature is returned when a stream does not start with a protocol signature
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// Handshake is the protocol signature, server name and management port sent
+// by a client at the start of a splunk-to-splunk connection
+type Handshake struct {
+	Version        int
+	ServerName     string
+	ManagementPort string
+}
+
+// ReadHandshake reads a handshake from r. The signature is verified before
+// the rest of the handshake is read, and ErrInvalidSignature is returned if
+// it is not a v2 or v3 signature.
+func ReadHandshake(r io.Reader) (Handshake, error) {
+	var h Handshake
+	signature := make([]byte, signatureSize)
+	if _, err := io.ReadFull(r, signature); err != nil {
+		return h, err
+	}
+
+	// The signature includes null padding, so we need to trim it before comparing
+	sigStr := string(bytes.TrimRight(signature, "\x00"))
+	switch sigStr {
+	case "--splunk-cooked-mode-v2--":
+		h.Version = 2
+	case "--splunk-cooked-mode-v3--":
+		h.Version = 3
+	default:
+		return h, fmt.Errorf("%w: %q", ErrInvalidSignature, sigStr)
+	}
+
+	rest := make([]byte, serverNameSize+mgmtPortSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return h, err
+	}
+	h.ServerName = string(bytes.TrimRight(rest[:serverNameSize], "\x00"))
+	h.ManagementPort = string(bytes.TrimRight(rest[serverNameSize:], "\x00"))
+	return h, nil
+}
+
+// WriteHandshake writes a handshake to w. The server name and management
+// port are truncated if they do not fit in their null padded fields.
+func WriteHandshake(w io.Writer, h Handshake) error {
+	var buf [handshakeSize]byte
+	copy(buf[:signatureSize], fmt.Sprintf("%s%d--", signaturePrefix, h.Version))
+	copy(buf[signatureSize:signatureSize+serverNameSize], h.ServerName)
+	copy(buf[signatureSize+serverNameSize:], h.ManagementPort)
+	_, err := w.Write(buf[:])
+	return err
+}
@@ -0,0 +1,79 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadHandshake(t *testing.T) {
+	encode := func(h Handshake) []byte {
+		var buf bytes.Buffer
+		if err := WriteHandshake(&buf, h); err != nil {
+			t.Fatalf("WriteHandshake() error = %v", err)
+		}
+		return buf.Bytes()
+	}
+	v2 := Handshake{Version: 2, ServerName: "forwarder1", ManagementPort: "8089"}
+	v3 := Handshake{Version: 3, ServerName: "forwarder2", ManagementPort: "8090"}
+
+	tests := []struct {
+		name    string
+		input   []byte
+		want    Handshake
+		wantErr error
+	}{
+		{"v2", encode(v2), v2, nil},
+		{"v3", encode(v3), v3, nil},
+		{"invalid signature", encode(Handshake{Version: 9, ServerName: "bad"}), Handshake{}, ErrInvalidSignature},
+		{"not a signature", bytes.Repeat([]byte("x"), handshakeSize), Handshake{}, ErrInvalidSignature},
+		{"truncated signature", encode(v3)[:100], Handshake{}, io.ErrUnexpectedEOF},
+		{"truncated server name", encode(v3)[:signatureSize], Handshake{Version: 3}, io.ErrUnexpectedEOF},
+		{"empty", nil, Handshake{}, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ReadHandshake(bytes.NewReader(tt.input))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ReadHandshake() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ReadHandshake() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteHandshake(t *testing.T) {
+	var buf bytes.Buffer
+	h := Handshake{Version: 3, ServerName: "test-server", ManagementPort: "8089"}
+	if err := WriteHandshake(&buf, h); err != nil {
+		t.Fatalf("WriteHandshake() error = %v", err)
+	}
+	want := bytes.Join([][]byte{
+		createFixedSizeBytes("--splunk-cooked-mode-v3--", 128),
+		createFixedSizeBytes("test-server", 256),
+		createFixedSizeBytes("8089", 16),
+	}, nil)
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("WriteHandshake() = %v, want %v", buf.Bytes(), want)
+	}
+}
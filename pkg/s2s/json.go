@@ -0,0 +1,183 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TimeFormat determines how message times are represented in JSON
+type TimeFormat int
+
+const (
+	// TimeRFC3339 formats times as RFC 3339 strings with nanoseconds (the default)
+	TimeRFC3339 TimeFormat = iota
+	// TimeEpoch formats times as seconds since the Unix epoch, with a
+	// fractional part if the time is not a whole second
+	TimeEpoch
+)
+
+// jsonMessage is the JSON representation of a message
+type jsonMessage struct {
+	Index      string            `json:"index,omitempty"`
+	Host       string            `json:"host,omitempty"`
+	Source     string            `json:"source,omitempty"`
+	SourceType string            `json:"sourcetype,omitempty"`
+	Time       *jsonTime         `json:"time,omitempty"`
+	IndexTime  *jsonTime         `json:"indextime,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	Raw        string            `json:"raw"`
+}
+
+// jsonTime is a time that is marshaled using its format
+type jsonTime struct {
+	time.Time
+	format TimeFormat
+}
+
+// newJSONTime returns nil for the zero time, so that it is omitted
+func newJSONTime(t time.Time, format TimeFormat) *jsonTime {
+	if t.IsZero() {
+		return nil
+	}
+	return &jsonTime{t, format}
+}
+
+// MarshalJSON formats the time using its format
+func (t jsonTime) MarshalJSON() ([]byte, error) {
+	if t.format == TimeEpoch {
+		s := strconv.FormatInt(t.Unix(), 10)
+		if ns := t.Nanosecond(); ns != 0 {
+			s += strings.TrimRight(fmt.Sprintf(".%09d", ns), "0")
+		}
+		return []byte(s), nil
+	}
+	return json.Marshal(t.Format(time.RFC3339Nano))
+}
+
+// UnmarshalJSON parses a time in either RFC 3339 or epoch format
+func (t *jsonTime) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return err
+		}
+		t.Time = parsed
+		return nil
+	}
+
+	secs, frac, _ := bytes.Cut(b, []byte("."))
+	sec, err := strconv.ParseInt(string(secs), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid time %s", ErrInvalidData, b)
+	}
+	var nsec int64
+	if len(frac) > 0 {
+		if len(frac) > 9 {
+			frac = frac[:9]
+		}
+		nsec, err = strconv.ParseInt(string(frac)+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid time %s", ErrInvalidData, b)
+		}
+	}
+	t.Time = time.Unix(sec, nsec)
+	return nil
+}
+
+// MarshalJSON encodes the message as a JSON object, omitting empty metadata.
+// Times are formatted as RFC 3339 strings.
+func (m *Message) MarshalJSON() ([]byte, error) {
+	return m.JSON(TimeRFC3339)
+}
+
+// JSON encodes the message like MarshalJSON, formatting times using the given
+// format. UnmarshalJSON accepts either format.
+func (m *Message) JSON(format TimeFormat) ([]byte, error) {
+	var fields map[string]string
+	if len(m.Fields) > 0 {
+		fields = m.Fields
+	}
+	return json.Marshal(jsonMessage{
+		Index:      m.Index,
+		Host:       m.Host,
+		Source:     m.Source,
+		SourceType: m.SourceType,
+		Time:       newJSONTime(m.Time, format),
+		IndexTime:  newJSONTime(m.IndexTime, format),
+		Fields:     fields,
+		Raw:        m.Raw,
+	})
+}
+
+// UnmarshalJSON decodes a message from a JSON object created by MarshalJSON
+func (m *Message) UnmarshalJSON(b []byte) error {
+	var jm jsonMessage
+	if err := json.Unmarshal(b, &jm); err != nil {
+		return err
+	}
+	m.Clear()
+	m.Index = jm.Index
+	m.Host = jm.Host
+	m.Source = jm.Source
+	m.SourceType = jm.SourceType
+	m.Raw = jm.Raw
+	if jm.Time != nil {
+		m.Time = jm.Time.Time
+	}
+	if jm.IndexTime != nil {
+		m.IndexTime = jm.IndexTime.Time
+	}
+	for k, v := range jm.Fields {
+		m.Fields[k] = v
+	}
+	return nil
+}
+
+// StreamToJSON decodes messages from r and writes each one to w as a line of
+// JSON, holding no more than one message in memory at a time. A leading
+// protocol signature is skipped, as are v3 control messages. If the stream
+// ends in the middle of a message, all complete messages are written and
+// io.ErrUnexpectedEOF is returned.
+func StreamToJSON(r io.Reader, w io.Writer) error {
+	dec := NewDecoder(r)
+	dec.SkipControl = true
+	enc := json.NewEncoder(w)
+	m := &Message{}
+	for {
+		if err := dec.Decode(m); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// encodeStream encodes a signature, a capabilities message and the given messages
+func encodeStream(t *testing.T, messages []*Message) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := writeSignature(&buf, "test-server:8089", 3); err != nil {
+		t.Fatalf("writeSignature() error = %v", err)
+	}
+	caps := &Message{Fields: map[string]string{capabilitiesKey: "ack=0;compression=0"}}
+	if err := caps.Write(&buf); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	for _, m := range messages {
+		if err := m.Write(&buf); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestStreamToJSON(t *testing.T) {
+	messages := []*Message{
+		{Index: "main", Host: "host1", Raw: "first message"},
+		{Index: "main", Source: "source2", Raw: "second message", Fields: map[string]string{"key": "value"}},
+		{SourceType: "type3", Raw: "third message"},
+	}
+	stream := encodeStream(t, messages)
+
+	tests := []struct {
+		name      string
+		input     []byte
+		wantLines int
+		wantErr   error
+	}{
+		{"complete stream", stream, 3, nil},
+		{"truncated stream", stream[:len(stream)-10], 2, io.ErrUnexpectedEOF},
+		{"signature only", stream[:handshakeSize], 0, nil},
+		{"truncated signature", stream[:100], 0, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := StreamToJSON(bytes.NewReader(tt.input), &out)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("StreamToJSON() error = %v, want %v", err, tt.wantErr)
+			}
+
+			lines := 0
+			scanner := bufio.NewScanner(&out)
+			for scanner.Scan() {
+				var got Message
+				if err := json.Unmarshal(scanner.Bytes(), &got); err != nil {
+					t.Fatalf("json.Unmarshal() error = %v", err)
+				}
+				if got.String() != messages[lines].String() {
+					t.Errorf("line %d = %v, want %v", lines, got.String(), messages[lines].String())
+				}
+				lines++
+			}
+			if lines != tt.wantLines {
+				t.Errorf("StreamToJSON() wrote %d lines, want %d", lines, tt.wantLines)
+			}
+		})
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	populated := &Message{
+		Index:      "main",
+		Host:       "höst",
+		Source:     "/var/log/日志.log",
+		SourceType: "test",
+		Time:       time.Date(2024, 3, 1, 12, 30, 45, 123000000, time.UTC),
+		IndexTime:  time.Unix(1709296246, 0).UTC(),
+		Fields:     map[string]string{"user": "josé", "emoji": "✓"},
+		Raw:        "event with ünïcode",
+	}
+
+	tests := []struct {
+		name   string
+		m      *Message
+		format TimeFormat
+		want   string
+	}{
+		{"empty", &Message{Fields: map[string]string{}}, TimeRFC3339, `{"raw":""}`},
+		{"populated rfc3339", populated, TimeRFC3339,
+			`{"index":"main","host":"höst","source":"/var/log/日志.log","sourcetype":"test","time":"2024-03-01T12:30:45.123Z","indextime":"2024-03-01T12:30:46Z","fields":{"emoji":"✓","user":"josé"},"raw":"event with ünïcode"}`},
+		{"populated epoch", populated, TimeEpoch,
+			`{"index":"main","host":"höst","source":"/var/log/日志.log","sourcetype":"test","time":1709296245.123,"indextime":1709296246,"fields":{"emoji":"✓","user":"josé"},"raw":"event with ünïcode"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := tt.m.JSON(tt.format)
+			if err != nil {
+				t.Fatalf("JSON() error = %v", err)
+			}
+			if string(b) != tt.want {
+				t.Errorf("JSON() = %s, want %s", b, tt.want)
+			}
+			if tt.format == TimeRFC3339 {
+				if std, _ := json.Marshal(tt.m); string(std) != tt.want {
+					t.Errorf("json.Marshal() = %s, want %s", std, tt.want)
+				}
+			}
+
+			var got Message
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatalf("json.Unmarshal() error = %v", err)
+			}
+			if !got.Time.Equal(tt.m.Time) || !got.IndexTime.Equal(tt.m.IndexTime) {
+				t.Errorf("json.Unmarshal() times = %v, %v, want %v, %v", got.Time, got.IndexTime, tt.m.Time, tt.m.IndexTime)
+			}
+			if got.Fields == nil {
+				t.Error("json.Unmarshal() Fields = nil, want empty map")
+			}
+
+			again, err := got.JSON(tt.format)
+			if err != nil {
+				t.Fatalf("JSON() error = %v", err)
+			}
+			if string(again) != string(b) {
+				t.Errorf("JSON() after round trip = %s, want %s", again, b)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// lazyConn is a connection used by a Pool or LoadBalancer. It is dialed when
+// first used and closed after a connection error, so the next use redials it.
+type lazyConn struct {
+	mu        sync.Mutex
+	conn      *Conn
+	connected time.Time
+}
+
+// send sends a message, first calling dial if there is no connection or it is
+// older than maxAge. The connection is closed if sending fails because of it,
+// but errors caused by the message leave it open.
+func (lc *lazyConn) send(m *Message, maxAge time.Duration, dial func() (*Conn, error)) error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.conn != nil && maxAge > 0 && time.Since(lc.connected) >= maxAge {
+		lc.conn.Close()
+		lc.conn = nil
+	}
+	if lc.conn == nil {
+		conn, err := dial()
+		if err != nil {
+			return err
+		}
+		lc.conn = conn
+		lc.connected = time.Now()
+	}
+
+	err := lc.conn.SendMessage(m)
+	if err != nil && isConnError(err) {
+		lc.conn.Close()
+		lc.conn = nil
+	}
+	return err
+}
+
+// close closes the connection if it is open
+func (lc *lazyConn) close() error {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	if lc.conn == nil {
+		return nil
+	}
+	err := lc.conn.Close()
+	lc.conn = nil
+	return err
+}
+
+// isConnError returns false if sending failed before anything was written,
+// because the message is invalid or the rate limit was exceeded. Any other
+// error is blamed on the connection.
+func isConnError(err error) bool {
+	for _, target := range []error{ErrNilMessage, ErrInvalidFieldName, ErrReservedField,
+		ErrMissingIndex, ErrFieldCollision, ErrRateLimited} {
+		if errors.Is(err, target) {
+			return false
+		}
+	}
+	return true
+}
+
+// failover calls send with each index below n until it succeeds. It returns
+// at once if an error is not a connection error, since the message would
+// fail the same way every time.
+func failover(n int, send func(i int) error) error {
+	var err error
+	for i := range n {
+		if err = send(i); err == nil || !isConnError(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,56 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Attribute keys used in structured log records, so that records from
+// clients and servers can be filtered consistently
+const (
+	LogKeyRemoteAddr = "remote_addr"
+	LogKeyEndpoint   = "endpoint"
+	LogKeyVersion    = "version"
+	LogKeyServerName = "server_name"
+	LogKeyReason     = "reason"
+	LogKeyMessages   = "messages"
+	LogKeyAttempt    = "attempt"
+	LogKeyError      = "error"
+	LogKeyDuration   = "duration"
+	LogKeyLimit      = "limit"
+	LogKeyControl    = "control"
+	LogKeyAckID      = "ack_id"
+	LogKeyChannel    = "channel"
+)
+
+// logAttrs logs a record with attributes to l, returning false if l is nil
+// so that the caller can fall back to a plain Logger
+func logAttrs(l *slog.Logger, level slog.Level, msg string, attrs ...slog.Attr) bool {
+	if l == nil {
+		return false
+	}
+	l.LogAttrs(context.Background(), level, msg, attrs...)
+	return true
+}
+
+// errorAttr returns an attribute for an error
+func errorAttr(err error) slog.Attr {
+	return slog.Any(LogKeyError, err)
+}
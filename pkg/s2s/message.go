@@ -18,21 +18,65 @@
 package s2s
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 )
 
+// CollisionPolicy determines how a Fields key that matches a metadata field
+// name (index, host, source or sourcetype, ignoring case) is handled when the
+// corresponding metadata is also set.
+type CollisionPolicy int
+
+const (
+	// CollisionKeep sends both the metadata and the field (the default)
+	CollisionKeep CollisionPolicy = iota
+	// CollisionPreferMetadata drops the colliding field
+	CollisionPreferMetadata
+	// CollisionPreferField replaces the metadata with the field value
+	CollisionPreferField
+	// CollisionError rejects the message with ErrFieldCollision
+	CollisionError
+)
+
+// TimeMode determines when a message is sent with a _time field
+type TimeMode int
+
+const (
+	// TimeAuto sends _time if the message has a Time (the default)
+	TimeAuto TimeMode = iota
+	// TimeAlways sends _time, using the current time if the message has none
+	TimeAlways
+	// TimeNever never sends _time, so the indexer timestamps every event
+	TimeNever
+)
+
+// ErrFieldCollision is returned when Fields collides with message metadata
+var ErrFieldCollision = errors.New("field collides with message metadata")
+
+// DefaultLineBreaker splits events at runs of newlines, like the default
+// LINE_BREAKER used by Splunk
+var DefaultLineBreaker = regexp.MustCompile(`([\r\n]+)`)
+
 // Message may used for control or data, with Raw containing one or more events.
+// ReceiveTime is not sent; it is set by a Server with StampReceiveTime when
+// Time is when the message was received, because it was sent without one.
 type Message struct {
-	Index      string
-	Host       string
-	Source     string
-	SourceType string
-	Raw        string
-	Time       time.Time
-	Fields     map[string]string
+	Index       string
+	Host        string
+	Source      string
+	SourceType  string
+	Raw         string
+	Time        time.Time
+	IndexTime   time.Time
+	Fields      map[string]string
+	ReceiveTime bool
 }
 
 // Clear clears the message.
@@ -43,7 +87,39 @@ func (m *Message) Clear() {
 	m.SourceType = ""
 	m.Raw = ""
 	m.Time = time.Time{}
+	m.IndexTime = time.Time{}
 	m.Fields = make(map[string]string)
+	m.ReceiveTime = false
+}
+
+// messagePool holds released messages for reuse by AcquireMessage
+var messagePool = sync.Pool{
+	New: func() any {
+		return &Message{Fields: make(map[string]string)}
+	},
+}
+
+// AcquireMessage returns an empty message from a pool, reusing the storage of
+// messages returned by ReleaseMessage to reduce garbage collection
+func AcquireMessage() *Message {
+	return messagePool.Get().(*Message)
+}
+
+// ReleaseMessage clears a message and returns it to the pool. The message must
+// not be used after it is released; Clone it first to keep a copy.
+func ReleaseMessage(m *Message) {
+	if m == nil {
+		return
+	}
+	m.reset()
+	messagePool.Put(m)
+}
+
+// reset clears the message like Clear, but reuses its Fields map
+func (m *Message) reset() {
+	fields := m.Fields
+	clear(fields)
+	*m = Message{Fields: fields}
 }
 
 // Read reads the message from a reader.
@@ -55,6 +131,29 @@ func (m *Message) Read(r io.Reader) error {
 	return DecodeMessage(r, m)
 }
 
+// ReadFrom reads a single message from r, implementing io.ReaderFrom. It
+// returns the number of bytes read, which is the encoded length of the message
+// if it is read successfully.
+func (m *Message) ReadFrom(r io.Reader) (int64, error) {
+	if m == nil {
+		return 0, ErrNilMessage
+	}
+	cr := &countingReader{r: r}
+	err := m.Read(cr)
+	return cr.n, err
+}
+
+// WriteTo writes the message to w, implementing io.WriterTo. It returns the
+// number of bytes written, which is the encoded length of the message.
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	if m == nil {
+		return 0, ErrNilMessage
+	}
+	cw := &countingWriter{w: w}
+	err := m.Write(cw)
+	return cw.n, err
+}
+
 // Write writes the message to a writer.
 func (m *Message) Write(w io.Writer) error {
 	if m == nil {
@@ -63,6 +162,26 @@ func (m *Message) Write(w io.Writer) error {
 	return EncodeMessage(w, m)
 }
 
+// EncodedSize returns the number of bytes the message is encoded with,
+// including its size prefix, without encoding it.
+func (m *Message) EncodedSize() int {
+	if m == nil {
+		return 0
+	}
+	size, _ := getHeaderValues(m, len(m.Raw))
+	return int(size) + 4
+}
+
+// FieldCount returns the number of key/value pairs the message is encoded
+// with, which includes its metadata, times, _done and _raw.
+func (m *Message) FieldCount() int {
+	if m == nil {
+		return 0
+	}
+	_, maps := getHeaderValues(m, len(m.Raw))
+	return int(maps)
+}
+
 // String returns a string representation of the message.
 func (m *Message) String() string {
 	var sb strings.Builder
@@ -99,6 +218,11 @@ func (m *Message) String() string {
 		sb.WriteString(fmt.Sprintf("%d", m.Time.Unix()))
 		sb.WriteString(" ")
 	}
+	if !m.IndexTime.IsZero() {
+		sb.WriteString("_indextime=")
+		sb.WriteString(fmt.Sprintf("%d", m.IndexTime.Unix()))
+		sb.WriteString(" ")
+	}
 	if m.Raw != "" {
 		sb.WriteString("_raw=")
 		sb.WriteString(m.Raw)
@@ -106,3 +230,162 @@ func (m *Message) String() string {
 	}
 	return strings.TrimSpace(sb.String())
 }
+
+// SetField sets a field, creating the Fields map if it is nil
+func (m *Message) SetField(key, value string) {
+	if m.Fields == nil {
+		m.Fields = make(map[string]string)
+	}
+	m.Fields[key] = value
+}
+
+// AddField sets a field unless the message already has it, creating the
+// Fields map if it is nil
+func (m *Message) AddField(key, value string) {
+	if _, ok := m.Fields[key]; !ok {
+		m.SetField(key, value)
+	}
+}
+
+// GetField returns the value of a field and whether the message has it
+func (m *Message) GetField(key string) (string, bool) {
+	value, ok := m.Fields[key]
+	return value, ok
+}
+
+// SplitRaw splits Raw into the events it contains, for messages from
+// forwarders that batch several events into one message. As with Splunk's
+// LINE_BREAKER, the text matched by the first capturing group of lineBreaker,
+// or the whole match if it has none, separates events and is discarded.
+// Empty events are dropped. If lineBreaker is nil, DefaultLineBreaker is used.
+func (m *Message) SplitRaw(lineBreaker *regexp.Regexp) []string {
+	if lineBreaker == nil {
+		lineBreaker = DefaultLineBreaker
+	}
+	group := 0
+	if lineBreaker.NumSubexp() > 0 {
+		group = 1
+	}
+
+	var events []string
+	start := 0
+	for _, match := range lineBreaker.FindAllStringSubmatchIndex(m.Raw, -1) {
+		from, to := match[2*group], match[2*group+1]
+		if from < 0 {
+			// the group did not participate in this match
+			continue
+		}
+		if event := m.Raw[start:from]; event != "" {
+			events = append(events, event)
+		}
+		start = to
+	}
+	if event := m.Raw[start:]; event != "" {
+		events = append(events, event)
+	}
+	return events
+}
+
+// Clone returns a copy of the message that does not share its Fields map
+func (m *Message) Clone() *Message {
+	if m == nil {
+		return nil
+	}
+	c := *m
+	c.Fields = maps.Clone(m.Fields)
+	return &c
+}
+
+// Equal returns true if both messages have the same metadata, times, raw data
+// and fields. A nil Fields map is equal to an empty one.
+func (m *Message) Equal(other *Message) bool {
+	if m == nil || other == nil {
+		return m == other
+	}
+	return m.Index == other.Index &&
+		m.Host == other.Host &&
+		m.Source == other.Source &&
+		m.SourceType == other.SourceType &&
+		m.Raw == other.Raw &&
+		m.Time.Equal(other.Time) &&
+		m.IndexTime.Equal(other.IndexTime) &&
+		maps.Equal(m.Fields, other.Fields)
+}
+
+// withField returns a copy of the message with an additional field
+func withField(m *Message, key, value string) *Message {
+	c := *m
+	c.Fields = make(map[string]string, len(m.Fields)+1)
+	for k, v := range m.Fields {
+		c.Fields[k] = v
+	}
+	c.Fields[key] = value
+	return &c
+}
+
+// applyTimeMode returns the message, or a copy with its Time changed to
+// match mode
+func applyTimeMode(m *Message, mode TimeMode) *Message {
+	switch {
+	case mode == TimeAlways && m.Time.IsZero():
+		return withTime(m, time.Now())
+	case mode == TimeNever && !m.Time.IsZero():
+		return withTime(m, time.Time{})
+	}
+	return m
+}
+
+// withTime returns a copy of the message with its time set to t
+func withTime(m *Message, t time.Time) *Message {
+	c := *m
+	c.Time = t
+	return &c
+}
+
+// metadata returns pointers to the metadata fields, keyed by lowercase name
+func (m *Message) metadata() map[string]*string {
+	return map[string]*string{
+		"index":      &m.Index,
+		"host":       &m.Host,
+		"source":     &m.Source,
+		"sourcetype": &m.SourceType,
+	}
+}
+
+// applyCollisionPolicy returns a message with Fields that collide with
+// metadata resolved according to the policy. The original is not modified.
+// Fields are resolved in sorted order, so if several keys differ only in
+// case, CollisionPreferField consistently uses the last one.
+func applyCollisionPolicy(m *Message, policy CollisionPolicy) (*Message, error) {
+	if policy == CollisionKeep || m == nil {
+		return m, nil
+	}
+
+	var resolved *Message
+	var resolvedMeta map[string]*string
+	meta := m.metadata()
+	for _, k := range slices.Sorted(maps.Keys(m.Fields)) {
+		value, ok := meta[strings.ToLower(k)]
+		if !ok || *value == "" {
+			continue
+		}
+		if policy == CollisionError {
+			return nil, fmt.Errorf("%w: %s", ErrFieldCollision, k)
+		}
+
+		// copy the message before making the first change
+		if resolved == nil {
+			resolved = m.Clone()
+			resolvedMeta = resolved.metadata()
+		}
+		delete(resolved.Fields, k)
+		if policy == CollisionPreferField {
+			*resolvedMeta[strings.ToLower(k)] = m.Fields[k]
+		}
+	}
+
+	if resolved == nil {
+		return m, nil
+	}
+	return resolved, nil
+}
@@ -0,0 +1,387 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"maps"
+	"regexp"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestApplyCollisionPolicy(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     CollisionPolicy
+		message    *Message
+		wantErr    error
+		wantHost   string
+		wantFields map[string]string
+	}{
+		{
+			name:       "keep",
+			policy:     CollisionKeep,
+			message:    &Message{Host: "meta", Fields: map[string]string{"host": "field"}},
+			wantHost:   "meta",
+			wantFields: map[string]string{"host": "field"},
+		},
+		{
+			name:       "prefer metadata",
+			policy:     CollisionPreferMetadata,
+			message:    &Message{Host: "meta", Fields: map[string]string{"host": "field", "other": "value"}},
+			wantHost:   "meta",
+			wantFields: map[string]string{"other": "value"},
+		},
+		{
+			name:       "prefer field ignores case",
+			policy:     CollisionPreferField,
+			message:    &Message{Host: "meta", Fields: map[string]string{"HOST": "field"}},
+			wantHost:   "field",
+			wantFields: map[string]string{},
+		},
+		{
+			name:       "prefer field with keys differing in case",
+			policy:     CollisionPreferField,
+			message:    &Message{Host: "meta", Fields: map[string]string{"HOST": "upper", "Host": "title", "host": "lower"}},
+			wantHost:   "lower",
+			wantFields: map[string]string{},
+		},
+		{
+			name:    "error",
+			policy:  CollisionError,
+			message: &Message{Host: "meta", Fields: map[string]string{"host": "field"}},
+			wantErr: ErrFieldCollision,
+		},
+		{
+			name:       "no collision with empty metadata",
+			policy:     CollisionError,
+			message:    &Message{Fields: map[string]string{"host": "field"}},
+			wantFields: map[string]string{"host": "field"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			host := tt.message.Host
+			fields := maps.Clone(tt.message.Fields)
+			got, err := applyCollisionPolicy(tt.message, tt.policy)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("applyCollisionPolicy() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.message.Host != host || !maps.Equal(tt.message.Fields, fields) {
+				t.Errorf("original message modified to %v", tt.message)
+			}
+			if err != nil {
+				return
+			}
+			if got.Host != tt.wantHost {
+				t.Errorf("Host = %v, want %v", got.Host, tt.wantHost)
+			}
+			if len(got.Fields) != len(tt.wantFields) {
+				t.Errorf("Fields = %v, want %v", got.Fields, tt.wantFields)
+			}
+			for k, v := range tt.wantFields {
+				if got.Fields[k] != v {
+					t.Errorf("Fields[%v] = %v, want %v", k, got.Fields[k], v)
+				}
+			}
+		})
+	}
+}
+
+func TestMessageClone(t *testing.T) {
+	m := &Message{Index: "main", Raw: "event", Time: time.Unix(1700000000, 0), Fields: map[string]string{"a": "1"}}
+	c := m.Clone()
+	if !c.Equal(m) {
+		t.Fatalf("Clone() = %v, want %v", c, m)
+	}
+
+	c.Fields["a"] = "2"
+	c.Fields["b"] = "3"
+	if m.Fields["a"] != "1" || len(m.Fields) != 1 {
+		t.Errorf("modifying Clone() changed original Fields = %v", m.Fields)
+	}
+
+	var nilMessage *Message
+	if got := nilMessage.Clone(); got != nil {
+		t.Errorf("Clone() of nil = %v, want nil", got)
+	}
+}
+
+func TestMessageFields(t *testing.T) {
+	var m Message
+	if _, ok := m.GetField("a"); ok {
+		t.Errorf("GetField() on zero Message found a field")
+	}
+
+	m.AddField("a", "1")
+	m.AddField("a", "2")
+	m.SetField("b", "3")
+	m.SetField("b", "4")
+	want := map[string]string{"a": "1", "b": "4"}
+	if !maps.Equal(m.Fields, want) {
+		t.Errorf("Fields = %v, want %v", m.Fields, want)
+	}
+	if got, ok := m.GetField("b"); !ok || got != "4" {
+		t.Errorf("GetField(b) = %q, %v, want %q, true", got, ok, "4")
+	}
+}
+
+func TestMessageSplitRaw(t *testing.T) {
+	tests := []struct {
+		name        string
+		raw         string
+		lineBreaker *regexp.Regexp
+		want        []string
+	}{
+		{"single event", "one", nil, []string{"one"}},
+		{"newlines", "one\ntwo\r\nthree\n", nil, []string{"one", "two", "three"}},
+		{"blank lines", "\n\none\n\n\ntwo", nil, []string{"one", "two"}},
+		{"empty", "", nil, nil},
+		{"no group", "one|two||three", regexp.MustCompile(`\|+`), []string{"one", "two", "three"}},
+		{"timestamp breaker", "2024-01-01 one\ncontinued\n2024-01-02 two",
+			regexp.MustCompile(`([\r\n]+)\d{4}-\d{2}-\d{2}`), []string{"2024-01-01 one\ncontinued", "2024-01-02 two"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &Message{Raw: tt.raw}
+			if got := m.SplitRaw(tt.lineBreaker); !slices.Equal(got, tt.want) {
+				t.Errorf("SplitRaw() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMessageEqual(t *testing.T) {
+	base := func() *Message {
+		return &Message{
+			Index:      "main",
+			Host:       "host",
+			Source:     "source",
+			SourceType: "type",
+			Raw:        "event",
+			Time:       time.Unix(1700000000, 0),
+			Fields:     map[string]string{"a": "1"},
+		}
+	}
+
+	tests := []struct {
+		name string
+		a, b *Message
+		want bool
+	}{
+		{"identical", base(), base(), true},
+		{"nil and empty fields", &Message{Raw: "x"}, &Message{Raw: "x", Fields: map[string]string{}}, true},
+		{"same instant in different zones", &Message{Time: time.Unix(1700000000, 0).UTC()}, &Message{Time: time.Unix(1700000000, 0).Local()}, true},
+		{"both nil", nil, nil, true},
+		{"one nil", base(), nil, false},
+		{"different index", base(), &Message{Index: "other"}, false},
+		{"different time", base(), func() *Message { m := base(); m.Time = m.Time.Add(time.Second); return m }(), false},
+		{"different index time", base(), func() *Message { m := base(); m.IndexTime = m.Time; return m }(), false},
+		{"different field value", base(), func() *Message { m := base(); m.Fields["a"] = "2"; return m }(), false},
+		{"extra field", base(), func() *Message { m := base(); m.Fields["b"] = "2"; return m }(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.Equal(tt.b); got != tt.want {
+				t.Errorf("Equal() = %v, want %v", got, tt.want)
+			}
+			if got := tt.b.Equal(tt.a); got != tt.want {
+				t.Errorf("Equal() reversed = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcquireReleaseMessage(t *testing.T) {
+	m := AcquireMessage()
+	m.Index = "main"
+	m.Raw = "event"
+	m.Time = time.Unix(1700000000, 0)
+	m.Fields["key"] = "value"
+	ReleaseMessage(m)
+	ReleaseMessage(nil)
+
+	// the pool may or may not return the released message, but it must be empty
+	for i := 0; i < 2; i++ {
+		m := AcquireMessage()
+		if !m.Equal(&Message{}) {
+			t.Errorf("AcquireMessage() = %v, want empty message", m)
+		}
+		if m.Fields == nil {
+			t.Error("AcquireMessage() Fields = nil, want empty map")
+		}
+	}
+}
+
+func BenchmarkDecodeMessagePooled(b *testing.B) {
+	data := benchmarkMessage(b)
+	r := bytes.NewReader(data)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(data)
+		m := AcquireMessage()
+		if err := DecodeMessage(r, m); err != nil {
+			b.Fatalf("DecodeMessage() error = %v", err)
+		}
+		ReleaseMessage(m)
+	}
+}
+
+func TestApplyTimeMode(t *testing.T) {
+	historical := time.Unix(1600000000, 0)
+	tests := []struct {
+		name     string
+		mode     TimeMode
+		time     time.Time
+		wantTime bool
+	}{
+		{"auto without time", TimeAuto, time.Time{}, false},
+		{"auto with time", TimeAuto, historical, true},
+		{"always without time", TimeAlways, time.Time{}, true},
+		{"always with time", TimeAlways, historical, true},
+		{"never without time", TimeNever, time.Time{}, false},
+		{"never with time", TimeNever, historical, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := &Message{Raw: "event", Time: tt.time}
+			m := applyTimeMode(orig, tt.mode)
+			if !orig.Time.Equal(tt.time) {
+				t.Error("applyTimeMode() modified the original message")
+			}
+			if !tt.time.IsZero() && tt.wantTime && !m.Time.Equal(tt.time) {
+				t.Errorf("applyTimeMode() Time = %v, want %v", m.Time, tt.time)
+			}
+
+			var buf bytes.Buffer
+			if err := EncodeMessage(&buf, m); err != nil {
+				t.Fatalf("EncodeMessage() error = %v", err)
+			}
+			if got := bytes.Contains(buf.Bytes(), []byte("_time\x00")); got != tt.wantTime {
+				t.Errorf("EncodeMessage() has _time = %v, want %v", got, tt.wantTime)
+			}
+			size, _ := getHeaderValues(m, len(m.Raw))
+			if int(size)+4 != buf.Len() {
+				t.Errorf("getHeaderValues() size = %d, want %d", size, buf.Len()-4)
+			}
+		})
+	}
+}
+
+func TestMessageWriteToReadFrom(t *testing.T) {
+	messages := []*Message{
+		{Raw: "event"},
+		{Index: "main", Host: "host1", Time: time.Unix(1700000000, 0), Fields: map[string]string{"key": "value"}, Raw: "second event"},
+	}
+
+	var stream bytes.Buffer
+	var written int64
+	for _, m := range messages {
+		var single bytes.Buffer
+		if err := EncodeMessage(&single, m); err != nil {
+			t.Fatalf("EncodeMessage() error = %v", err)
+		}
+		n, err := io.WriterTo(m).WriteTo(&stream)
+		if err != nil {
+			t.Fatalf("WriteTo() error = %v", err)
+		}
+		if n != int64(single.Len()) {
+			t.Errorf("WriteTo() = %d, want %d", n, single.Len())
+		}
+		written += n
+	}
+	if written != int64(stream.Len()) {
+		t.Errorf("WriteTo() total = %d, want %d", written, stream.Len())
+	}
+
+	// ReadFrom reads one message at a time
+	for _, want := range messages {
+		var m io.ReaderFrom = &Message{}
+		before := stream.Len()
+		n, err := m.ReadFrom(&stream)
+		if err != nil {
+			t.Fatalf("ReadFrom() error = %v", err)
+		}
+		if n != int64(before-stream.Len()) {
+			t.Errorf("ReadFrom() = %d, want %d", n, before-stream.Len())
+		}
+		if !m.(*Message).Equal(want) {
+			t.Errorf("ReadFrom() message = %v, want %v", m, want)
+		}
+	}
+	if n, err := (&Message{}).ReadFrom(&stream); err != io.EOF || n != 0 {
+		t.Errorf("ReadFrom() at end = %d, %v, want 0, %v", n, err, io.EOF)
+	}
+
+	var nilMessage *Message
+	if _, err := nilMessage.WriteTo(&stream); err != ErrNilMessage {
+		t.Errorf("WriteTo() error = %v, want %v", err, ErrNilMessage)
+	}
+}
+
+func TestMessageEncodedSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		m          *Message
+		wantFields int
+	}{
+		{"empty", &Message{}, 2},
+		{"raw only", &Message{Raw: "hello world"}, 2},
+		{"metadata", &Message{Index: "main", Host: "web01", Source: "/var/log/app.log", SourceType: "app", Raw: "event"}, 6},
+		{"fields and times", &Message{
+			Fields:    map[string]string{"user": "alice", "status": "200"},
+			Time:      time.Unix(1700000000, 0),
+			IndexTime: time.Unix(1700000001, 0),
+			Raw:       "request served",
+		}, 6},
+		{"unicode", &Message{
+			Host:   "hôte-ünïcode",
+			Fields: map[string]string{"名前": "値", "emoji": "🚀✨"},
+			Raw:    "日本語のイベント — ✓",
+		}, 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.m.Write(&buf); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			if got := tt.m.EncodedSize(); got != buf.Len() {
+				t.Errorf("EncodedSize() = %d, want %d", got, buf.Len())
+			}
+			if got := tt.m.FieldCount(); got != tt.wantFields {
+				t.Errorf("FieldCount() = %d, want %d", got, tt.wantFields)
+			}
+		})
+	}
+
+	var m *Message
+	if got := m.EncodedSize(); got != 0 {
+		t.Errorf("nil EncodedSize() = %d, want 0", got)
+	}
+	if got := m.FieldCount(); got != 0 {
+		t.Errorf("nil FieldCount() = %d, want 0", got)
+	}
+}
@@ -0,0 +1,153 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Universal forwarders send indexed fields packed into a single _meta field
+// of space separated "key::value" pairs. Values containing spaces, quotes or
+// backslashes are double quoted, with quotes and backslashes escaped by a
+// backslash. Fields whose names begin with an underscore are internal to the
+// protocol, and are always sent as separate fields.
+
+// metaKey is the field used to carry packed indexed fields
+const metaKey = "_meta"
+
+// FormatMeta encodes fields in the _meta format, sorted by key. Keys may not
+// contain whitespace, quotes or "::".
+func FormatMeta(fields map[string]string) (string, error) {
+	var b strings.Builder
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		if k == "" || strings.ContainsAny(k, " \t\r\n\"") || strings.Contains(k, "::") {
+			return "", fmt.Errorf("%w: %q cannot be used in %s", ErrInvalidFieldName, k, metaKey)
+		}
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(k)
+		b.WriteString("::")
+		v := fields[k]
+		if v != "" && !strings.ContainsAny(v, " \t\r\n\"\\") {
+			b.WriteString(v)
+			continue
+		}
+		b.WriteByte('"')
+		for i := 0; i < len(v); i++ {
+			if v[i] == '"' || v[i] == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(v[i])
+		}
+		b.WriteByte('"')
+	}
+	return b.String(), nil
+}
+
+// ParseMeta decodes fields in the _meta format
+func ParseMeta(s string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if s == "" {
+			return fields, nil
+		}
+		k, rest, ok := strings.Cut(s, "::")
+		if !ok || k == "" || strings.ContainsAny(k, " \t\r\n\"") {
+			return nil, fmt.Errorf("%w: invalid %s pair %q", ErrInvalidData, metaKey, s)
+		}
+
+		var v string
+		if strings.HasPrefix(rest, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			if i == len(rest) {
+				return nil, fmt.Errorf("%w: unterminated %s value for %q", ErrInvalidData, metaKey, k)
+			}
+			v, s = b.String(), rest[i+1:]
+		} else {
+			end := strings.IndexAny(rest, " \t\r\n")
+			if end < 0 {
+				end = len(rest)
+			}
+			v, s = rest[:end], rest[end:]
+		}
+		fields[k] = v
+	}
+}
+
+// packMeta returns a copy of the message with its indexed fields packed into
+// _meta, appending to any _meta field it already has
+func packMeta(m *Message) (*Message, error) {
+	indexed := make(map[string]string, len(m.Fields))
+	for k, v := range m.Fields {
+		if !strings.HasPrefix(k, "_") {
+			indexed[k] = v
+		}
+	}
+	if len(indexed) == 0 {
+		return m, nil
+	}
+	meta, err := FormatMeta(indexed)
+	if err != nil {
+		return nil, err
+	}
+
+	c := *m
+	c.Fields = make(map[string]string, len(m.Fields)-len(indexed)+1)
+	for k, v := range m.Fields {
+		if strings.HasPrefix(k, "_") {
+			c.Fields[k] = v
+		}
+	}
+	if existing := c.Fields[metaKey]; existing != "" {
+		meta = existing + " " + meta
+	}
+	c.Fields[metaKey] = meta
+	return &c, nil
+}
+
+// unpackMeta replaces the _meta field of a message with the fields it holds.
+// Fields that are also sent separately keep their separate value.
+func unpackMeta(m *Message) error {
+	meta, ok := m.Fields[metaKey]
+	if !ok {
+		return nil
+	}
+	fields, err := ParseMeta(meta)
+	if err != nil {
+		return err
+	}
+	delete(m.Fields, metaKey)
+	for k, v := range fields {
+		if _, exists := m.Fields[k]; !exists {
+			m.Fields[k] = v
+		}
+	}
+	return nil
+}
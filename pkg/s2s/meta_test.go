@@ -0,0 +1,148 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bytes"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+)
+
+func TestFormatMeta(t *testing.T) {
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		want    string
+		wantErr error
+	}{
+		{"empty", nil, "", nil},
+		{"sorted pairs", map[string]string{"region": "us-east", "env": "prod"}, "env::prod region::us-east", nil},
+		{"quoted value", map[string]string{"msg": `say "hi" \o/`}, `msg::"say \"hi\" \\o/"`, nil},
+		{"empty value", map[string]string{"k": ""}, `k::""`, nil},
+		{"key with space", map[string]string{"a b": "c"}, "", ErrInvalidFieldName},
+		{"key with separator", map[string]string{"a::b": "c"}, "", ErrInvalidFieldName},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatMeta(tt.fields)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("FormatMeta() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("FormatMeta() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMeta(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string]string
+		wantErr error
+	}{
+		{"empty", "", map[string]string{}, nil},
+		{"pairs", "  env::prod\tregion::us-east ", map[string]string{"env": "prod", "region": "us-east"}, nil},
+		{"quoted value", `msg::"say \"hi\" \\o/" n::1`, map[string]string{"msg": `say "hi" \o/`, "n": "1"}, nil},
+		{"value with separator", "url::http://host", map[string]string{"url": "http://host"}, nil},
+		{"missing separator", "env=prod", nil, ErrInvalidData},
+		{"unterminated quote", `msg::"oops`, nil, ErrInvalidData},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseMeta(tt.input)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("ParseMeta() error = %v, want %v", err, tt.wantErr)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("ParseMeta() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetaRoundTrip(t *testing.T) {
+	in := &Message{
+		Index: "main",
+		Raw:   "event",
+		Fields: map[string]string{
+			"env":      "prod",
+			"team":     "site reliability",
+			"quote":    `"quoted" \ value`,
+			"_s2s_seq": "1",
+		},
+	}
+	packed, err := packMeta(in)
+	if err != nil {
+		t.Fatalf("packMeta() error = %v", err)
+	}
+	if len(packed.Fields) != 2 || packed.Fields["_s2s_seq"] != "1" {
+		t.Errorf("packMeta() Fields = %v, want only _meta and _s2s_seq", packed.Fields)
+	}
+	if len(in.Fields) != 4 {
+		t.Error("packMeta() modified the original message")
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeMessage(&buf, packed); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+	dec := NewDecoder(&buf)
+	dec.ParseMeta = true
+	out := &Message{}
+	if err := dec.Decode(out); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !out.Equal(in) {
+		t.Errorf("Decode() = %v, want %v", out, in)
+	}
+}
+
+func TestServerParseMeta(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.Logger = nil
+	s.ParseMeta = true
+	received := s.Messages()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseMeta = true
+
+	in := &Message{Raw: "event", Fields: map[string]string{"env": "prod", "owner": "data team"}}
+	if err := c.SendMessage(in); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	select {
+	case m := <-received:
+		if !maps.Equal(m.Fields, in.Fields) {
+			t.Errorf("received Fields = %v, want %v", m.Fields, in.Fields)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
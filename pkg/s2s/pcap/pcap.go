@@ -0,0 +1,303 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pcap reconstructs splunk-to-splunk messages from packet captures.
+// It reads the classic libpcap file format written by tcpdump and Wireshark,
+// reassembles each TCP connection and decodes the messages sent by clients.
+// Connections that negotiated compression or used TLS cannot be decoded.
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"sort"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+var (
+	ErrInvalidCapture = errors.New("invalid pcap file")
+	ErrLinkType       = errors.New("unsupported pcap link type")
+)
+
+// link types of the captured packets
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+)
+
+// maxSnapLen bounds the size of a captured packet, whatever the file header
+// claims, so that a corrupt capture cannot demand a huge allocation. It is
+// the default snapshot length of tcpdump and Wireshark.
+const maxSnapLen = 262144
+
+// protocolTCP is the IP protocol number of TCP
+const protocolTCP = 6
+
+// Stream is the data sent in one direction of a TCP connection, from Src to
+// Dst, reassembled in sequence order. Reassembly stops at the first gap,
+// such as a packet missing from the capture.
+type Stream struct {
+	Src  netip.AddrPort
+	Dst  netip.AddrPort
+	Data []byte
+}
+
+// Event is a message decoded from a client stream
+type Event struct {
+	Src     netip.AddrPort
+	Dst     netip.AddrPort
+	Message *s2s.Message
+}
+
+// segment is the payload of a TCP packet at a sequence number
+type segment struct {
+	seq  uint32
+	data []byte
+}
+
+// flow collects the segments sent in one direction of a TCP connection
+type flow struct {
+	src, dst netip.AddrPort
+	isn      uint32
+	hasSYN   bool
+	segments []segment
+}
+
+// ReadStreams reads a capture file and returns the TCP streams it contains,
+// in the order their first packets were captured
+func ReadStreams(r io.Reader) ([]Stream, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("%w: reading file header: %v", ErrInvalidCapture, err)
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(header) {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("%w: unknown magic number % x", ErrInvalidCapture, header[:4])
+	}
+	snapLen := order.Uint32(header[16:])
+	if snapLen == 0 || snapLen > maxSnapLen {
+		snapLen = maxSnapLen
+	}
+	linkType := order.Uint32(header[20:]) & 0xffff
+
+	var flows []*flow
+	byKey := make(map[[2]netip.AddrPort]*flow)
+	record := make([]byte, 16)
+	for {
+		if _, err := io.ReadFull(r, record); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("%w: reading packet header: %v", ErrInvalidCapture, err)
+		}
+		inclLen := order.Uint32(record[8:])
+		if inclLen > snapLen {
+			return nil, fmt.Errorf("%w: packet length %d exceeds snapshot length %d", ErrInvalidCapture, inclLen, snapLen)
+		}
+		packet := make([]byte, inclLen)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return nil, fmt.Errorf("%w: reading packet: %v", ErrInvalidCapture, err)
+		}
+
+		ip, err := linkPayload(packet, linkType)
+		if err != nil {
+			return nil, err
+		}
+		src, dst, seq, syn, payload, ok := parseTCP(ip)
+		if !ok {
+			continue
+		}
+		key := [2]netip.AddrPort{src, dst}
+		f := byKey[key]
+		if f == nil {
+			f = &flow{src: src, dst: dst, isn: seq}
+			byKey[key] = f
+			flows = append(flows, f)
+		}
+		if syn {
+			// the SYN consumes a sequence number before the first data byte
+			f.isn, f.hasSYN = seq+1, true
+		} else if !f.hasSYN && int32(seq-f.isn) < 0 {
+			// without a SYN, the data starts at the earliest segment
+			f.isn = seq
+		}
+		if len(payload) > 0 {
+			f.segments = append(f.segments, segment{seq: seq, data: payload})
+		}
+	}
+
+	streams := make([]Stream, 0, len(flows))
+	for _, f := range flows {
+		streams = append(streams, Stream{Src: f.src, Dst: f.dst, Data: f.reassemble()})
+	}
+	return streams, nil
+}
+
+// reassemble returns the contiguous data of the flow from its initial
+// sequence number, discarding retransmitted and overlapping data
+func (f *flow) reassemble() []byte {
+	sort.SliceStable(f.segments, func(i, j int) bool {
+		return int32(f.segments[i].seq-f.segments[j].seq) < 0
+	})
+	var data []byte
+	for _, s := range f.segments {
+		offset := int64(int32(s.seq - f.isn))
+		end := offset + int64(len(s.data))
+		switch {
+		case offset > int64(len(data)):
+			// a segment is missing, so nothing after it can be used
+			return data
+		case end > int64(len(data)) && offset >= 0:
+			data = append(data, s.data[int64(len(data))-offset:]...)
+		}
+	}
+	return data
+}
+
+// linkPayload returns the IP packet within a captured frame
+func linkPayload(packet []byte, linkType uint32) ([]byte, error) {
+	switch linkType {
+	case linkTypeEthernet:
+		if len(packet) < 14 {
+			return nil, nil
+		}
+		etherType, payload := binary.BigEndian.Uint16(packet[12:]), packet[14:]
+		// skip a VLAN tag
+		if etherType == 0x8100 && len(payload) >= 4 {
+			payload = payload[4:]
+		}
+		return payload, nil
+	case linkTypeLinuxSLL:
+		if len(packet) < 16 {
+			return nil, nil
+		}
+		return packet[16:], nil
+	case linkTypeNull:
+		if len(packet) < 4 {
+			return nil, nil
+		}
+		return packet[4:], nil
+	case linkTypeRaw:
+		return packet, nil
+	}
+	return nil, fmt.Errorf("%w: %d", ErrLinkType, linkType)
+}
+
+// parseTCP returns the addresses, sequence number, SYN flag and payload of a
+// TCP segment in an IPv4 or IPv6 packet. It returns false for other packets,
+// including IPv4 fragments and IPv6 packets with extension headers.
+func parseTCP(ip []byte) (src, dst netip.AddrPort, seq uint32, syn bool, payload []byte, ok bool) {
+	if len(ip) < 1 {
+		return
+	}
+	var srcAddr, dstAddr netip.Addr
+	var tcp []byte
+	switch ip[0] >> 4 {
+	case 4:
+		headerLen := int(ip[0]&0x0f) * 4
+		if len(ip) < 20 || headerLen < 20 || len(ip) < headerLen || ip[9] != protocolTCP {
+			return
+		}
+		if binary.BigEndian.Uint16(ip[6:])&0x3fff != 0 {
+			// a fragment, or a packet with more fragments
+			return
+		}
+		totalLen := int(binary.BigEndian.Uint16(ip[2:]))
+		if totalLen < headerLen || totalLen > len(ip) {
+			// the packet was truncated when it was captured
+			totalLen = len(ip)
+		}
+		srcAddr = netip.AddrFrom4([4]byte(ip[12:16]))
+		dstAddr = netip.AddrFrom4([4]byte(ip[16:20]))
+		tcp = ip[headerLen:totalLen]
+	case 6:
+		if len(ip) < 40 || ip[6] != protocolTCP {
+			return
+		}
+		payloadLen := int(binary.BigEndian.Uint16(ip[4:]))
+		if 40+payloadLen > len(ip) {
+			payloadLen = len(ip) - 40
+		}
+		srcAddr = netip.AddrFrom16([16]byte(ip[8:24]))
+		dstAddr = netip.AddrFrom16([16]byte(ip[24:40]))
+		tcp = ip[40 : 40+payloadLen]
+	default:
+		return
+	}
+
+	if len(tcp) < 20 {
+		return
+	}
+	dataOffset := int(tcp[12]>>4) * 4
+	if dataOffset < 20 || dataOffset > len(tcp) {
+		return
+	}
+	src = netip.AddrPortFrom(srcAddr, binary.BigEndian.Uint16(tcp[0:]))
+	dst = netip.AddrPortFrom(dstAddr, binary.BigEndian.Uint16(tcp[2:]))
+	seq = binary.BigEndian.Uint32(tcp[4:])
+	syn = tcp[13]&0x02 != 0
+	return src, dst, seq, syn, tcp[dataOffset:], true
+}
+
+// ExtractEvents reads a capture file and decodes the messages sent by
+// clients on each splunk-to-splunk connection it contains, which are the
+// streams that start with a protocol signature. Control messages, such as
+// the capabilities exchange, are skipped. Events decoded before an error in
+// a stream are returned along with the error, and the remaining streams are
+// still decoded.
+func ExtractEvents(r io.Reader) ([]Event, error) {
+	streams, err := ReadStreams(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []Event
+	var errs []error
+	for _, stream := range streams {
+		if _, err := s2s.ReadHandshake(bytes.NewReader(stream.Data)); err != nil {
+			// not the client side of a splunk-to-splunk connection
+			continue
+		}
+		dec := s2s.NewDecoder(bytes.NewReader(stream.Data))
+		dec.SkipControl = true
+		for {
+			m := &s2s.Message{}
+			err := dec.Decode(m)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("stream %s -> %s: %w", stream.Src, stream.Dst, err))
+				break
+			}
+			events = append(events, Event{Src: stream.Src, Dst: stream.Dst, Message: m})
+		}
+	}
+	return events, errors.Join(errs...)
+}
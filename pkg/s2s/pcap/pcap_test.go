@@ -0,0 +1,222 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+const (
+	flagSYN = 0x02
+	flagACK = 0x10
+)
+
+// tcpPacket returns an Ethernet frame holding a TCP segment
+func tcpPacket(src, dst netip.AddrPort, seq uint32, flags byte, payload []byte) []byte {
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	tcp = append(tcp, payload...)
+
+	var ip []byte
+	etherType := uint16(0x0800)
+	if src.Addr().Is4() {
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+		ip[8] = 64
+		ip[9] = protocolTCP
+		s, d := src.Addr().As4(), dst.Addr().As4()
+		copy(ip[12:], s[:])
+		copy(ip[16:], d[:])
+	} else {
+		etherType = 0x86dd
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], uint16(len(tcp)))
+		ip[6] = protocolTCP
+		ip[7] = 64
+		s, d := src.Addr().As16(), dst.Addr().As16()
+		copy(ip[8:], s[:])
+		copy(ip[24:], d[:])
+	}
+
+	frame := make([]byte, 14)
+	binary.BigEndian.PutUint16(frame[12:], etherType)
+	return append(append(frame, ip...), tcp...)
+}
+
+// writeCapture returns a pcap file holding the frames
+func writeCapture(frames [][]byte) []byte {
+	var buf bytes.Buffer
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeEthernet)
+	buf.Write(header)
+	for i, frame := range frames {
+		record := make([]byte, 16)
+		binary.LittleEndian.PutUint32(record[0:], uint32(1700000000+i))
+		binary.LittleEndian.PutUint32(record[8:], uint32(len(frame)))
+		binary.LittleEndian.PutUint32(record[12:], uint32(len(frame)))
+		buf.Write(record)
+		buf.Write(frame)
+	}
+	return buf.Bytes()
+}
+
+// clientStream returns the data sent by a v3 client: the signature, the
+// capabilities exchange and the messages
+func clientStream(t *testing.T, messages ...*s2s.Message) []byte {
+	t.Helper()
+	handshake := make([]byte, 128+256+16)
+	copy(handshake, "--splunk-cooked-mode-v3--")
+	copy(handshake[128:], "forwarder")
+	copy(handshake[128+256:], "8089")
+	buf := bytes.NewBuffer(handshake)
+	capabilities := &s2s.Message{Fields: map[string]string{"__s2s_capabilities": "ack=0;compression=0"}}
+	for _, m := range append([]*s2s.Message{capabilities}, messages...) {
+		if err := m.Write(buf); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// segments splits data into segments of size bytes starting at seq
+func segments(src, dst netip.AddrPort, seq uint32, data []byte, size int) [][]byte {
+	var frames [][]byte
+	for offset := 0; offset < len(data); offset += size {
+		end := min(offset+size, len(data))
+		frames = append(frames, tcpPacket(src, dst, seq+uint32(offset), flagACK, data[offset:end]))
+	}
+	return frames
+}
+
+func TestExtractEvents(t *testing.T) {
+	client := netip.MustParseAddrPort("10.0.0.1:50000")
+	server := netip.MustParseAddrPort("10.0.0.2:9997")
+	client6 := netip.MustParseAddrPort("[2001:db8::1]:50001")
+	server6 := netip.MustParseAddrPort("[2001:db8::2]:9997")
+	web := netip.MustParseAddrPort("10.0.0.3:80")
+
+	events := []*s2s.Message{
+		{Index: "main", Host: "web01", Source: "/var/log/app.log", SourceType: "app", Raw: "first event"},
+		{Index: "main", Raw: "second event", Fields: map[string]string{"env": "prod"}},
+		{Index: "security", Raw: "third event"},
+	}
+	v6Event := &s2s.Message{Index: "main", Raw: "event over ipv6"}
+
+	var response bytes.Buffer
+	(&s2s.Message{Fields: map[string]string{"__s2s_control_msg": "cap_response=success"}}).Write(&response)
+
+	data := segments(client, server, 1001, clientStream(t, events...), 100)
+	// deliver two segments out of order and retransmit one
+	data[2], data[3] = data[3], data[2]
+	data = append(data[:5], append([][]byte{data[4]}, data[5:]...)...)
+
+	frames := [][]byte{
+		tcpPacket(client, server, 1000, flagSYN, nil),
+		tcpPacket(server, client, 5000, flagSYN|flagACK, nil),
+		tcpPacket(client, web, 7000, flagACK, []byte("GET / HTTP/1.1\r\n\r\n")),
+	}
+	frames = append(frames, data...)
+	frames = append(frames, tcpPacket(server, client, 5001, flagACK, response.Bytes()))
+	// the IPv6 connection was already open when the capture started
+	frames = append(frames, segments(client6, server6, 90000, clientStream(t, v6Event), 256)...)
+
+	got, err := ExtractEvents(bytes.NewReader(writeCapture(frames)))
+	if err != nil {
+		t.Fatalf("ExtractEvents() error = %v", err)
+	}
+	want := []Event{
+		{Src: client, Dst: server, Message: events[0]},
+		{Src: client, Dst: server, Message: events[1]},
+		{Src: client, Dst: server, Message: events[2]},
+		{Src: client6, Dst: server6, Message: v6Event},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("ExtractEvents() returned %d events, want %d: %v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].Src != want[i].Src || got[i].Dst != want[i].Dst || !got[i].Message.Equal(want[i].Message) {
+			t.Errorf("event %d = %s -> %s %v, want %s -> %s %v", i, got[i].Src, got[i].Dst, got[i].Message,
+				want[i].Src, want[i].Dst, want[i].Message)
+		}
+	}
+}
+
+func TestExtractEventsMissingSegment(t *testing.T) {
+	client := netip.MustParseAddrPort("10.0.0.1:50000")
+	server := netip.MustParseAddrPort("10.0.0.2:9997")
+	data := clientStream(t, &s2s.Message{Raw: "complete event"}, &s2s.Message{Raw: "event that is cut off"})
+	frames := segments(client, server, 1, data, 64)
+	// drop a segment within the last message
+	frames = append(frames[:len(frames)-2], frames[len(frames)-1])
+
+	got, err := ExtractEvents(bytes.NewReader(writeCapture(frames)))
+	if err == nil {
+		t.Error("ExtractEvents() error = nil, want an error for the incomplete message")
+	}
+	if len(got) != 1 || got[0].Message.Raw != "complete event" {
+		t.Errorf("ExtractEvents() = %v, want the complete event", got)
+	}
+}
+
+func TestReadStreamsInvalid(t *testing.T) {
+	// a packet header claiming 4 GiB must be rejected before it is allocated
+	hugePacket := writeCapture([][]byte{make([]byte, 64)})
+	binary.LittleEndian.PutUint32(hugePacket[24+8:], 0xffffffff)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrInvalidCapture},
+		{"bad magic", make([]byte, 24), ErrInvalidCapture},
+		{"truncated packet", writeCapture([][]byte{make([]byte, 64)})[:24+16+10], ErrInvalidCapture},
+		{"packet over snapshot length", writeCapture([][]byte{make([]byte, 65536)}), ErrInvalidCapture},
+		{"packet over maximum length", hugePacket, ErrInvalidCapture},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ReadStreams(bytes.NewReader(tt.data)); !errors.Is(err, tt.want) {
+				t.Errorf("ReadStreams() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	header := writeCapture(nil)
+	binary.LittleEndian.PutUint32(header[20:], 147)
+	capture := append(header, writeCapture([][]byte{{1, 2, 3}})[24:]...)
+	if _, err := ReadStreams(bytes.NewReader(capture)); !errors.Is(err, ErrLinkType) {
+		t.Errorf("ReadStreams() error = %v, want %v", err, ErrLinkType)
+	}
+}
@@ -0,0 +1,63 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package s2s
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// peekConn checks whether the peer has closed conn without consuming any
+// data, by peeking at the socket without blocking. It returns io.EOF if the
+// peer has closed the connection, the socket error if it has failed, or nil
+// if the connection looks usable or cannot be checked.
+func peekConn(conn net.Conn) error {
+	sc, ok := socketConn(conn).(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var peekErr error
+	b := make([]byte, 1)
+	err = raw.Read(func(fd uintptr) bool {
+		n, _, err := syscall.Recvfrom(int(fd), b, syscall.MSG_PEEK)
+		switch {
+		case errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR):
+			// nothing to read, so the connection is idle but open
+		case err != nil:
+			peekErr = os.NewSyscallError("recvfrom", err)
+		case n == 0:
+			peekErr = io.EOF
+		}
+		// never wait for the socket to become readable
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return peekErr
+}
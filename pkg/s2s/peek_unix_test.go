@@ -0,0 +1,81 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build unix
+
+package s2s
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnIsAlive(t *testing.T) {
+	written := make(chan struct{})
+	kill := make(chan struct{})
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		// send a byte that the probe must leave for the client to read
+		conn.Write([]byte("x"))
+		close(written)
+		<-kill
+	})
+
+	c, err := ConnectVersion(endpoint, 2)
+	if err != nil {
+		t.Fatalf("ConnectVersion() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.SendString("event"); err != nil {
+		t.Fatalf("SendString() error = %v", err)
+	}
+	<-written
+	time.Sleep(20 * time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if !c.IsAlive() {
+			t.Fatalf("IsAlive() = false, want true (LastError() = %v)", c.LastError())
+		}
+	}
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(c.conn, b); err != nil || string(b) != "x" {
+		t.Errorf("read after IsAlive() = %q, %v, want %q", b, err, "x")
+	}
+	if err := c.LastError(); err != nil {
+		t.Errorf("LastError() = %v, want nil", err)
+	}
+
+	close(kill)
+	deadline := time.Now().Add(2 * time.Second)
+	for c.IsAlive() {
+		if time.Now().After(deadline) {
+			t.Fatal("IsAlive() = true after the server closed the connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// the server closed without reading the event, so the close may be a reset
+	if err := c.LastError(); !errors.Is(err, io.EOF) && !isTransient(err) {
+		t.Errorf("LastError() = %v, want %v or a reset", err, io.EOF)
+	}
+
+	c.Close()
+	if c.IsAlive() {
+		t.Error("IsAlive() = true after Close()")
+	}
+}
@@ -0,0 +1,44 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import "net"
+
+// pipeEndpoint identifies in-memory connections, which have no address
+const pipeEndpoint = "localhost:0"
+
+// ConnectPipe returns a Conn connected in memory to a Server, without a
+// network listener, and a channel that receives the messages the server
+// reads from it. The full protocol is used, including the handshake,
+// compression and acknowledgements, so this is useful for tests and for
+// embedding a pipeline in a single process. Writes block until the server
+// reads them, so the channel must be drained. It is closed once the Conn is
+// closed and every message has been delivered.
+func ConnectPipe() (*Conn, <-chan *Message) {
+	s := NewServer(pipeEndpoint)
+	s.Logger = nil
+	s.Capabilities.Compression = true
+	messages := s.Messages()
+
+	client, server := net.Pipe()
+	go func() {
+		s.ServeConn(server)
+		s.Stop()
+	}()
+	return newConn(pipeEndpoint, client, false), messages
+}
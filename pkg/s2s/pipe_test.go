@@ -0,0 +1,112 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestConnectPipe(t *testing.T) {
+	tests := []struct {
+		name       string
+		compressed bool
+		useAck     bool
+	}{
+		{"plain", false, false},
+		{"compressed", true, false},
+		{"acknowledged", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, messages := ConnectPipe()
+			c.Compressed = tt.compressed
+			c.UseAck = tt.useAck
+
+			const n = 10
+			var want []*Message
+			for i := 0; i < n; i++ {
+				want = append(want, &Message{
+					Index:  "main",
+					Raw:    fmt.Sprintf("event %d", i),
+					Time:   time.Unix(int64(1700000000+i), 0),
+					Fields: map[string]string{"n": fmt.Sprint(i)},
+				})
+			}
+			go func() {
+				defer c.Close()
+				for _, m := range want {
+					var err error
+					if tt.useAck {
+						err = c.SendMessageAck(m)
+					} else {
+						err = c.SendMessage(m)
+					}
+					if err != nil {
+						t.Errorf("send error = %v", err)
+						return
+					}
+				}
+			}()
+
+			var got []*Message
+			for m := range messages {
+				got = append(got, m)
+			}
+			if len(got) != n {
+				t.Fatalf("received %d messages, want %d", len(got), n)
+			}
+			for i := range got {
+				if !got[i].Equal(want[i]) {
+					t.Errorf("message %d = %v, want %v", i, got[i], want[i])
+				}
+			}
+			if tt.compressed && !c.Compressed {
+				t.Errorf("Compressed = false after handshake, want true")
+			}
+		})
+	}
+}
+
+func BenchmarkSendMessagePipe(b *testing.B) {
+	for _, bc := range benchmarkSizes {
+		b.Run(bc.name, func(b *testing.B) {
+			m := newBenchmarkMessage(bc.rawSize, bc.fields)
+			size, _ := getHeaderValues(m, len(m.Raw))
+			c, messages := ConnectPipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for range messages {
+				}
+			}()
+
+			b.SetBytes(int64(size) + 4)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.SendMessage(m); err != nil {
+					b.Fatalf("SendMessage() error = %v", err)
+				}
+			}
+			c.Close()
+			<-done
+		})
+	}
+}
@@ -0,0 +1,169 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+var (
+	ErrInvalidPoolSize = errors.New("pool size must be at least one per endpoint")
+	ErrPoolClosed      = errors.New("pool is closed")
+	ErrPipelineLimit   = errors.New("pipeline limit reached")
+)
+
+// PoolEndpoint is an endpoint used by a Pool, with a relative Weight that
+// determines its share of the pool's connections
+type PoolEndpoint struct {
+	Endpoint string
+	Weight   int
+}
+
+// Pool sends messages over several connections to one or more endpoints.
+// Messages are sent round-robin across connections, which are dialed when
+// first used. A connection that fails to send is closed and redialed on its
+// next use, and the message is retried on the next connection; invalid
+// messages fail at once without affecting any connection. Each
+// connection to an endpoint is a pipeline: connections beyond the pipeline
+// level (pl) advertised by the indexer are closed after the handshake and
+// not used again, so a pool never exceeds the indexer's limit.
+type Pool struct {
+	Dial   func(endpoint string) (*Conn, error)
+	slots  []*poolSlot
+	next   atomic.Uint64
+	closed atomic.Bool
+}
+
+// poolSlot is a single connection within a Pool
+type poolSlot struct {
+	endpoint  string
+	pipeline  int
+	overLimit atomic.Bool
+	conn      lazyConn
+}
+
+// NewPool creates a pool of size connections, divided evenly across endpoints
+func NewPool(size int, endpoints ...string) (*Pool, error) {
+	weighted := make([]PoolEndpoint, len(endpoints))
+	for i, endpoint := range endpoints {
+		weighted[i] = PoolEndpoint{Endpoint: endpoint, Weight: 1}
+	}
+	return NewWeightedPool(size, weighted)
+}
+
+// NewWeightedPool creates a pool of size connections, divided across
+// endpoints in proportion to their weights. Each endpoint with a positive
+// weight receives at least one connection.
+func NewWeightedPool(size int, endpoints []PoolEndpoint) (*Pool, error) {
+	totalWeight := 0
+	active := 0
+	for _, e := range endpoints {
+		if e.Weight > 0 {
+			totalWeight += e.Weight
+			active++
+		}
+	}
+	if active == 0 || size < active {
+		return nil, ErrInvalidPoolSize
+	}
+
+	// give each endpoint one connection, then divide the rest by weight
+	counts := make([]int, len(endpoints))
+	remaining := size - active
+	assigned := 0
+	for i, e := range endpoints {
+		if e.Weight > 0 {
+			counts[i] = 1 + remaining*e.Weight/totalWeight
+			assigned += counts[i]
+		}
+	}
+	for i := 0; assigned < size; i = (i + 1) % len(endpoints) {
+		if endpoints[i].Weight > 0 {
+			counts[i]++
+			assigned++
+		}
+	}
+
+	// interleave endpoints so that round-robin spreads load between them
+	p := &Pool{Dial: Connect}
+	pipelines := make([]int, len(endpoints))
+	for len(p.slots) < size {
+		for i, e := range endpoints {
+			if counts[i] > 0 {
+				p.slots = append(p.slots, &poolSlot{endpoint: e.Endpoint, pipeline: pipelines[i]})
+				pipelines[i]++
+				counts[i]--
+			}
+		}
+	}
+	return p, nil
+}
+
+// Size returns the number of connections in the pool
+func (p *Pool) Size() int {
+	return len(p.slots)
+}
+
+// SendMessage sends a message over the next connection in the pool
+func (p *Pool) SendMessage(m *Message) error {
+	return failover(len(p.slots), func(int) error {
+		if p.closed.Load() {
+			return ErrPoolClosed
+		}
+		slot := p.slots[(p.next.Add(1)-1)%uint64(len(p.slots))]
+		if slot.overLimit.Load() {
+			return fmt.Errorf("%w: %s", ErrPipelineLimit, slot.endpoint)
+		}
+		return slot.conn.send(m, 0, func() (*Conn, error) {
+			return p.dial(slot)
+		})
+	})
+}
+
+// dial connects a slot and performs the handshake, checking that the slot is
+// within the pipeline limit advertised by the indexer
+func (p *Pool) dial(slot *poolSlot) (*Conn, error) {
+	conn, err := p.Dial(slot.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.ensureHandshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if limit := conn.Capabilities.PipelineLevel; limit > 0 && slot.pipeline >= limit {
+		conn.Close()
+		slot.overLimit.Store(true)
+		return nil, fmt.Errorf("%w: %s allows %d pipelines", ErrPipelineLimit, slot.endpoint, limit)
+	}
+	return conn, nil
+}
+
+// Close closes all connections in the pool
+func (p *Pool) Close() error {
+	p.closed.Store(true)
+	var err error
+	for _, slot := range p.slots {
+		if closeErr := slot.conn.close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewWeightedPool(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		endpoints []PoolEndpoint
+		want      map[string]int
+		wantErr   bool
+	}{
+		{
+			name:      "even weights",
+			size:      4,
+			endpoints: []PoolEndpoint{{"a:1", 1}, {"b:1", 1}},
+			want:      map[string]int{"a:1": 2, "b:1": 2},
+		},
+		{
+			name:      "uneven weights",
+			size:      4,
+			endpoints: []PoolEndpoint{{"a:1", 3}, {"b:1", 1}},
+			want:      map[string]int{"a:1": 3, "b:1": 1},
+		},
+		{
+			name:      "zero weight excluded",
+			size:      2,
+			endpoints: []PoolEndpoint{{"a:1", 1}, {"b:1", 0}},
+			want:      map[string]int{"a:1": 2},
+		},
+		{
+			name:      "too small",
+			size:      1,
+			endpoints: []PoolEndpoint{{"a:1", 1}, {"b:1", 1}},
+			wantErr:   true,
+		},
+		{
+			name:    "no endpoints",
+			size:    1,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewWeightedPool(tt.size, tt.endpoints)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("NewWeightedPool() error = nil, wantErr true")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewWeightedPool() error = %v", err)
+			}
+			if p.Size() != tt.size {
+				t.Errorf("Size() = %v, want %v", p.Size(), tt.size)
+			}
+			got := map[string]int{}
+			for _, slot := range p.slots {
+				got[slot.endpoint]++
+			}
+			for endpoint, n := range tt.want {
+				if got[endpoint] != n {
+					t.Errorf("connections to %s = %v, want %v", endpoint, got[endpoint], n)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolSendMessage(t *testing.T) {
+	var mu sync.Mutex
+	perConn := map[string]int{}
+	s := NewServer("127.0.0.1:0")
+	s.Logger = nil
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		perConn[info.RemoteAddr.String()]++
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	p, err := NewPool(3, s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 9; i++ {
+		if err := p.SendMessage(&Message{Raw: "pooled message"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+
+	// break the connection in the next slot, which should be evicted and redialed
+	dead := p.slots[0].conn.conn
+	dead.conn.Close()
+	for i := 0; i < 3; i++ {
+		if err := p.SendMessage(&Message{Raw: "pooled message"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	if p.slots[0].conn.conn == dead {
+		t.Error("dead connection was not evicted")
+	}
+
+	// wait for the server to handle all messages
+	want := 12
+	for i := 0; i < 200; i++ {
+		mu.Lock()
+		total := 0
+		for _, n := range perConn {
+			total += n
+		}
+		mu.Unlock()
+		if total == want {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	total := 0
+	for _, n := range perConn {
+		total += n
+	}
+	if total != want {
+		t.Errorf("server received %d messages, want %d", total, want)
+	}
+	// three original connections plus the replacement for the dead one
+	if len(perConn) != 4 {
+		t.Errorf("messages were sent over %d connections, want 4", len(perConn))
+	}
+}
+
+func TestPoolPipelineLimit(t *testing.T) {
+	var mu sync.Mutex
+	perConn := map[string]int{}
+	s := NewServer("127.0.0.1:0")
+	s.Logger = nil
+	s.Capabilities.PipelineLevel = 2
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		perConn[info.RemoteAddr.String()]++
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	p, err := NewPool(4, s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+
+	for i := 0; i < 8; i++ {
+		if err := p.SendMessage(&Message{Raw: "pooled message"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	for i, slot := range p.slots {
+		if got, want := slot.overLimit.Load(), i >= 2; got != want {
+			t.Errorf("slot %d overLimit = %v, want %v", i, got, want)
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		mu.Lock()
+		total := 0
+		for _, n := range perConn {
+			total += n
+		}
+		mu.Unlock()
+		if total == 8 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(perConn) != 2 {
+		t.Errorf("messages received on %d connections, want 2: %v", len(perConn), perConn)
+	}
+}
+
+// invalidMessages are messages that fail validation before anything is written
+var invalidMessages = []struct {
+	name    string
+	m       *Message
+	wantErr error
+}{
+	{"nil", nil, ErrNilMessage},
+	{"reserved field", &Message{Index: "main", Fields: map[string]string{"_raw": "x"}, Raw: "event"}, ErrReservedField},
+	{"invalid field name", &Message{Index: "main", Fields: map[string]string{"bad\x00key": "x"}, Raw: "event"}, ErrInvalidFieldName},
+	{"missing index", &Message{Raw: "event"}, ErrMissingIndex},
+}
+
+func TestPoolInvalidMessage(t *testing.T) {
+	s := startTestServer(t)
+	p, err := NewPool(3, s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("NewPool() error = %v", err)
+	}
+	defer p.Close()
+	dials := 0
+	p.Dial = func(endpoint string) (*Conn, error) {
+		dials++
+		c, err := Connect(endpoint)
+		if err == nil {
+			c.RequireIndex = true
+		}
+		return c, err
+	}
+
+	valid := &Message{Index: "main", Raw: "pooled message"}
+	for i := 0; i < p.Size(); i++ {
+		if err := p.SendMessage(valid); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	for _, tt := range invalidMessages {
+		if err := p.SendMessage(tt.m); !errors.Is(err, tt.wantErr) {
+			t.Errorf("SendMessage(%s) error = %v, want %v", tt.name, err, tt.wantErr)
+		}
+	}
+	for i := 0; i < p.Size(); i++ {
+		if err := p.SendMessage(valid); err != nil {
+			t.Fatalf("SendMessage() after invalid messages error = %v", err)
+		}
+	}
+	if dials != p.Size() {
+		t.Errorf("dialed %d times, want %d", dials, p.Size())
+	}
+}
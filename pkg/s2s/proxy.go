@@ -0,0 +1,242 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrProxy is returned when a proxy refuses or fails to establish a connection
+var ErrProxy = errors.New("proxy connection failed")
+
+// ProxyDialer returns a DialFunc that connects through the proxy at proxyURL,
+// which may be "socks5://[user:pass@]host:port" or "http://[user:pass@]host:port".
+// The connection to the proxy itself is made using forward, or a default
+// dialer if it is nil. TLS handshakes are performed over the proxied connection.
+func ProxyDialer(proxyURL string, forward DialFunc) (DialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL: missing host")
+	}
+
+	var handshake func(conn net.Conn, u *url.URL, address string) (net.Conn, error)
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		handshake = socks5Handshake
+	case "http":
+		handshake = httpConnectHandshake
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+	}
+
+	dial := dialer(forward)
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if network != "tcp" {
+			return nil, fmt.Errorf("%w: unsupported network %q", ErrProxy, network)
+		}
+
+		conn, err := dial(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		// bound the proxy handshake by the context deadline
+		if deadline, ok := ctx.Deadline(); ok {
+			if err := conn.SetDeadline(deadline); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+
+		proxied, err := handshake(conn, u, address)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return proxied, nil
+	}, nil
+}
+
+// socks5Handshake asks a SOCKS5 proxy (RFC 1928) to connect to address
+func socks5Handshake(conn net.Conn, u *url.URL, address string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %q", portStr)
+	}
+
+	// negotiate the authentication method
+	methods := []byte{0x00}
+	if u.User != nil {
+		methods = []byte{0x00, 0x02}
+	}
+	greeting := append([]byte{0x05, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return nil, err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return nil, err
+	}
+	if reply[0] != 0x05 {
+		return nil, fmt.Errorf("%w: unexpected SOCKS version %d", ErrProxy, reply[0])
+	}
+
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		// username/password authentication (RFC 1929)
+		if u.User == nil {
+			return nil, fmt.Errorf("%w: proxy requires authentication", ErrProxy)
+		}
+		username := u.User.Username()
+		password, _ := u.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return nil, fmt.Errorf("%w: credentials too long", ErrProxy)
+		}
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return nil, err
+		}
+		if reply[1] != 0x00 {
+			return nil, fmt.Errorf("%w: authentication rejected", ErrProxy)
+		}
+	default:
+		return nil, fmt.Errorf("%w: no acceptable authentication method", ErrProxy)
+	}
+
+	// request a connection to the destination
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("%w: host name too long", ErrProxy)
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 0x01)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 0x04)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	// read the reply, skipping the bound address
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return nil, err
+	}
+	if header[1] != 0x00 {
+		return nil, fmt.Errorf("%w: SOCKS5 reply code %d", ErrProxy, header[1])
+	}
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return nil, err
+		}
+		addrLen = int(l[0])
+	default:
+		return nil, fmt.Errorf("%w: unknown SOCKS5 address type %d", ErrProxy, header[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, addrLen+2)); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// httpConnectHandshake asks an HTTP proxy to connect to address using CONNECT
+func httpConnectHandshake(conn net.Conn, u *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req.SetBasicAuth(u.User.Username(), password)
+		req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: %s", ErrProxy, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn that first returns data already buffered by a reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,229 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startTestProxy starts a proxy that reports each destination it was asked to
+// connect to and then relays data to it
+func startTestProxy(t *testing.T, handshake func(conn net.Conn) (string, error)) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	destinations := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dest, err := handshake(conn)
+				if err != nil {
+					return
+				}
+				destinations <- dest
+				upstream, err := net.Dial("tcp", dest)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() {
+					io.Copy(upstream, conn)
+					upstream.Close()
+				}()
+				io.Copy(conn, upstream)
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), destinations
+}
+
+// socks5TestHandshake implements the server side of a SOCKS5 handshake
+// requiring username "user" and password "pass"
+func socks5TestHandshake(conn net.Conn) (string, error) {
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(conn, make([]byte, greeting[1])); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write([]byte{0x05, 0x02}); err != nil {
+		return "", err
+	}
+
+	var auth [2]byte
+	if _, err := io.ReadFull(conn, auth[:]); err != nil {
+		return "", err
+	}
+	username := make([]byte, auth[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return "", err
+	}
+	var plen [1]byte
+	if _, err := io.ReadFull(conn, plen[:]); err != nil {
+		return "", err
+	}
+	password := make([]byte, plen[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return "", err
+	}
+	if string(username) != "user" || string(password) != "pass" {
+		conn.Write([]byte{0x01, 0x01})
+		return "", ErrProxy
+	}
+	if _, err := conn.Write([]byte{0x01, 0x00}); err != nil {
+		return "", err
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(conn, req[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 0x01:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 0x03:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", ErrProxy
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return "", err
+	}
+
+	if _, err := conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// httpConnectTestHandshake implements the server side of an HTTP CONNECT request
+func httpConnectTestHandshake(conn net.Conn) (string, error) {
+	req, err := http.ReadRequest(bufio.NewReader(conn))
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		return "", ErrProxy
+	}
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return "", err
+	}
+	return req.Host, nil
+}
+
+func TestProxyDialer(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheme    string
+		handshake func(conn net.Conn) (string, error)
+	}{
+		{"socks5", "socks5://user:pass@", socks5TestHandshake},
+		{"http connect", "http://", httpConnectTestHandshake},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("127.0.0.1:0")
+			s.Logger = nil
+			messages := s.Messages()
+			if err := s.Start(); err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+			defer s.Stop()
+			endpoint := s.listener.Addr().String()
+
+			proxyAddr, destinations := startTestProxy(t, tt.handshake)
+			dial, err := ProxyDialer(tt.scheme+proxyAddr, nil)
+			if err != nil {
+				t.Fatalf("ProxyDialer() error = %v", err)
+			}
+
+			c, err := ConnectWithDialer(endpoint, dial)
+			if err != nil {
+				t.Fatalf("ConnectWithDialer() error = %v", err)
+			}
+			defer c.Close()
+			if err := c.SendMessage(&Message{Raw: "proxied message"}); err != nil {
+				t.Fatalf("SendMessage() error = %v", err)
+			}
+
+			if got := <-destinations; got != endpoint {
+				t.Errorf("proxy connected to %v, want %v", got, endpoint)
+			}
+			select {
+			case m := <-messages:
+				if m.Raw != "proxied message" {
+					t.Errorf("received %v, want proxied message", m)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for message")
+			}
+		})
+	}
+}
+
+func TestProxyDialerAuthFailure(t *testing.T) {
+	proxyAddr, _ := startTestProxy(t, socks5TestHandshake)
+	dial, err := ProxyDialer("socks5://user:wrong@"+proxyAddr, nil)
+	if err != nil {
+		t.Fatalf("ProxyDialer() error = %v", err)
+	}
+	if _, err := ConnectWithDialer("127.0.0.1:9997", dial); err == nil {
+		t.Error("ConnectWithDialer() error = nil, want authentication error")
+	}
+}
+
+func TestProxyDialerInvalidURL(t *testing.T) {
+	for _, proxyURL := range []string{"ftp://proxy:21", "socks5://", "://bad"} {
+		if _, err := ProxyDialer(proxyURL, nil); err == nil {
+			t.Errorf("ProxyDialer(%q) error = nil, want error", proxyURL)
+		}
+	}
+}
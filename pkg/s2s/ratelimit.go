@@ -0,0 +1,123 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrRateLimited is returned when a message would exceed a rate limit and
+// the RateLimiter is configured to reject rather than wait
+var ErrRateLimited = errors.New("rate limit exceeded")
+
+// RateLimiter limits the rate at which messages are sent, in messages per
+// second and/or bytes per second. A rate of zero is unlimited. Messages are
+// paced evenly without bursts, so sending n messages at a rate of r per second
+// takes at least n/r seconds. If Reject is set, messages that would exceed a
+// limit return ErrRateLimited instead of waiting. A RateLimiter may be shared
+// by several connections, and its limits may be changed while in use.
+type RateLimiter struct {
+	Reject bool
+	mu     sync.Mutex
+	limits [2]float64
+	debt   [2]float64
+	last   time.Time
+}
+
+// NewRateLimiter creates a RateLimiter with the given limits
+func NewRateLimiter(messagesPerSec, bytesPerSec float64) *RateLimiter {
+	rl := &RateLimiter{}
+	rl.SetLimits(messagesPerSec, bytesPerSec)
+	return rl
+}
+
+// SetLimits changes the limits, in messages per second and bytes per second
+func (rl *RateLimiter) SetLimits(messagesPerSec, bytesPerSec float64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	rl.refill(time.Now())
+	rl.limits = [2]float64{messagesPerSec, bytesPerSec}
+}
+
+// Limits returns the current limits, in messages per second and bytes per second
+func (rl *RateLimiter) Limits() (messagesPerSec, bytesPerSec float64) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.limits[0], rl.limits[1]
+}
+
+// wait blocks until the given number of messages and bytes may be sent, or
+// returns ErrRateLimited if Reject is set and they may not be sent now. It
+// returns net.ErrClosed if done is closed while waiting.
+func (rl *RateLimiter) wait(done <-chan struct{}, messages, bytes int) error {
+	rl.mu.Lock()
+	rl.refill(time.Now())
+
+	// when rejecting, send only if earlier messages have been paid for
+	if rl.Reject {
+		defer rl.mu.Unlock()
+		if rl.debt[0] > 0 || rl.debt[1] > 0 {
+			return ErrRateLimited
+		}
+		rl.debt[0] += float64(messages)
+		rl.debt[1] += float64(bytes)
+		return nil
+	}
+
+	// otherwise take on the debt and wait until it will have been paid
+	rl.debt[0] += float64(messages)
+	rl.debt[1] += float64(bytes)
+	var delay time.Duration
+	for i, limit := range rl.limits {
+		if limit <= 0 {
+			continue
+		}
+		if d := time.Duration(rl.debt[i] / limit * float64(time.Second)); d > delay {
+			delay = d
+		}
+	}
+	rl.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-done:
+		return net.ErrClosed
+	}
+}
+
+// refill pays off the debt accrued since the last call
+func (rl *RateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(rl.last).Seconds()
+	rl.last = now
+	for i, limit := range rl.limits {
+		if limit <= 0 {
+			rl.debt[i] = 0
+			continue
+		}
+		rl.debt[i] = max(rl.debt[i]-elapsed*limit, 0)
+	}
+}
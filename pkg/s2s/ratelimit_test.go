@@ -0,0 +1,134 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterWait(t *testing.T) {
+	tests := []struct {
+		name           string
+		messagesPerSec float64
+		bytesPerSec    float64
+		messages       int
+		bytes          int
+		want           time.Duration
+	}{
+		{"messages per second", 100, 0, 10, 1, 100 * time.Millisecond},
+		{"bytes per second", 0, 1000, 10, 10, 100 * time.Millisecond},
+		{"both limits", 100, 1000, 5, 40, 200 * time.Millisecond},
+		{"unlimited", 0, 0, 10, 1000, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := NewRateLimiter(tt.messagesPerSec, tt.bytesPerSec)
+			start := time.Now()
+			for i := 0; i < tt.messages; i++ {
+				if err := rl.wait(nil, 1, tt.bytes); err != nil {
+					t.Fatalf("wait() error = %v", err)
+				}
+			}
+			elapsed := time.Since(start)
+			if elapsed < tt.want || elapsed > tt.want+time.Second {
+				t.Errorf("sending took %v, want at least %v", elapsed, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterReject(t *testing.T) {
+	rl := NewRateLimiter(20, 0)
+	rl.Reject = true
+	if err := rl.wait(nil, 1, 100); err != nil {
+		t.Fatalf("wait() error = %v", err)
+	}
+	if err := rl.wait(nil, 1, 100); err != ErrRateLimited {
+		t.Errorf("wait() error = %v, want %v", err, ErrRateLimited)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := rl.wait(nil, 1, 100); err != nil {
+		t.Errorf("wait() after pause error = %v", err)
+	}
+
+	// raising the limit at runtime takes effect immediately
+	rl.SetLimits(0, 0)
+	if err := rl.wait(nil, 1, 100); err != nil {
+		t.Errorf("wait() after SetLimits() error = %v", err)
+	}
+	if m, b := rl.Limits(); m != 0 || b != 0 {
+		t.Errorf("Limits() = %v, %v, want 0, 0", m, b)
+	}
+}
+
+func TestSendMessageRateLimited(t *testing.T) {
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.CloseNow()
+	c.Version = 2
+
+	const n, rate = 20, 100
+	c.RateLimiter = NewRateLimiter(rate, 0)
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		if err := c.SendMessage(&Message{Raw: "event"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	if elapsed, want := time.Since(start), time.Duration(n)*time.Second/rate; elapsed < want {
+		t.Errorf("sending %d messages at %d/sec took %v, want at least %v", n, rate, elapsed, want)
+	}
+}
+
+func TestSendMessageRateLimitedClose(t *testing.T) {
+	endpoint := startMockIndexer(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn)
+	})
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	c.Version = 2
+
+	// the first message waits ten seconds at this rate
+	c.RateLimiter = NewRateLimiter(0.1, 0)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- c.SendMessage(&Message{Raw: "event"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.CloseNow()
+
+	select {
+	case err := <-sent:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("SendMessage() error = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("SendMessage() was not interrupted by CloseNow()")
+	}
+}
@@ -0,0 +1,96 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultRelayRetries is the default number of times a relay redials on failure
+	DefaultRelayRetries = 3
+
+	// DefaultRelayRetryDelay is the default delay between relay redial attempts
+	DefaultRelayRetryDelay = 1 * time.Second
+)
+
+// RelayHandler is a Handler that forwards every received message to a
+// downstream server. Messages are sent one at a time over a single outbound
+// connection, so a slow downstream server applies backpressure to inbound
+// connections. If sending fails, the outbound connection is redialed up to
+// MaxRetries times before the error is returned to the Server.
+type RelayHandler struct {
+	Dial       func() (*Conn, error)
+	MaxRetries int
+	RetryDelay time.Duration
+	mu         sync.Mutex
+	conn       *Conn
+}
+
+// NewRelayHandler creates a RelayHandler that forwards messages to endpoint
+func NewRelayHandler(endpoint string) *RelayHandler {
+	return &RelayHandler{
+		Dial: func() (*Conn, error) {
+			return Connect(endpoint)
+		},
+		MaxRetries: DefaultRelayRetries,
+		RetryDelay: DefaultRelayRetryDelay,
+	}
+}
+
+// HandleMessage forwards a message to the downstream server
+func (h *RelayHandler) HandleMessage(info ConnInfo, m *Message) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var err error
+	for attempt := 0; attempt <= h.MaxRetries; attempt++ {
+		if attempt > 0 && h.RetryDelay > 0 {
+			time.Sleep(h.RetryDelay)
+		}
+
+		if h.conn == nil {
+			h.conn, err = h.Dial()
+			if err != nil {
+				continue
+			}
+		}
+
+		if err = h.conn.SendMessage(m); err == nil {
+			return nil
+		}
+
+		// drop the broken connection so that the next attempt redials
+		h.conn.Close()
+		h.conn = nil
+	}
+	return err
+}
+
+// Close closes the outbound connection
+func (h *RelayHandler) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.conn == nil {
+		return nil
+	}
+	err := h.conn.Close()
+	h.conn = nil
+	return err
+}
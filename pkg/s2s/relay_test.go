@@ -0,0 +1,77 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRelayHandler(t *testing.T) {
+	downstream := NewServer("127.0.0.1:0")
+	downstream.Logger = nil
+	messages := downstream.Messages()
+	if err := downstream.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer downstream.Stop()
+
+	relay := NewRelayHandler(downstream.listener.Addr().String())
+	relay.RetryDelay = 0
+	defer relay.Close()
+
+	inbound := NewServer("127.0.0.1:0")
+	inbound.Logger = nil
+	inbound.Handler = relay
+	if err := inbound.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer inbound.Stop()
+
+	c, err := Connect(inbound.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+
+	want := []*Message{
+		{Index: "main", Host: "host1", Source: "source1", SourceType: "type1", Raw: "first", Fields: map[string]string{"key": "value"}},
+		{Index: "other", Raw: "second"},
+	}
+	for i, m := range want {
+		// break the outbound connection to force a redial
+		if i == 1 {
+			relay.mu.Lock()
+			relay.conn.conn.Close()
+			relay.mu.Unlock()
+		}
+
+		if err := c.SendMessageAck(m); err != nil {
+			t.Fatalf("SendMessageAck() error = %v", err)
+		}
+		select {
+		case got := <-messages:
+			if got.String() != m.String() {
+				t.Errorf("downstream received %v, want %v", got, m)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timed out waiting for %v", m)
+		}
+	}
+}
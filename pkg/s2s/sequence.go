@@ -0,0 +1,63 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// When Conn.UseSequence is enabled, every message carries an "_s2s_seq" field
+// holding a per-connection sequence number starting at 1. When
+// Server.VerifySequence is enabled, the server removes the field and logs any
+// gaps, duplicates or reordering it detects.
+
+// sequenceKey is the field used to carry the message sequence number
+const sequenceKey = "_s2s_seq"
+
+// sequenceChecker verifies that sequence numbers on a connection increase by one
+type sequenceChecker struct {
+	last uint64
+}
+
+// check removes the sequence number from the message and returns a
+// description of the problem if it is not the next expected number
+func (sc *sequenceChecker) check(m *Message) string {
+	value, ok := m.Fields[sequenceKey]
+	if !ok {
+		return ""
+	}
+	delete(m.Fields, sequenceKey)
+
+	seq, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return fmt.Sprintf("invalid sequence number %q", value)
+	}
+
+	expected := sc.last + 1
+	switch {
+	case seq == expected:
+		sc.last = seq
+		return ""
+	case seq > expected:
+		sc.last = seq
+		return fmt.Sprintf("sequence gap: expected %d, got %d (%d missing)", expected, seq, seq-expected)
+	default:
+		return fmt.Sprintf("duplicate or reordered sequence: expected %d, got %d", expected, seq)
+	}
+}
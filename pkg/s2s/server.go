@@ -18,49 +18,138 @@
 package s2s
 
 import (
+	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
-	"strings"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 )
 
-// Server represents a Splunk-to-Splunk server that can accept connections
+const (
+	// DefaultStopTimeout is the default time Stop waits for connections to close
+	DefaultStopTimeout = 5 * time.Second
+
+	// drainPollInterval is how often Drain checks whether messages are queued
+	drainPollInterval = 10 * time.Millisecond
+
+	// minAcceptDelay and maxAcceptDelay bound the backoff after temporary accept errors
+	minAcceptDelay = 5 * time.Millisecond
+	maxAcceptDelay = 1 * time.Second
+)
+
+var (
+	// ErrDuplicateHandshake is returned when a signature is received mid-stream
+	ErrDuplicateHandshake = errors.New("duplicate handshake signature received")
+	// ErrStopTimeout is returned when connections were still open after StopTimeout
+	ErrStopTimeout = errors.New("timed out waiting for connections to close")
+)
+
+// Logger is used by Server to log connection activity and errors.
+// It is satisfied by *log.Logger. A nil Logger disables logging.
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Server represents a Splunk-to-Splunk server that can accept connections.
+// Endpoint is either "host:port" or "unix://<path>" for a Unix domain socket.
+// Received messages are passed to Handler, and discarded if it is nil.
+// If MaxConnections is set, connections over the limit are closed, or queued
+// until another connection closes if BlockOnMaxConns is set. If ReadTimeout is
+// set, connections that do not complete the handshake or a message within it
+// are closed. If ParseMeta is set, indexed fields packed into _meta are
+// unpacked into Fields before messages are handled. If LenientDecode is set,
+// messages without the padding and trailer that should follow their fields are
+// accepted with a warning, as with Decoder. If StampReceiveTime is set,
+// messages without a _time are handled with Time set to when they were
+// received and ReceiveTime set to true. Messages larger than MaxMessageSize,
+// or DefaultMaxMessageSize if it is zero, are discarded as they are read and
+// logged, and the connection continues with the next message. Messages with
+// Raw compressed by CompressRaw are decompressed, within the same limit,
+// before they are handled. If
+// StructuredLogger is set, it is used instead of Logger, and events are logged
+// at their level with attributes using the LogKey constants as keys.
 type Server struct {
-	Endpoint    string
-	Encrypted   bool
-	CertFile    string
-	KeyFile     string
-	InsecureTLS bool
-	listener    net.Listener
-	stopChan    chan struct{}
+	Endpoint          string
+	Encrypted         bool
+	CertFile          string
+	KeyFile           string
+	InsecureTLS       bool
+	Handler           Handler
+	Logger            Logger
+	StructuredLogger  *slog.Logger
+	MessageBufferSize int
+	DropMessages      bool
+	StopTimeout       time.Duration
+	VerifySequence    bool
+	ParseMeta         bool
+	LenientDecode     bool
+	MaxMessageSize    int
+	StampReceiveTime  bool
+	MaxConnections    int
+	BlockOnMaxConns   bool
+	ReadTimeout       time.Duration
+	Capabilities      Capabilities
+	listener          net.Listener
+	stopChan          chan struct{}
+	stopOnce          sync.Once
+	messages          *channelHandler
+	wg                sync.WaitGroup
+	connsMu           sync.Mutex
+	conns             map[net.Conn]struct{}
+	connSlots         chan struct{}
+	stats             serverCounters
 }
 
-// NewServer creates a new unencrypted Splunk-to-Splunk server
+// NewServer creates a new unencrypted Splunk-to-Splunk server.
+// Received messages are discarded unless Handler is set, or Messages is
+// called, and activity is logged to the standard logger unless Logger is
+// changed.
 func NewServer(endpoint string) *Server {
 	return &Server{
-		Endpoint:  endpoint,
-		Encrypted: false,
-		stopChan:  make(chan struct{}),
+		Endpoint:          endpoint,
+		Encrypted:         false,
+		Logger:            log.Default(),
+		MessageBufferSize: DefaultMessageBufferSize,
+		StopTimeout:       DefaultStopTimeout,
+		Capabilities:      DefaultServerCapabilities,
+		stopChan:          make(chan struct{}),
+		conns:             make(map[net.Conn]struct{}),
 	}
 }
 
 // NewTLSServer creates a new TLS-enabled Splunk-to-Splunk server
 func NewTLSServer(endpoint, certFile, keyFile string, insecureTLS bool) *Server {
 	return &Server{
-		Endpoint:    endpoint,
-		Encrypted:   true,
-		CertFile:    certFile,
-		KeyFile:     keyFile,
-		InsecureTLS: insecureTLS,
-		stopChan:    make(chan struct{}),
+		Endpoint:          endpoint,
+		Encrypted:         true,
+		CertFile:          certFile,
+		KeyFile:           keyFile,
+		InsecureTLS:       insecureTLS,
+		Logger:            log.Default(),
+		MessageBufferSize: DefaultMessageBufferSize,
+		StopTimeout:       DefaultStopTimeout,
+		Capabilities:      DefaultServerCapabilities,
+		stopChan:          make(chan struct{}),
+		conns:             make(map[net.Conn]struct{}),
 	}
 }
 
 // Start starts the server and begins accepting connections
 func (s *Server) Start() error {
+	network, address := splitEndpoint(s.Endpoint)
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+
 	var err error
 	if s.Encrypted {
 		var cert tls.Certificate
@@ -71,120 +160,555 @@ func (s *Server) Start() error {
 
 		config := &tls.Config{
 			Certificates: []tls.Certificate{cert},
-			MinVersion:   tls.VersionTLS12,
+			MinVersion:   DefaultMinTLSVersion,
 		}
 		if s.InsecureTLS {
 			config.InsecureSkipVerify = true
 		}
 
-		s.listener, err = tls.Listen("tcp", s.Endpoint, config)
+		s.listener, err = tls.Listen(network, address, config)
 	} else {
-		s.listener, err = net.Listen("tcp", s.Endpoint)
+		s.listener, err = net.Listen(network, address)
 	}
 
 	if err != nil {
 		return fmt.Errorf("failed to start server: %v", err)
 	}
 
+	if s.MaxConnections > 0 {
+		s.connSlots = make(chan struct{}, s.MaxConnections)
+	}
+
+	s.wg.Add(1)
 	go s.acceptConnections()
 
 	return nil
 }
 
-// Stop stops the server and closes all connections
+// Messages returns a channel that receives every message decoded by the
+// server, replacing Handler, and must be called before Start. Messages from
+// a single connection are delivered in the order they were received, but
+// there is no ordering between connections. When the channel is full, the
+// server blocks reading from that connection unless DropMessages is set.
+// The channel is closed when the server is stopped.
+func (s *Server) Messages() <-chan *Message {
+	if s.messages == nil {
+		s.messages = newChannelHandler(s.MessageBufferSize, s.DropMessages, s.stopChan)
+		s.Handler = s.messages
+	}
+	return s.messages.ch
+}
+
+// Addr returns the address the server is listening on, or nil if it has not
+// been started. This is useful when Endpoint uses port 0.
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// ActiveConnections returns the number of connections currently being handled
+func (s *Server) ActiveConnections() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return len(s.conns)
+}
+
+// Stats returns a snapshot of the counters for the server. DecodeErrors
+// counts connections closed because of an invalid signature or message.
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		TotalConnections:  s.stats.totalConnections.Load(),
+		ActiveConnections: s.ActiveConnections(),
+		MessagesReceived:  s.stats.messagesReceived.Load(),
+		ControlMessages:   s.stats.controlMessages.Load(),
+		DecodeErrors:      s.stats.decodeErrors.Load(),
+	}
+}
+
+// Stop stops accepting connections and waits for open connections to be
+// closed by their clients, so that messages already received are handled.
+// Connections still open after StopTimeout are closed and ErrStopTimeout is
+// returned. A StopTimeout of zero waits indefinitely. Closing the listener
+// also removes the socket file of a Unix domain socket endpoint.
 func (s *Server) Stop() error {
-	close(s.stopChan)
-	if s.listener != nil {
-		return s.listener.Close()
+	ctx := context.Background()
+	if s.StopTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.StopTimeout)
+		defer cancel()
+	}
+	return s.stop(ctx)
+}
+
+// Drain stops the server like Stop, but waits until ctx expires rather than
+// StopTimeout, and then waits for the consumer to empty the channel returned
+// by Messages, so that every message received has been handled when it
+// returns nil. If ctx expires before the connections are closed, they are
+// closed and ErrStopTimeout is returned. If it expires while messages are
+// still queued, the error wraps ctx.Err() and reports how many remain.
+func (s *Server) Drain(ctx context.Context) error {
+	if err := s.stop(ctx); err != nil || s.messages == nil {
+		return err
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for n := len(s.messages.ch); n > 0; n = len(s.messages.ch) {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %d messages still queued", ctx.Err(), n)
+		case <-ticker.C:
+		}
 	}
 	return nil
 }
 
+// stop stops the server, closing connections still open when ctx expires
+func (s *Server) stop(ctx context.Context) error {
+	var err error
+	s.stopOnce.Do(func() {
+		// close stopChan holding connsMu, so that ServeConn cannot add a
+		// connection to the wait group once it has been checked
+		s.connsMu.Lock()
+		close(s.stopChan)
+		s.connsMu.Unlock()
+		if s.listener != nil {
+			err = s.listener.Close()
+		}
+
+		if !s.waitForConnections(ctx) {
+			s.connsMu.Lock()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.connsMu.Unlock()
+			s.wg.Wait()
+			if err == nil {
+				err = ErrStopTimeout
+			}
+		}
+
+		if s.messages != nil {
+			s.messages.close()
+		}
+	})
+	return err
+}
+
+// waitForConnections waits for all connections to finish, returning false
+// if ctx expires first
+func (s *Server) waitForConnections(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
 // acceptConnections handles incoming connections
 func (s *Server) acceptConnections() {
+	defer s.wg.Done()
+	var tempDelay time.Duration
 	for {
 		select {
 		case <-s.stopChan:
 			return
 		default:
+			// wait for a free slot before accepting if limited and blocking
+			if s.connSlots != nil && s.BlockOnMaxConns {
+				select {
+				case s.connSlots <- struct{}{}:
+				case <-s.stopChan:
+					return
+				}
+			}
+
 			conn, err := s.listener.Accept()
 			if err != nil {
-				if !errors.Is(err, net.ErrClosed) {
-					log.Printf("Error accepting connection: %v", err)
+				if s.connSlots != nil && s.BlockOnMaxConns {
+					<-s.connSlots
+				}
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
+				if !isTemporary(err) {
+					if !logAttrs(s.StructuredLogger, slog.LevelError, "accept failed, stopping", errorAttr(err)) {
+						s.logf("Error accepting connection, stopping: %v", err)
+					}
+					return
+				}
+
+				// back off on temporary errors such as running out of file descriptors
+				if tempDelay == 0 {
+					tempDelay = minAcceptDelay
+				} else {
+					tempDelay *= 2
+				}
+				if tempDelay > maxAcceptDelay {
+					tempDelay = maxAcceptDelay
+				}
+				if !logAttrs(s.StructuredLogger, slog.LevelWarn, "accept failed, retrying", errorAttr(err),
+					slog.Duration(LogKeyDuration, tempDelay)) {
+					s.logf("Error accepting connection: %v; retrying in %v", err, tempDelay)
+				}
+				timer := time.NewTimer(tempDelay)
+				select {
+				case <-s.stopChan:
+					timer.Stop()
+					return
+				case <-timer.C:
 				}
 				continue
 			}
+			tempDelay = 0
 
-			go s.handleConnection(conn)
+			// reject connections over the limit if not blocking
+			if s.connSlots != nil && !s.BlockOnMaxConns {
+				select {
+				case s.connSlots <- struct{}{}:
+				default:
+					if !logAttrs(s.StructuredLogger, slog.LevelWarn, "connection limit reached", remoteAddrAttr(conn),
+						slog.Int(LogKeyLimit, s.MaxConnections)) {
+						s.logf("Rejecting connection from %s: limit of %d connections reached", conn.RemoteAddr(), s.MaxConnections)
+					}
+					conn.Close()
+					continue
+				}
+			}
+
+			s.connsMu.Lock()
+			s.conns[conn] = struct{}{}
+			s.connsMu.Unlock()
+			s.stats.totalConnections.Add(1)
+
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				defer func() {
+					s.connsMu.Lock()
+					delete(s.conns, conn)
+					s.connsMu.Unlock()
+					if s.connSlots != nil {
+						<-s.connSlots
+					}
+				}()
+				s.handleConnection(conn)
+			}()
 		}
 	}
 }
 
+// ServeConn handles a client connection that was not accepted by the
+// server's listener, such as one end of a net.Pipe, until it is closed. The
+// server does not need to be started, and Stop closes the connection.
+func (s *Server) ServeConn(conn net.Conn) {
+	s.connsMu.Lock()
+	select {
+	case <-s.stopChan:
+		s.connsMu.Unlock()
+		conn.Close()
+		return
+	default:
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	s.connsMu.Unlock()
+	s.stats.totalConnections.Add(1)
+
+	defer s.wg.Done()
+	defer func() {
+		s.connsMu.Lock()
+		delete(s.conns, conn)
+		s.connsMu.Unlock()
+	}()
+	s.handleConnection(conn)
+}
+
 // handleConnection processes a single client connection
 func (s *Server) handleConnection(conn net.Conn) {
 	defer conn.Close()
 
-	// Read and verify signature
-	signature := make([]byte, 128)
-	if _, err := io.ReadFull(conn, signature); err != nil {
-		log.Printf("Failed to read signature: %v", err)
+	// Read and verify the handshake
+	if err := s.setReadDeadline(conn); err != nil {
+		if !logAttrs(s.StructuredLogger, slog.LevelError, "setting read deadline failed", remoteAddrAttr(conn), errorAttr(err)) {
+			s.logf("Failed to set read deadline: %v", err)
+		}
 		return
 	}
-
-	// The signature includes null padding, so we need to trim it before comparing
-	var version int
-	sigStr := strings.TrimRight(string(signature), "\x00")
-	switch sigStr {
-	case "--splunk-cooked-mode-v2--":
-		version = 2
-	case "--splunk-cooked-mode-v3--":
-		version = 3
-	default:
-		log.Printf("Invalid signature received: %q", sigStr)
+	handshake, err := ReadHandshake(conn)
+	if err != nil {
+		if errors.Is(err, ErrInvalidSignature) {
+			if !logAttrs(s.StructuredLogger, slog.LevelWarn, "invalid signature", remoteAddrAttr(conn), errorAttr(err)) {
+				s.logf("Invalid signature received from %s: %v", conn.RemoteAddr(), err)
+			}
+			s.stats.decodeErrors.Add(1)
+		} else {
+			if !logAttrs(s.StructuredLogger, slog.LevelWarn, "handshake failed", remoteAddrAttr(conn), errorAttr(err)) {
+				s.logf("Failed to read handshake: %v", err)
+			}
+		}
 		return
 	}
-	log.Printf("Received v%d connection from %s", version, conn.RemoteAddr())
+	if !logAttrs(s.StructuredLogger, slog.LevelInfo, "connection accepted", remoteAddrAttr(conn),
+		slog.Int(LogKeyVersion, handshake.Version), slog.String(LogKeyServerName, handshake.ServerName)) {
+		s.logf("Received v%d connection from %s", handshake.Version, conn.RemoteAddr())
+	}
+	info := ConnInfo{
+		RemoteAddr:     conn.RemoteAddr(),
+		Version:        handshake.Version,
+		ServerName:     handshake.ServerName,
+		ManagementPort: handshake.ManagementPort,
+	}
 
-	// Read server name and management port (we don't use these)
-	serverName := make([]byte, 256)
-	mgmtPort := make([]byte, 16)
-	if _, err := io.ReadFull(conn, serverName); err != nil {
-		log.Printf("Failed to read server name: %v", err)
-		return
+	received, err := s.readMessages(conn, info)
+	reason := disconnectReason(err)
+	if reason == DisconnectProtocolError {
+		s.stats.decodeErrors.Add(1)
+	}
+	s.logDisconnect(conn, reason, received, err)
+	if h, ok := s.Handler.(DisconnectHandler); ok {
+		h.OnDisconnect(info, reason)
 	}
-	if _, err := io.ReadFull(conn, mgmtPort); err != nil {
-		log.Printf("Failed to read management port: %v", err)
+}
+
+// logDisconnect logs why a connection was closed and how many messages were
+// received on it
+func (s *Server) logDisconnect(conn net.Conn, reason DisconnectReason, received uint64, err error) {
+	if s.StructuredLogger != nil {
+		if reason == DisconnectProtocolError {
+			logAttrs(s.StructuredLogger, slog.LevelWarn, "decode error", remoteAddrAttr(conn), errorAttr(err))
+		}
+		attrs := []slog.Attr{remoteAddrAttr(conn), slog.String(LogKeyReason, reason.String()), slog.Uint64(LogKeyMessages, received)}
+		if err != nil {
+			attrs = append(attrs, errorAttr(err))
+		}
+		logAttrs(s.StructuredLogger, slog.LevelInfo, "connection closed", attrs...)
 		return
 	}
 
-	// Read messages until connection is closed
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrDuplicateHandshake):
+		s.logf("Rejecting connection from %s: %v", conn.RemoteAddr(), err)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		s.logf("Timed out reading from %s", conn.RemoteAddr())
+	case reason == DisconnectProtocolError:
+		s.logf("Error reading message: %v", err)
+	case reason == DisconnectNetworkError:
+		s.logf("Network error on connection from %s: %v", conn.RemoteAddr(), err)
+	}
+	s.logf("Connection closed from %s: %s", conn.RemoteAddr(), reason)
+}
+
+// remoteAddrAttr returns a log attribute for the remote address of a connection
+func remoteAddrAttr(conn net.Conn) slog.Attr {
+	return slog.Any(LogKeyRemoteAddr, conn.RemoteAddr())
+}
+
+// readMessages handles messages from a client connection until it is closed,
+// returning the number of messages received and the error that ended the
+// connection, or nil for a clean close
+func (s *Server) readMessages(conn net.Conn, info ConnInfo) (uint64, error) {
+	r := bufio.NewReader(conn)
+	var cw *CompressedWriter
+	useAck := false
+	var sequence sequenceChecker
+	var buf readBuffer
+	var received uint64
+	limits := DecodeLimits{MaxMessageSize: s.MaxMessageSize, SkipOversized: true}.withDefaults()
 	for {
-		m := &Message{}
-		if err := m.Read(conn); err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading message: %v", err)
+		if err := s.setReadDeadline(conn); err != nil {
+			return received, err
+		}
+
+		// Reject clients that send a second signature instead of a message
+		if isSignature(r) {
+			return received, ErrDuplicateHandshake
+		}
+
+		m := AcquireMessage()
+		err := decodeMessage(r, m, limits, nil, s.LenientDecode, 0, &buf)
+		if errors.Is(err, errNonstandardTrailer) {
+			if !logAttrs(s.StructuredLogger, slog.LevelWarn, "nonstandard trailer", remoteAddrAttr(conn), errorAttr(err)) {
+				s.logf("Warning: message from %s: %v", conn.RemoteAddr(), err)
 			}
-			log.Printf("Connection closed from %s", conn.RemoteAddr())
-			return
+			err = nil
+		}
+		if errors.Is(err, ErrMessageTooLarge) {
+			if !logAttrs(s.StructuredLogger, slog.LevelWarn, "message skipped", remoteAddrAttr(conn), errorAttr(err)) {
+				s.logf("Skipped message from %s: %v", conn.RemoteAddr(), err)
+			}
+			ReleaseMessage(m)
+			continue
+		}
+		if err == io.EOF {
+			return received, nil
+		}
+		if err != nil {
+			return received, err
 		}
 		if len(m.Raw) == 0 {
 			// look for v3 control messages
-			capabilities, ok := m.Fields["__s2s_capabilities"]
+			capabilities, ok := m.Fields[capabilitiesKey]
 			if ok {
-				log.Printf("Received s2s capabilities: %s", capabilities)
+				s.stats.controlMessages.Add(1)
+				if !logAttrs(s.StructuredLogger, slog.LevelDebug, "capabilities received", remoteAddrAttr(conn),
+					slog.String(LogKeyControl, capabilities)) {
+					s.logf("Received s2s capabilities: %s", capabilities)
+				}
+				clientCaps := parseControlValues(capabilities)
+				useAck = clientCaps["ack"] == "1"
+				caps := s.Capabilities
+				caps.Compression = caps.Compression && clientCaps["compression"] == "1"
+				compressed := caps.Compression
 				v3Response := &Message{
 					Fields: map[string]string{
-						// from pcap: "cap_response=success;cap_flush_key=true;idx_can_send_hb=true;idx_can_recv_token=true;request_certificate=true;v4=true;channel_limit=300;pl=7"
-						"__s2s_control_msg": "cap_response=success;cap_flush_key=false;idx_can_send_hb=false;idx_can_recv_token=false;request_certificate=false;v4=false;channel_limit=300;pl=7",
+						controlMsgKey: caps.String(),
 					},
 				}
 				if err := v3Response.Write(conn); err != nil {
-					log.Printf("Error sending capabilities response: %v", err)
-					return
+					return received, fmt.Errorf("sending capabilities response: %w", err)
+				}
+				if compressed {
+					zr, err := NewCompressedReader(r)
+					if err != nil {
+						return received, fmt.Errorf("reading compressed stream: %w", err)
+					}
+					defer zr.Close()
+					r = bufio.NewReader(zr)
+					cw = NewCompressedWriter(conn)
 				}
+				ReleaseMessage(m)
 				continue
 			}
+			if isControlMessage(m) {
+				s.stats.controlMessages.Add(1)
+				if !logAttrs(s.StructuredLogger, slog.LevelDebug, "control message received", remoteAddrAttr(conn),
+					slog.String(LogKeyControl, m.Fields[controlMsgKey])) {
+					s.logf("Received s2s control message from %s: %s", conn.RemoteAddr(), m.Fields[controlMsgKey])
+				}
+				ReleaseMessage(m)
+				continue
+			}
+		}
+		s.stats.messagesReceived.Add(1)
+		received++
+		ackID, hasAckID := m.Fields[ackIDKey]
+		channelID, hasChannel := m.Fields[channelKey]
+		delete(m.Fields, ackIDKey)
+		delete(m.Fields, channelKey)
+		if s.VerifySequence {
+			if problem := sequence.check(m); problem != "" {
+				if !logAttrs(s.StructuredLogger, slog.LevelWarn, "sequence problem", remoteAddrAttr(conn),
+					slog.String(LogKeyReason, problem)) {
+					s.logf("Message from %s: %s", conn.RemoteAddr(), problem)
+				}
+			}
 		}
-		fmt.Printf("Received message: %s\n", m.String())
+		if s.ParseMeta {
+			if err := unpackMeta(m); err != nil {
+				if !logAttrs(s.StructuredLogger, slog.LevelWarn, "invalid _meta", remoteAddrAttr(conn), errorAttr(err)) {
+					s.logf("Message from %s: %v", conn.RemoteAddr(), err)
+				}
+			}
+		}
+		if s.StampReceiveTime && m.Time.IsZero() {
+			m.Time = time.Now()
+			m.ReceiveTime = true
+		}
+		// a message that cannot be decompressed is delivered as it was received
+		if err := decompressRaw(m, limits.MaxMessageSize); err != nil {
+			if !logAttrs(s.StructuredLogger, slog.LevelWarn, "decompression failed", remoteAddrAttr(conn), errorAttr(err)) {
+				s.logf("Message from %s: %v", conn.RemoteAddr(), err)
+			}
+		}
+		success := true
+		if s.Handler != nil {
+			if err := s.Handler.HandleMessage(info, m); err != nil {
+				if !logAttrs(s.StructuredLogger, slog.LevelError, "handler error", remoteAddrAttr(conn), errorAttr(err)) {
+					s.logf("Error handling message from %s: %v", conn.RemoteAddr(), err)
+				}
+				success = false
+			}
+		}
+		ReleaseMessage(m)
+		if useAck && hasAckID {
+			id, err := strconv.ParseUint(ackID, 10, 64)
+			if err != nil {
+				if !logAttrs(s.StructuredLogger, slog.LevelWarn, "invalid ack id", remoteAddrAttr(conn), slog.String(LogKeyAckID, ackID)) {
+					s.logf("Invalid ack id received: %q", ackID)
+				}
+				continue
+			}
+			var channel uint64
+			if hasChannel {
+				if channel, err = strconv.ParseUint(channelID, 10, 64); err != nil {
+					if !logAttrs(s.StructuredLogger, slog.LevelWarn, "invalid channel", remoteAddrAttr(conn),
+						slog.String(LogKeyChannel, channelID)) {
+						s.logf("Invalid channel received: %q", channelID)
+					}
+					continue
+				}
+			}
+			if cw != nil {
+				err = SendChannelAck(cw, channel, id, success)
+				if err == nil {
+					err = cw.Flush()
+				}
+			} else {
+				err = SendChannelAck(conn, channel, id, success)
+			}
+			if err != nil {
+				return received, fmt.Errorf("sending ack: %w", err)
+			}
+		}
+	}
+}
+
+// setReadDeadline applies ReadTimeout to the next read from a connection
+func (s *Server) setReadDeadline(conn net.Conn) error {
+	if s.ReadTimeout <= 0 {
+		return nil
+	}
+	return conn.SetReadDeadline(time.Now().Add(s.ReadTimeout))
+}
+
+// isSignature returns true if the next bytes to be read are a protocol signature
+func isSignature(r *bufio.Reader) bool {
+	prefix, err := r.Peek(len(signaturePrefix))
+	if err != nil {
+		return false
 	}
+	return bytes.Equal(prefix, []byte(signaturePrefix))
+}
+
+// logf logs a message using the server's Logger, if any. Callers log to
+// StructuredLogger with logAttrs instead when it is set.
+func (s *Server) logf(format string, v ...any) {
+	if s.Logger != nil {
+		s.Logger.Printf(format, v...)
+	}
+}
+
+// removeStaleSocket removes a Unix domain socket file left behind by a
+// previous server so that it can be listened on again
+func removeStaleSocket(path string) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// isTemporary returns true if the error is a temporary network error
+func isTemporary(err error) bool {
+	var te interface{ Temporary() bool }
+	return errors.As(err, &te) && te.Temporary()
 }
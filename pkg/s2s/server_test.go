@@ -0,0 +1,1280 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestServer starts a server on a random local port and returns it
+func startTestServer(t *testing.T) *Server {
+	t.Helper()
+	return startTestServerWith(t, func(*Server) {})
+}
+
+// startTestServerWith starts a server on a random local port after
+// configure has set its options, and returns it
+func startTestServerWith(t *testing.T, configure func(s *Server)) *Server {
+	t.Helper()
+	s := NewServer("127.0.0.1:0")
+	configure(s)
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+	return s
+}
+
+func TestServerSendsAcks(t *testing.T) {
+	s := startTestServer(t)
+	if s.Handler != nil {
+		t.Fatalf("Handler = %v, want nil so that messages are discarded", s.Handler)
+	}
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+
+	for i := 0; i < 3; i++ {
+		if err := c.SendMessageAck(&Message{Raw: "acked message"}); err != nil {
+			t.Fatalf("SendMessageAck() error = %v", err)
+		}
+	}
+}
+
+// withCompression configures a test server to negotiate compression
+func withCompression(s *Server) {
+	s.Capabilities.Compression = true
+}
+
+func TestServerCompression(t *testing.T) {
+	s := startTestServerWith(t, withCompression)
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+	c.Compressed = true
+
+	for i := 0; i < 3; i++ {
+		if err := c.SendMessageAck(&Message{Raw: "compressed message"}); err != nil {
+			t.Fatalf("SendMessageAck() error = %v", err)
+		}
+	}
+	if !c.Compressed {
+		t.Error("Compressed = false after handshake, want true")
+	}
+}
+
+func TestServerRejectsDuplicateSignature(t *testing.T) {
+	s := startTestServer(t)
+	endpoint := s.listener.Addr().String()
+
+	conn, err := net.Dial("tcp", endpoint)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	for i := 0; i < 2; i++ {
+		if err := writeSignature(conn, endpoint, 2); err != nil {
+			t.Fatalf("writeSignature() error = %v", err)
+		}
+	}
+
+	// the server should close the connection rather than wait for more data
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Errorf("Read() error = %v, want EOF", err)
+	}
+}
+
+func TestIsSignature(t *testing.T) {
+	var sig bytes.Buffer
+	if err := writeSignature(&sig, "test-server:8089", 3); err != nil {
+		t.Fatalf("writeSignature() error = %v", err)
+	}
+	var msg bytes.Buffer
+	if err := EncodeMessage(&msg, &Message{Raw: "test"}); err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+
+	if !isSignature(bufio.NewReader(&sig)) {
+		t.Error("isSignature(signature) = false, want true")
+	}
+	if isSignature(bufio.NewReader(&msg)) {
+		t.Error("isSignature(message) = true, want false")
+	}
+	if isSignature(bufio.NewReader(bytes.NewReader(nil))) {
+		t.Error("isSignature(empty) = true, want false")
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	var mu sync.Mutex
+	var received []*Message
+	s := startTestServer(t)
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		if m.Raw == "reject" {
+			return errors.New("rejected")
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, m.Clone())
+		return nil
+	})
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+
+	want := []string{"first", "second", "third"}
+	for _, raw := range want {
+		if err := c.SendMessageAck(&Message{Index: "main", Raw: raw}); err != nil {
+			t.Fatalf("SendMessageAck() error = %v", err)
+		}
+	}
+	if err := c.SendMessageAck(&Message{Raw: "reject"}); err != ErrAckFailed {
+		t.Errorf("SendMessageAck() error = %v, want %v", err, ErrAckFailed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != len(want) {
+		t.Fatalf("received %d messages, want %d", len(received), len(want))
+	}
+	for i, m := range received {
+		if m.Raw != want[i] || m.Index != "main" {
+			t.Errorf("received[%d] = %v, want index=main _raw=%v", i, m, want[i])
+		}
+		if _, ok := m.Fields[ackIDKey]; ok {
+			t.Errorf("received[%d] contains %s field", i, ackIDKey)
+		}
+	}
+}
+
+func TestServerMessages(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	messages := s.Messages()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	const perConn = 50
+	var wg sync.WaitGroup
+	for _, index := range []string{"conn1", "conn2"} {
+		wg.Add(1)
+		go func(index string) {
+			defer wg.Done()
+			c, err := Connect(s.listener.Addr().String())
+			if err != nil {
+				t.Errorf("Connect() error = %v", err)
+				return
+			}
+			defer c.Close()
+			for i := 0; i < perConn; i++ {
+				if err := c.SendMessage(&Message{Index: index, Raw: strconv.Itoa(i)}); err != nil {
+					t.Errorf("SendMessage() error = %v", err)
+					return
+				}
+			}
+		}(index)
+	}
+
+	next := map[string]int{}
+	for i := 0; i < 2*perConn; i++ {
+		select {
+		case m := <-messages:
+			if m.Raw != strconv.Itoa(next[m.Index]) {
+				t.Errorf("message from %s = %v, want %v", m.Index, m.Raw, next[m.Index])
+			}
+			next[m.Index]++
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out after %d messages", i)
+		}
+	}
+	wg.Wait()
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if _, ok := <-messages; ok {
+		t.Error("Messages() channel open after Stop, want closed")
+	}
+}
+
+// captureLogger is a Logger that records log messages
+type captureLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *captureLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *captureLogger) contains(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.messages {
+		if strings.Contains(m, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestServerLogger(t *testing.T) {
+	logger := &captureLogger{}
+	s := NewServer("127.0.0.1:0")
+	s.Logger = logger
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+
+	var signature [handshakeSize]byte
+	copy(signature[:], "--not-a-valid-signature--")
+	if _, err := conn.Write(signature[:]); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	// wait for the server to close the connection
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	var netErr net.Error
+	if _, err := conn.Read(make([]byte, 1)); errors.As(err, &netErr) && netErr.Timeout() {
+		t.Fatalf("Read() error = %v, want connection closed", err)
+	}
+
+	if !logger.contains("Invalid signature received") {
+		t.Errorf("logged messages = %q, want invalid signature", logger.messages)
+	}
+}
+
+func TestServerStopWaitsForConnections(t *testing.T) {
+	const count = 5
+	var mu sync.Mutex
+	handled := 0
+	started := make(chan struct{}, count)
+
+	s := NewServer("127.0.0.1:0")
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		started <- struct{}{}
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		defer mu.Unlock()
+		handled++
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	for i := 0; i < count; i++ {
+		if err := c.SendMessage(&Message{Raw: "buffered message"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	c.Close()
+
+	// wait for the connection to be accepted before stopping
+	<-started
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if handled != count {
+		t.Errorf("handled %d messages before Stop returned, want %d", handled, count)
+	}
+
+	// stopping twice should not panic
+	if err := s.Stop(); err != nil {
+		t.Errorf("second Stop() error = %v", err)
+	}
+}
+
+func TestServerStopTimeout(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.StopTimeout = 50 * time.Millisecond
+	s.Logger = nil
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.SendMessage(&Message{Raw: "idle connection"}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	// wait for the connection to be tracked
+	for i := 0; i < 100; i++ {
+		s.connsMu.Lock()
+		n := len(s.conns)
+		s.connsMu.Unlock()
+		if n > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s.Stop(); !errors.Is(err, ErrStopTimeout) {
+		t.Errorf("Stop() error = %v, want %v", err, ErrStopTimeout)
+	}
+}
+
+func TestServerServeConnDuringStop(t *testing.T) {
+	// ServeConn racing with Stop must either serve the connection, which Stop
+	// then closes, or close it at once, and never add to a finished wait group
+	for i := 0; i < 100; i++ {
+		s := NewServer("127.0.0.1:0")
+		s.Logger = nil
+		s.StopTimeout = time.Millisecond
+		client, server := net.Pipe()
+		served := make(chan struct{})
+		go func() {
+			s.ServeConn(server)
+			close(served)
+		}()
+		s.Stop()
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("ServeConn() did not return after Stop()")
+		}
+		client.Close()
+	}
+}
+
+func TestServerVerifySequence(t *testing.T) {
+	logger := &captureLogger{}
+	var mu sync.Mutex
+	var received []*Message
+
+	s := NewServer("127.0.0.1:0")
+	s.Logger = logger
+	s.VerifySequence = true
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, m.Clone())
+		return nil
+	})
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	// skip sequence number 3
+	for _, seq := range []string{"1", "2", "4"} {
+		m := &Message{Raw: "message " + seq, Fields: map[string]string{sequenceKey: seq}}
+		if err := c.SendMessage(m); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	c.Close()
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+
+	if !logger.contains("sequence gap: expected 3, got 4") {
+		t.Errorf("logged messages = %q, want sequence gap", logger.messages)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, m := range received {
+		if _, ok := m.Fields[sequenceKey]; ok {
+			t.Errorf("message %v contains %s field", m, sequenceKey)
+		}
+	}
+}
+
+func TestSequenceChecker(t *testing.T) {
+	tests := []struct {
+		name    string
+		seqs    []string
+		problem string
+	}{
+		{"in order", []string{"1", "2", "3"}, ""},
+		{"gap", []string{"1", "3"}, "sequence gap: expected 2, got 3 (1 missing)"},
+		{"duplicate", []string{"1", "2", "2"}, "duplicate or reordered sequence: expected 3, got 2"},
+		{"invalid", []string{"x"}, `invalid sequence number "x"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sc sequenceChecker
+			var problem string
+			for _, seq := range tt.seqs {
+				problem = sc.check(&Message{Fields: map[string]string{sequenceKey: seq}})
+			}
+			if problem != tt.problem {
+				t.Errorf("check() = %q, want %q", problem, tt.problem)
+			}
+		})
+	}
+}
+
+// temporaryError is a net.Error that reports itself as temporary
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary accept error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// fakeListener is a net.Listener that returns temporary errors before a connection
+type fakeListener struct {
+	mu       sync.Mutex
+	failures int
+	conns    []net.Conn
+	accepted int
+}
+
+func (l *fakeListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.failures > 0 {
+		l.failures--
+		return nil, temporaryError{}
+	}
+	if len(l.conns) == 0 {
+		return nil, net.ErrClosed
+	}
+	conn := l.conns[0]
+	l.conns = l.conns[1:]
+	l.accepted++
+	return conn, nil
+}
+
+func (l *fakeListener) Close() error   { return nil }
+func (l *fakeListener) Addr() net.Addr { return &net.TCPAddr{} }
+
+func TestServerAcceptBackoff(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	listener := &fakeListener{failures: 3, conns: []net.Conn{server}}
+
+	s := NewServer("")
+	s.Logger = nil
+	s.listener = listener
+
+	start := time.Now()
+	s.wg.Add(1)
+	s.acceptConnections()
+	elapsed := time.Since(start)
+
+	// 5ms + 10ms + 20ms of backoff
+	if elapsed < 35*time.Millisecond {
+		t.Errorf("acceptConnections() returned after %v, want at least 35ms of backoff", elapsed)
+	}
+	if listener.accepted != 1 {
+		t.Errorf("accepted %d connections, want 1", listener.accepted)
+	}
+	client.Close()
+	if err := s.Stop(); err != nil {
+		t.Errorf("Stop() error = %v", err)
+	}
+}
+
+// dialWithSignature opens a raw connection to the server and sends a v2 signature
+func dialWithSignature(t *testing.T, endpoint string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", endpoint)
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	if err := writeSignature(conn, endpoint, 2); err != nil {
+		t.Fatalf("writeSignature() error = %v", err)
+	}
+	return conn
+}
+
+// waitForActive waits until the server has the given number of active connections
+func waitForActive(t *testing.T, s *Server, want int) {
+	t.Helper()
+	for i := 0; i < 200; i++ {
+		if s.ActiveConnections() == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("ActiveConnections() = %d, want %d", s.ActiveConnections(), want)
+}
+
+func TestServerMaxConnectionsReject(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.Logger = nil
+	s.MaxConnections = 2
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+	endpoint := s.listener.Addr().String()
+
+	for i := 0; i < 2; i++ {
+		conn := dialWithSignature(t, endpoint)
+		defer conn.Close()
+	}
+	waitForActive(t, s, 2)
+
+	// the extra connection should be closed by the server
+	extra := dialWithSignature(t, endpoint)
+	defer extra.Close()
+	if err := extra.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	var netErr net.Error
+	if _, err := extra.Read(make([]byte, 1)); err == nil || (errors.As(err, &netErr) && netErr.Timeout()) {
+		t.Errorf("Read() error = %v, want connection closed", err)
+	}
+	if got := s.ActiveConnections(); got != 2 {
+		t.Errorf("ActiveConnections() = %d, want 2", got)
+	}
+}
+
+func TestServerMaxConnectionsBlock(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.Logger = nil
+	s.MaxConnections = 1
+	s.BlockOnMaxConns = true
+	messages := s.Messages()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+	endpoint := s.listener.Addr().String()
+
+	first := dialWithSignature(t, endpoint)
+	defer first.Close()
+	waitForActive(t, s, 1)
+
+	// the second connection is queued until the first is closed
+	second := dialWithSignature(t, endpoint)
+	defer second.Close()
+	if err := (&Message{Raw: "queued"}).Write(second); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	select {
+	case m := <-messages:
+		t.Fatalf("received %v while connection limit reached", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	first.Close()
+	select {
+	case m := <-messages:
+		if m.Raw != "queued" {
+			t.Errorf("received %v, want queued", m)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for queued connection")
+	}
+}
+
+func TestServerReadTimeout(t *testing.T) {
+	logger := &captureLogger{}
+	s := NewServer("127.0.0.1:0")
+	s.Logger = logger
+	s.ReadTimeout = 100 * time.Millisecond
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("--splunk-cooked")); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	start := time.Now()
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("SetReadDeadline() error = %v", err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("Read() error = %v, want EOF", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("connection closed after %v, want about %v", elapsed, s.ReadTimeout)
+	}
+	waitForActive(t, s, 0)
+}
+
+func TestServerCapabilities(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.Logger = nil
+	s.Handler = nil
+	s.Capabilities = Capabilities{
+		Version:          3,
+		V4:               true,
+		ChannelLimit:     50,
+		PipelineLevel:    3,
+		CanSendHeartbeat: true,
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.Compressed = true
+
+	if err := c.SendMessage(&Message{Raw: "test"}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	if c.Capabilities != s.Capabilities {
+		t.Errorf("Capabilities = %+v, want %+v", c.Capabilities, s.Capabilities)
+	}
+	if c.Compressed {
+		t.Error("Compressed = true, want false when server does not support it")
+	}
+}
+
+func TestDefaultServerCapabilities(t *testing.T) {
+	// the default must stay byte-identical to the response Server has always sent
+	want := "cap_response=success;cap_flush_key=false;idx_can_send_hb=false;idx_can_recv_token=false;request_certificate=false;v4=false;channel_limit=300;pl=7"
+	if got := DefaultServerCapabilities.String(); got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+	if got := parseCapabilities(want); got != DefaultServerCapabilities {
+		t.Errorf("parseCapabilities() = %+v, want %+v", got, DefaultServerCapabilities)
+	}
+}
+
+func TestServerUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "s2s.sock")
+	endpoint := UnixPrefix + path
+
+	s := NewServer(endpoint)
+	s.Logger = nil
+	messages := s.Messages()
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	want := &Message{Index: "main", Host: "localhost", Raw: "unix socket message"}
+	if err := c.SendMessage(want); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+	select {
+	case got := <-messages:
+		if got.String() != want.String() {
+			t.Errorf("received %v, want %v", got, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+	c.Close()
+
+	if err := s.Stop(); err != nil {
+		t.Fatalf("Stop() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file still exists after Stop: %v", err)
+	}
+}
+
+func TestServerIgnoresHeartbeats(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		var mu sync.Mutex
+		var received []*Message
+		s := startTestServerWith(t, withCompression)
+		s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+			mu.Lock()
+			defer mu.Unlock()
+			received = append(received, m.Clone())
+			return nil
+		})
+
+		c, err := Connect(s.listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Connect() error = %v", err)
+		}
+		c.UseAck = true
+		c.Compressed = compressed
+
+		if err := c.Ping(); err != nil {
+			t.Fatalf("Ping() error = %v", err)
+		}
+		if err := c.SendMessageAck(&Message{Raw: "event"}); err != nil {
+			t.Fatalf("SendMessageAck() error = %v", err)
+		}
+		c.Close()
+
+		mu.Lock()
+		if len(received) != 1 || received[0].Raw != "event" {
+			t.Errorf("compressed=%v: handler received %v, want only the event", compressed, received)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	s.Logger = nil
+	s.Handler = nil
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+	endpoint := s.listener.Addr().String()
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+	if err := c.Ping(); err != nil {
+		t.Fatalf("Ping() error = %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := c.SendMessageAck(&Message{Raw: "event"}); err != nil {
+			t.Fatalf("SendMessageAck() error = %v", err)
+		}
+	}
+
+	// an invalid signature and a truncated message are both decode errors
+	bad, err := net.Dial("tcp", endpoint)
+	if err != nil {
+		t.Fatalf("net.Dial() error = %v", err)
+	}
+	bad.Write(make([]byte, 128))
+	bad.Close()
+	truncated := dialWithSignature(t, endpoint)
+	truncated.Write([]byte{0, 0, 0, 100, 0, 0})
+	truncated.Close()
+
+	want := ServerStats{
+		TotalConnections:  3,
+		ActiveConnections: 1,
+		MessagesReceived:  3,
+		ControlMessages:   2,
+		DecodeErrors:      2,
+	}
+	var got ServerStats
+	for i := 0; i < 200; i++ {
+		if got = s.Stats(); got == want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Stats() = %+v, want %+v", got, want)
+}
+
+func TestServerStampReceiveTime(t *testing.T) {
+	received := make(chan *Message, 2)
+	s := startTestServer(t)
+	s.Logger = nil
+	s.StampReceiveTime = true
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		received <- m.Clone()
+		return nil
+	})
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	eventTime := time.Unix(1700000000, 0)
+	before := time.Now()
+	for _, m := range []*Message{{Raw: "no time"}, {Raw: "with time", Time: eventTime}} {
+		if err := c.SendMessage(m); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+
+	m := <-received
+	if !m.ReceiveTime || m.Time.Before(before) || m.Time.After(time.Now()) {
+		t.Errorf("message without _time has Time = %v, ReceiveTime = %v, want receive time after %v", m.Time, m.ReceiveTime, before)
+	}
+	m = <-received
+	if m.ReceiveTime || !m.Time.Equal(eventTime) {
+		t.Errorf("message with _time has Time = %v, ReceiveTime = %v, want %v", m.Time, m.ReceiveTime, eventTime)
+	}
+}
+
+// recordHandler is a slog.Handler that captures records
+type recordHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *recordHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r.Clone())
+	return nil
+}
+
+// attrs returns the attributes of the first record with the given message
+func (h *recordHandler) attrs(msg string) (map[string]slog.Value, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Message == msg {
+			attrs := make(map[string]slog.Value)
+			r.Attrs(func(a slog.Attr) bool {
+				attrs[a.Key] = a.Value
+				return true
+			})
+			return attrs, true
+		}
+	}
+	return nil, false
+}
+
+func TestServerStructuredLogger(t *testing.T) {
+	h := &recordHandler{}
+	s := startTestServer(t)
+	s.Logger = &captureLogger{}
+	s.StructuredLogger = slog.New(h)
+	s.Handler = nil
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := c.SendMessage(&Message{Raw: "event"}); err != nil {
+			t.Fatalf("SendMessage() error = %v", err)
+		}
+	}
+	c.Close()
+	waitForActive(t, s, 0)
+	bad := dialWithSignature(t, s.listener.Addr().String())
+	bad.Write([]byte{0, 0, 0, 100, 0, 0})
+	bad.Close()
+	for i := 0; i < 200; i++ {
+		if _, ok := h.attrs("decode error"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	tests := []struct {
+		msg  string
+		want map[string]string
+	}{
+		{"connection accepted", map[string]string{LogKeyVersion: "3"}},
+		{"connection closed", map[string]string{LogKeyReason: DisconnectClosed.String(), LogKeyMessages: "2"}},
+		{"decode error", nil},
+	}
+	for _, tt := range tests {
+		attrs, ok := h.attrs(tt.msg)
+		if !ok {
+			t.Errorf("no %q record logged", tt.msg)
+			continue
+		}
+		if _, ok := attrs[LogKeyRemoteAddr]; !ok {
+			t.Errorf("%q record has no %s attribute", tt.msg, LogKeyRemoteAddr)
+		}
+		for k, v := range tt.want {
+			if got := attrs[k].String(); got != v {
+				t.Errorf("%q record %s = %q, want %q", tt.msg, k, got, v)
+			}
+		}
+	}
+	if logger := s.Logger.(*captureLogger); len(logger.messages) != 0 {
+		t.Errorf("Logger received %q, want nothing when StructuredLogger is set", logger.messages)
+	}
+}
+
+// level returns the level of the first record with the given message
+func (h *recordHandler) level(msg string) (slog.Level, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.records {
+		if r.Message == msg {
+			return r.Level, true
+		}
+	}
+	return 0, false
+}
+
+func TestServerStructuredLoggerErrors(t *testing.T) {
+	h := &recordHandler{}
+	errHandler := errors.New("handler failed")
+	s := startTestServerWith(t, func(s *Server) {
+		s.Logger = nil
+		s.StructuredLogger = slog.New(h)
+		s.Handler = HandlerFunc(func(ConnInfo, *Message) error { return errHandler })
+	})
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.SendString("event"); err != nil {
+		t.Fatalf("SendString() error = %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		if _, ok := h.level("handler error"); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	level, ok := h.level("handler error")
+	if !ok {
+		t.Fatal("no \"handler error\" record logged")
+	}
+	if level != slog.LevelError {
+		t.Errorf("\"handler error\" record level = %v, want %v", level, slog.LevelError)
+	}
+	attrs, _ := h.attrs("handler error")
+	if got := attrs[LogKeyError].String(); got != errHandler.Error() {
+		t.Errorf("\"handler error\" record %s = %q, want %q", LogKeyError, got, errHandler)
+	}
+	if _, ok := attrs[LogKeyRemoteAddr]; !ok {
+		t.Errorf("\"handler error\" record has no %s attribute", LogKeyRemoteAddr)
+	}
+}
+
+func TestServerHandlerConnInfo(t *testing.T) {
+	infos := make(chan ConnInfo, 1)
+	s := startTestServer(t)
+	s.Logger = nil
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		infos <- info
+		return nil
+	})
+	endpoint := s.listener.Addr().String()
+
+	c, err := Connect(endpoint)
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	if err := c.SendMessage(&Message{Raw: "event"}); err != nil {
+		t.Fatalf("SendMessage() error = %v", err)
+	}
+
+	// clients identify themselves by their hostname and the indexer's port
+	host, port, _ := net.SplitHostPort(endpoint)
+	host = cmp.Or(Hostname(), host)
+	select {
+	case info := <-infos:
+		if info.Version != 3 || info.ServerName != host || info.ManagementPort != port {
+			t.Errorf("ConnInfo = %+v, want v3 from %s:%s", info, host, port)
+		}
+		if info.RemoteAddr == nil || info.RemoteAddr.String() != c.conn.LocalAddr().String() {
+			t.Errorf("ConnInfo.RemoteAddr = %v, want %v", info.RemoteAddr, c.conn.LocalAddr())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+func TestServerAddr(t *testing.T) {
+	s := NewServer("127.0.0.1:0")
+	if addr := s.Addr(); addr != nil {
+		t.Errorf("Addr() before Start() = %v, want nil", addr)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	defer s.Stop()
+	if addr := s.Addr(); addr == nil || strings.HasSuffix(addr.String(), ":0") {
+		t.Errorf("Addr() = %v, want the listening address", addr)
+	}
+}
+
+// disconnectHandler records the reason each connection was closed
+type disconnectHandler struct {
+	HandlerFunc
+	reasons chan DisconnectReason
+}
+
+func (h disconnectHandler) OnDisconnect(info ConnInfo, reason DisconnectReason) {
+	h.reasons <- reason
+}
+
+func TestServerDisconnectReason(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want DisconnectReason
+	}{
+		{"clean close", nil, DisconnectClosed},
+		{"bad framing", []byte{0, 0, 0, 8, 0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0}, DisconnectProtocolError},
+		{"truncated message", []byte{0, 0, 0, 100, 0, 0}, DisconnectProtocolError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger := &captureLogger{}
+			h := disconnectHandler{reasons: make(chan DisconnectReason, 1)}
+			s := startTestServer(t)
+			s.Logger = logger
+			s.Handler = h
+
+			conn := dialWithSignature(t, s.listener.Addr().String())
+			if _, err := conn.Write(tt.data); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			conn.Close()
+
+			select {
+			case got := <-h.reasons:
+				if got != tt.want {
+					t.Errorf("OnDisconnect() reason = %v, want %v", got, tt.want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatal("OnDisconnect() was not called")
+			}
+			waitForActive(t, s, 0)
+			if !logger.contains(tt.want.String()) {
+				t.Errorf("logged messages = %q, want %q", logger.messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		consume bool
+		wantErr bool
+	}{
+		{"consumed", true, false},
+		{"not consumed", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer("127.0.0.1:0")
+			s.Logger = nil
+			messages := s.Messages()
+			if err := s.Start(); err != nil {
+				t.Fatalf("Start() error = %v", err)
+			}
+
+			c, err := Connect(s.listener.Addr().String())
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			for i := 0; i < 10; i++ {
+				if err := c.SendMessage(&Message{Raw: "event"}); err != nil {
+					t.Fatalf("SendMessage() error = %v", err)
+				}
+			}
+			c.Close()
+			for i := 0; i < 200 && s.Stats().MessagesReceived < 10; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			var consumed atomic.Int64
+			if tt.consume {
+				go func() {
+					for range messages {
+						time.Sleep(time.Millisecond)
+						consumed.Add(1)
+					}
+				}()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			err = s.Drain(ctx)
+			if tt.wantErr {
+				if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "10 messages") {
+					t.Errorf("Drain() error = %v, want %v with 10 messages queued", err, context.DeadlineExceeded)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Drain() error = %v", err)
+			}
+			// the last message may still be in the consumer's hands
+			for i := 0; i < 200 && consumed.Load() < 10; i++ {
+				time.Sleep(time.Millisecond)
+			}
+			if got := consumed.Load(); got != 10 {
+				t.Errorf("consumed %d messages, want 10", got)
+			}
+		})
+	}
+}
+
+func TestServerDecompressRaw(t *testing.T) {
+	received := make(chan *Message, 2)
+	s := startTestServer(t)
+	s.Logger = nil
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		received <- m.Clone()
+		return nil
+	})
+
+	c, err := Connect(s.listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.CompressRawOver = 1024
+
+	large := strings.Repeat("large compressible event payload\n", 4096)
+	for _, raw := range []string{"small event", large} {
+		if err := c.SendString(raw); err != nil {
+			t.Fatalf("SendString() error = %v", err)
+		}
+		select {
+		case m := <-received:
+			if m.Raw != raw {
+				t.Errorf("Raw has %d bytes, want %d", len(m.Raw), len(raw))
+			}
+			if _, ok := m.Fields[compressedRawKey]; ok {
+				t.Errorf("message has a %s field after decompression", compressedRawKey)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for message")
+		}
+	}
+	if got := c.Stats().BytesWritten; got >= uint64(len(large))/10 {
+		t.Errorf("Stats().BytesWritten = %d, want the large event compressed", got)
+	}
+}
+
+func TestServerDecompressRawInvalid(t *testing.T) {
+	received := make(chan *Message, 1)
+	logger := &captureLogger{}
+	s := startTestServer(t)
+	s.Logger = logger
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		received <- m.Clone()
+		return nil
+	})
+
+	conn := dialWithSignature(t, s.listener.Addr().String())
+	defer conn.Close()
+	sent := &Message{Raw: "not gzip", Fields: map[string]string{compressedRawKey: gzipEncoding}}
+	if err := sent.Write(conn); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	select {
+	case m := <-received:
+		if m.Raw != sent.Raw || m.Fields[compressedRawKey] != gzipEncoding {
+			t.Errorf("received %v, want %v unchanged", m, sent)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the message")
+	}
+	if !logger.contains("compressed _raw") {
+		t.Errorf("log = %v, want the decompression failure to be logged", logger.messages)
+	}
+}
+
+func TestServerMaxMessageSize(t *testing.T) {
+	received := make(chan string, 2)
+	logger := &captureLogger{}
+	s := startTestServer(t)
+	s.Logger = logger
+	s.MaxMessageSize = 1024
+	s.Handler = HandlerFunc(func(info ConnInfo, m *Message) error {
+		received <- m.Raw
+		return nil
+	})
+
+	conn := dialWithSignature(t, s.listener.Addr().String())
+	defer conn.Close()
+	for _, raw := range []string{strings.Repeat("x", 4096), "valid event"} {
+		if err := (&Message{Raw: raw}).Write(conn); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	select {
+	case raw := <-received:
+		if raw != "valid event" {
+			t.Errorf("received %d bytes, want %q", len(raw), "valid event")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the valid event")
+	}
+	if !logger.contains("exceeds limit of 1024") {
+		t.Errorf("log = %v, want the oversized message to be logged", logger.messages)
+	}
+	if got := s.Stats(); got.ActiveConnections != 1 || got.DecodeErrors != 0 {
+		t.Errorf("Stats() = %+v, want the connection to stay open", got)
+	}
+}
@@ -0,0 +1,121 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a snapshot of the counters for a splunk-to-splunk connection
+type ConnStats struct {
+	MessagesSent uint64
+	BytesWritten uint64
+	SendErrors   uint64
+	LastSend     time.Time
+}
+
+// connCounters are the counters for a connection, which are safe for concurrent use
+type connCounters struct {
+	messagesSent atomic.Uint64
+	bytesWritten atomic.Uint64
+	sendErrors   atomic.Uint64
+	lastSend     atomic.Int64
+	lastErr      atomic.Pointer[error]
+}
+
+// record updates the counters with the result of sending a message
+func (cc *connCounters) record(err error) {
+	if err != nil {
+		cc.sendErrors.Add(1)
+		cc.setError(err)
+		return
+	}
+	cc.messagesSent.Add(1)
+	cc.lastSend.Store(time.Now().UnixNano())
+}
+
+// setError records the most recent error for the connection
+func (cc *connCounters) setError(err error) {
+	cc.lastErr.Store(&err)
+}
+
+// lastError returns the most recent error for the connection, or nil
+func (cc *connCounters) lastError() error {
+	if err := cc.lastErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// snapshot returns the current values of the counters
+func (cc *connCounters) snapshot() ConnStats {
+	stats := ConnStats{
+		MessagesSent: cc.messagesSent.Load(),
+		BytesWritten: cc.bytesWritten.Load(),
+		SendErrors:   cc.sendErrors.Load(),
+	}
+	if last := cc.lastSend.Load(); last != 0 {
+		stats.LastSend = time.Unix(0, last)
+	}
+	return stats
+}
+
+// countingConn is a network connection that counts the bytes written to it
+type countingConn struct {
+	net.Conn
+	n *atomic.Uint64
+}
+
+// Write writes to the connection and counts the bytes written
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(uint64(n))
+	return n, err
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// ServerStats is a snapshot of the counters for a splunk-to-splunk server
+type ServerStats struct {
+	TotalConnections  uint64
+	ActiveConnections int
+	MessagesReceived  uint64
+	ControlMessages   uint64
+	DecodeErrors      uint64
+}
+
+// serverCounters are the counters for a server, which are safe for concurrent use
+type serverCounters struct {
+	totalConnections atomic.Uint64
+	messagesReceived atomic.Uint64
+	controlMessages  atomic.Uint64
+	decodeErrors     atomic.Uint64
+}
@@ -0,0 +1,127 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// DefaultWaitTimeout is how long AssertReceived waits for messages
+const DefaultWaitTimeout = 5 * time.Second
+
+// errRejected is returned by the handler for messages rejected by MockServer.Reject
+var errRejected = errors.New("message rejected by mock server")
+
+// MockServer is an indexer for tests that records the messages it receives.
+// It is backed by an s2s.Server listening on a local port, so it performs the
+// v2 or v3 handshake, negotiates compression and sends acknowledgements. If
+// Reject is set, messages for which it returns true are recorded but
+// acknowledged as failures.
+type MockServer struct {
+	Server   *s2s.Server
+	Reject   func(m *s2s.Message) bool
+	mu       sync.Mutex
+	messages []*s2s.Message
+	notify   chan struct{}
+}
+
+// NewMockServer starts a MockServer that is closed when the test finishes
+func NewMockServer(t testing.TB) *MockServer {
+	t.Helper()
+	ms := &MockServer{
+		Server: s2s.NewServer("127.0.0.1:0"),
+		notify: make(chan struct{}, 1),
+	}
+	ms.Server.Logger = nil
+	ms.Server.Handler = s2s.HandlerFunc(ms.handleMessage)
+	if err := ms.Server.Start(); err != nil {
+		t.Fatalf("Start() error = %v", err)
+	}
+	t.Cleanup(func() { ms.Close() })
+	return ms
+}
+
+// Endpoint returns the "host:port" endpoint to connect to
+func (ms *MockServer) Endpoint() string {
+	return ms.Server.Addr().String()
+}
+
+// Messages returns the messages received so far, in the order they arrived
+func (ms *MockServer) Messages() []*s2s.Message {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([]*s2s.Message(nil), ms.messages...)
+}
+
+// WaitForMessages waits until at least n messages have been received and
+// returns them, or returns the messages received so far after timeout
+func (ms *MockServer) WaitForMessages(n int, timeout time.Duration) []*s2s.Message {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		messages := ms.Messages()
+		if len(messages) >= n {
+			return messages
+		}
+		select {
+		case <-ms.notify:
+		case <-deadline.C:
+			return ms.Messages()
+		}
+	}
+}
+
+// Close stops the server, closing any open connections
+func (ms *MockServer) Close() error {
+	return ms.Server.Stop()
+}
+
+// handleMessage records a copy of each message, since the server reuses it
+func (ms *MockServer) handleMessage(info s2s.ConnInfo, m *s2s.Message) error {
+	ms.mu.Lock()
+	ms.messages = append(ms.messages, m.Clone())
+	ms.mu.Unlock()
+	select {
+	case ms.notify <- struct{}{}:
+	default:
+	}
+	if ms.Reject != nil && ms.Reject(m) {
+		return errRejected
+	}
+	return nil
+}
+
+// AssertReceived waits up to DefaultWaitTimeout for the server to receive
+// the wanted messages, and verifies that they match in order
+func AssertReceived(t testing.TB, ms *MockServer, want ...*s2s.Message) {
+	t.Helper()
+	got := ms.WaitForMessages(len(want), DefaultWaitTimeout)
+	if len(got) != len(want) {
+		t.Fatalf("received %d messages, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].Equal(want[i]) {
+			t.Errorf("message %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
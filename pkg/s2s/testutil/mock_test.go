@@ -0,0 +1,100 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+func TestMockServerRoundTrip(t *testing.T) {
+	messages := []*s2s.Message{
+		{Index: "main", Host: "host1", Raw: "first"},
+		{Index: "main", Time: time.Unix(1700000000, 0), Fields: map[string]string{"key": "value"}, Raw: "second"},
+	}
+	tests := []struct {
+		name       string
+		version    int
+		compressed bool
+		useAck     bool
+	}{
+		{"v2", 2, false, false},
+		{"v3", 3, false, false},
+		{"v3 compressed with acks", 3, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ms := NewMockServer(t)
+			c, err := s2s.Connect(ms.Endpoint())
+			if err != nil {
+				t.Fatalf("Connect() error = %v", err)
+			}
+			defer c.Close()
+			c.Version = tt.version
+			c.Compressed = tt.compressed
+			c.UseAck = tt.useAck
+
+			for _, m := range messages {
+				send := c.SendMessage
+				if tt.useAck {
+					send = c.SendMessageAck
+				}
+				if err := send(m); err != nil {
+					t.Fatalf("send error = %v", err)
+				}
+			}
+			AssertReceived(t, ms, messages...)
+		})
+	}
+}
+
+func TestMockServerReject(t *testing.T) {
+	ms := NewMockServer(t)
+	ms.Reject = func(m *s2s.Message) bool { return m.Raw == "bad" }
+
+	c, err := s2s.Connect(ms.Endpoint())
+	if err != nil {
+		t.Fatalf("Connect() error = %v", err)
+	}
+	defer c.Close()
+	c.UseAck = true
+
+	if err := c.SendMessageAck(&s2s.Message{Raw: "good"}); err != nil {
+		t.Errorf("SendMessageAck() error = %v", err)
+	}
+	if err := c.SendMessageAck(&s2s.Message{Raw: "bad"}); !errors.Is(err, s2s.ErrAckFailed) {
+		t.Errorf("SendMessageAck() error = %v, want %v", err, s2s.ErrAckFailed)
+	}
+	AssertReceived(t, ms, &s2s.Message{Raw: "good"}, &s2s.Message{Raw: "bad"})
+}
+
+func TestMockServerWaitTimeout(t *testing.T) {
+	ms := NewMockServer(t)
+	if got := ms.WaitForMessages(1, 10*time.Millisecond); len(got) != 0 {
+		t.Errorf("WaitForMessages() = %v, want no messages", got)
+	}
+	if err := ms.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+	if _, err := s2s.Connect(ms.Endpoint()); err == nil {
+		t.Error("Connect() after Close() error = nil, want connection refused")
+	}
+}
@@ -0,0 +1,124 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package testutil provides helpers for verifying conformance with the
+// Splunk-to-Splunk wire format produced by this library.
+package testutil
+
+import (
+	"bytes"
+	"encoding/binary"
+	"maps"
+	"slices"
+	"testing"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+// GoldenBytes returns the canonical wire encoding of a message. Fields are
+// encoded in sorted key order, so the result is stable across runs.
+func GoldenBytes(m *s2s.Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := s2s.EncodeMessage(&buf, m); err != nil {
+		return nil, err
+	}
+	b := buf.Bytes()
+	if len(m.Fields) < 2 {
+		return b, nil
+	}
+
+	// EncodeMessage writes Fields in map order after the metadata, so find
+	// them and rewrite them sorted; the sorted encoding has the same length
+	start := 8
+	for _, v := range []string{m.Index, m.Host, m.Source, m.SourceType} {
+		if v != "" {
+			start = skipStrings(b, start, 2)
+		}
+	}
+	end := skipStrings(b, start, 2*len(m.Fields))
+
+	var fields bytes.Buffer
+	for _, k := range slices.Sorted(maps.Keys(m.Fields)) {
+		if err := s2s.EncodeKeyValue(&fields, k, m.Fields[k]); err != nil {
+			return nil, err
+		}
+	}
+	copy(b[start:end], fields.Bytes())
+	return b, nil
+}
+
+// skipStrings returns the offset in b after n encoded strings starting at offset
+func skipStrings(b []byte, offset, n int) int {
+	for range n {
+		offset += 4 + int(binary.BigEndian.Uint32(b[offset:]))
+	}
+	return offset
+}
+
+// AssertRoundTrip encodes a message, decodes it, and verifies that the
+// decoded message matches the original and re-encodes to identical bytes.
+func AssertRoundTrip(t testing.TB, m *s2s.Message) {
+	t.Helper()
+
+	encoded, err := GoldenBytes(m)
+	if err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+
+	decoded := &s2s.Message{}
+	if err := s2s.DecodeMessage(bytes.NewReader(encoded), decoded); err != nil {
+		t.Fatalf("DecodeMessage() error = %v", err)
+	}
+
+	if decoded.Index != m.Index {
+		t.Errorf("Index = %v, want %v", decoded.Index, m.Index)
+	}
+	if decoded.Host != m.Host {
+		t.Errorf("Host = %v, want %v", decoded.Host, m.Host)
+	}
+	if decoded.Source != m.Source {
+		t.Errorf("Source = %v, want %v", decoded.Source, m.Source)
+	}
+	if decoded.SourceType != m.SourceType {
+		t.Errorf("SourceType = %v, want %v", decoded.SourceType, m.SourceType)
+	}
+	if decoded.Raw != m.Raw {
+		t.Errorf("Raw = %v, want %v", decoded.Raw, m.Raw)
+	}
+	if decoded.Time.Unix() != m.Time.Unix() {
+		t.Errorf("Time = %v, want %v", decoded.Time, m.Time)
+	}
+	if decoded.IndexTime.Unix() != m.IndexTime.Unix() {
+		t.Errorf("IndexTime = %v, want %v", decoded.IndexTime, m.IndexTime)
+	}
+	if len(decoded.Fields) != len(m.Fields) {
+		t.Errorf("Fields length = %v, want %v", len(decoded.Fields), len(m.Fields))
+	}
+	for k, v := range m.Fields {
+		if decoded.Fields[k] != v {
+			t.Errorf("Fields[%v] = %v, want %v", k, decoded.Fields[k], v)
+		}
+	}
+
+	reencoded, err := GoldenBytes(decoded)
+	if err != nil {
+		t.Fatalf("EncodeMessage() error = %v", err)
+	}
+	if !bytes.Equal(reencoded, encoded) {
+		t.Errorf("re-encoded bytes = %v, want %v", reencoded, encoded)
+	}
+}
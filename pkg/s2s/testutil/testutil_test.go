@@ -0,0 +1,114 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testutil
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/mikedickey/go-s2s/pkg/s2s"
+)
+
+func TestGoldenBytes(t *testing.T) {
+	m := &s2s.Message{Index: "main", Raw: "hi"}
+	want := []byte{
+		0, 0, 0, 82, 0, 0, 0, 3,
+		0, 0, 0, 16, '_', 'M', 'e', 't', 'a', 'D', 'a', 't', 'a', ':', 'I', 'n', 'd', 'e', 'x', 0,
+		0, 0, 0, 5, 'm', 'a', 'i', 'n', 0,
+		0, 0, 0, 6, '_', 'd', 'o', 'n', 'e', 0,
+		0, 0, 0, 6, '_', 'd', 'o', 'n', 'e', 0,
+		0, 0, 0, 5, '_', 'r', 'a', 'w', 0,
+		0, 0, 0, 3, 'h', 'i', 0,
+		0, 0, 0, 0,
+		0, 0, 0, 5, '_', 'r', 'a', 'w', 0,
+	}
+
+	got, err := GoldenBytes(m)
+	if err != nil {
+		t.Fatalf("GoldenBytes() error = %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("GoldenBytes() = %v, want %v", got, want)
+	}
+}
+
+func TestGoldenBytesDeterministic(t *testing.T) {
+	m := &s2s.Message{
+		Index: "main",
+		Host:  "host1",
+		Raw:   "test",
+		Fields: map[string]string{
+			"a": "1", "b": "2", "c": "3", "d": "4", "e": "5",
+		},
+	}
+	first, err := GoldenBytes(m)
+	if err != nil {
+		t.Fatalf("GoldenBytes() error = %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		got, err := GoldenBytes(m)
+		if err != nil {
+			t.Fatalf("GoldenBytes() error = %v", err)
+		}
+		if !bytes.Equal(got, first) {
+			t.Fatalf("GoldenBytes() = %v, want %v", got, first)
+		}
+	}
+}
+
+func TestAssertRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		message *s2s.Message
+	}{
+		{
+			name:    "minimal message",
+			message: &s2s.Message{Raw: "test message"},
+		},
+		{
+			name: "full message",
+			message: &s2s.Message{
+				Index:      "main",
+				Host:       "testhost",
+				Source:     "testsource",
+				SourceType: "test:sourcetype",
+				Raw:        "full test message",
+				Time:       time.Unix(1700000000, 0),
+				IndexTime:  time.Unix(1700000100, 0),
+				Fields: map[string]string{
+					"field1": "value1",
+					"field2": "value2",
+				},
+			},
+		},
+		{
+			name: "unicode message",
+			message: &s2s.Message{
+				Host: "世界",
+				Raw:  "🌍 test message",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			AssertRoundTrip(t, tt.message)
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+)
+
+var (
+	ErrEmptyMessage      = errors.New("message has no raw data or fields")
+	ErrInvalidSourceType = errors.New("invalid sourcetype")
+	ErrTooManyFields     = errors.New("message has too many fields")
+)
+
+// DefaultSourceTypePattern matches sourcetypes made of letters, digits,
+// underscores, hyphens, colons and periods, such as "access_combined" or
+// "WinEventLog:Security"
+var DefaultSourceTypePattern = regexp.MustCompile(`^[A-Za-z0-9_:.\-]+$`)
+
+// Validator checks messages before they are sent, reporting every problem
+// at once. MaxFields limits the number of fields, defaulting to
+// DefaultMaxFields, the most a Server decodes. SourceTypePattern must match
+// the SourceType of messages that have one, defaulting to
+// DefaultSourceTypePattern. If RequireIndex is set, messages must have an
+// Index, as with Conn.RequireIndex. Fields may not use the keys of
+// MetadataKeys, or DefaultMetadataKeys if it is nil, as with Encoder.
+type Validator struct {
+	MaxFields         int
+	SourceTypePattern *regexp.Regexp
+	RequireIndex      bool
+	MetadataKeys      *MetadataKeys
+}
+
+// Validate checks the message with the default Validator
+func (m *Message) Validate() error {
+	return Validator{}.Validate(m)
+}
+
+// Validate returns nil if the message is valid, or an error joining one error
+// for each problem found. Each wraps ErrEmptyMessage, ErrMissingIndex,
+// ErrInvalidSourceType, ErrTooManyFields, ErrInvalidFieldName or
+// ErrReservedField, so it can be checked with errors.Is.
+func (v Validator) Validate(m *Message) error {
+	if m == nil {
+		return ErrNilMessage
+	}
+
+	var errs []error
+	if m.Raw == "" && len(m.Fields) == 0 {
+		errs = append(errs, ErrEmptyMessage)
+	}
+	if v.RequireIndex && m.Index == "" {
+		errs = append(errs, ErrMissingIndex)
+	}
+	pattern := v.SourceTypePattern
+	if pattern == nil {
+		pattern = DefaultSourceTypePattern
+	}
+	if m.SourceType != "" && !pattern.MatchString(m.SourceType) {
+		errs = append(errs, fmt.Errorf("%w: %q", ErrInvalidSourceType, m.SourceType))
+	}
+	maxFields := v.MaxFields
+	if maxFields <= 0 {
+		maxFields = DefaultMaxFields
+	}
+	if len(m.Fields) > maxFields {
+		errs = append(errs, fmt.Errorf("%w: %d, limit %d", ErrTooManyFields, len(m.Fields), maxFields))
+	}
+
+	// sort the keys so that the problems are reported in a stable order
+	meta := metadataKeys(v.MetadataKeys)
+	for _, k := range slices.Sorted(maps.Keys(m.Fields)) {
+		if err := validateFieldName(k); err != nil {
+			errs = append(errs, err)
+		} else if isReservedField(k, m.Fields[k]) || meta.isKey(k) {
+			errs = append(errs, fmt.Errorf("%w: %q", ErrReservedField, k))
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+// ------------------------------------------------------------------
+// Splunk-to-Splunk Protocol Library
+// ------------------------------------------------------------------
+// Copyright (c) 2025 Mike Dickey
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s2s
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestValidatorValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		validator Validator
+		m         *Message
+		want      []error
+	}{
+		{
+			name: "valid",
+			m:    &Message{Raw: "event", SourceType: "WinEventLog:Security", Fields: map[string]string{"user": "alice"}},
+		},
+		{
+			name: "fields without raw",
+			m:    &Message{Fields: map[string]string{"metric_name:cpu": "1"}},
+		},
+		{
+			name: "nil",
+			want: []error{ErrNilMessage},
+		},
+		{
+			name: "empty",
+			m:    &Message{},
+			want: []error{ErrEmptyMessage},
+		},
+		{
+			name: "several problems",
+			m: &Message{
+				SourceType: "access log",
+				Fields: map[string]string{
+					"bad\xffkey": "v",
+					"_time":      "0",
+				},
+			},
+			validator: Validator{MaxFields: 1, RequireIndex: true},
+			want:      []error{ErrMissingIndex, ErrInvalidSourceType, ErrTooManyFields, ErrInvalidFieldName, ErrReservedField},
+		},
+		{
+			name: "compressed raw",
+			m:    &Message{Raw: "event", Fields: map[string]string{compressedRawKey: gzipEncoding}},
+		},
+		{
+			name: "compressed field",
+			m:    &Message{Raw: "event", Fields: map[string]string{compressedRawKey: "true"}},
+			want: []error{ErrReservedField},
+		},
+		{
+			name: "default metadata key",
+			m:    &Message{Raw: "event", Fields: map[string]string{"MetaData:Host": "web01"}},
+			want: []error{ErrReservedField},
+		},
+		{
+			name:      "custom metadata key",
+			m:         &Message{Raw: "event", Fields: map[string]string{"_host": "web01"}},
+			validator: Validator{MetadataKeys: &MetadataKeys{IndexKey: "_index", HostKey: "_host", SourceKey: "_source", SourceTypeKey: "_sourcetype"}},
+			want:      []error{ErrReservedField},
+		},
+		{
+			name:      "custom sourcetype pattern",
+			m:         &Message{Raw: "event", SourceType: "Access-Log"},
+			validator: Validator{SourceTypePattern: regexp.MustCompile(`^[a-z_]+$`)},
+			want:      []error{ErrInvalidSourceType},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.validator.Validate(tt.m)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			for _, want := range tt.want {
+				if !errors.Is(err, want) {
+					t.Errorf("Validate() error = %v, want it to wrap %v", err, want)
+				}
+			}
+			// errors.Join puts each problem on its own line
+			if got := len(strings.Split(err.Error(), "\n")); got != len(tt.want) {
+				t.Errorf("Validate() reported %d problems, want %d: %v", got, len(tt.want), err)
+			}
+		})
+	}
+}
+
+func TestMessageValidate(t *testing.T) {
+	if err := (&Message{Raw: "event"}).Validate(); err != nil {
+		t.Errorf("Validate() error = %v, want nil", err)
+	}
+	if err := (&Message{}).Validate(); !errors.Is(err, ErrEmptyMessage) {
+		t.Errorf("Validate() error = %v, want %v", err, ErrEmptyMessage)
+	}
+}